@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+var (
+	backupsList bool
+)
+
+// RestoreBackupCmd replaces the config file by one of its backups.
+var RestoreBackupCmd = &cobra.Command{
+	Use:   "restore-backup [NAME]",
+	Short: "Restore a previous version of the config file",
+	Long: `A copy of the config file is kept each time it is modified (the last 10 versions are kept).
+Use --list to display available backups, and pass a backup name to restore it, or select it
+interactively. The current config is itself backed up before being replaced.
+
+If the application is running, it automatically reloads the restored config.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		backups, e := config.NewConfigBackups().List()
+		if e != nil {
+			exit(e)
+		}
+		if backupsList {
+			if len(backups) == 0 {
+				fmt.Println("No backups found")
+			}
+			for _, b := range backups {
+				fmt.Printf("%s\t%s\t%d\n", b.Name, b.Time.Format("2006-01-02 15:04:05"), b.Size)
+			}
+			return
+		}
+		var name string
+		if len(args) > 0 {
+			name = args[0]
+		} else {
+			if len(backups) == 0 {
+				exit(fmt.Errorf("no backups found"))
+			}
+			var items []string
+			for _, b := range backups {
+				items = append(items, b.Time.Format("2006-01-02 15:04:05"))
+			}
+			s := promptui.Select{Label: "Select a backup to restore", Items: items}
+			i, _, e := s.Run()
+			if e != nil {
+				exit(e)
+			}
+			name = backups[i].Name
+		}
+		if e := config.RestoreBackup(name); e != nil {
+			exit(e)
+		}
+		fmt.Println("Config restored from " + name)
+	},
+}
+
+func init() {
+	RestoreBackupCmd.Flags().BoolVarP(&backupsList, "list", "l", false, "List available backups")
+	CfgCmd.AddCommand(RestoreBackupCmd)
+}
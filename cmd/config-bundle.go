@@ -0,0 +1,281 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skratchdot/open-golang/open"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+var (
+	bundleOutput  string
+	bundleFormat  string
+	bundleVars    []string
+	bundleGlobals bool
+	bundleLogin   bool
+)
+
+// parseBundleVars adds the NAME=VALUE flags to the default variables.
+func parseBundleVars() (map[string]string, error) {
+	vars := config.DefaultBundleVars()
+	for _, v := range bundleVars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid variable %s, please use NAME=VALUE", v)
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+// instanceRunning checks if the web server of a running instance can be reached.
+func instanceRunning() bool {
+	conn, e := statusConnect(configUrl, 2*time.Second)
+	if e != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// localFolder returns the path of a fs:// URI.
+func localFolder(uri string) string {
+	u, e := nurl.Parse(uri)
+	if e != nil || u.Scheme != "fs" {
+		return ""
+	}
+	return u.Path
+}
+
+// requiresAuthority checks if one of the task endpoints uses one of the given authorities.
+func requiresAuthority(task *config.Task, authorities []*config.Authority) bool {
+	for _, uri := range []string{task.LeftURI, task.RightURI} {
+		u, e := nurl.Parse(uri)
+		if e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		u.Path = ""
+		for _, a := range authorities {
+			if a.Id == u.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// importGlobals updates the global sections through the running instance if any, or directly in the config file.
+func importGlobals(b *config.Bundle, running bool) error {
+	if !running {
+		return config.Default().UpdateGlobals(b.Logs, b.Updates, b.Debugging, b.Service)
+	}
+	data, _ := json.Marshal(&config.Global{Logs: b.Logs, Updates: b.Updates, Debugging: b.Debugging, Service: b.Service})
+	req, _ := http.NewRequest(http.MethodPut, strings.TrimRight(configUrl, "/")+"/config", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	resp, e := http.DefaultClient.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot update global config: %s", resp.Status)
+	}
+	return nil
+}
+
+// ExportCmd writes the configuration to a portable bundle.
+var ExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export tasks, accounts and settings to a portable bundle",
+	Long: `Export the sync tasks, accounts and global settings to a YAML or JSON bundle that can be
+imported on another machine with "config import".
+
+Accounts are exported without their tokens. Paths starting with your home directory are
+replaced by ${HOME}, and other variables can be defined with --var NAME=VALUE. Passwords
+found in endpoints URIs (e.g. S3 secrets) are replaced by ${SECRET_N} variables that must be
+provided on import, with --var or as environment variables.
+
+Example:
+
+ $ cells-sync config export -o setup.yaml --var DOCS=/home/name/Documents
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		vars, e := parseBundleVars()
+		if e != nil {
+			exit(e)
+		}
+		format := bundleFormat
+		if format == "" {
+			format = "yaml"
+			if strings.ToLower(filepath.Ext(bundleOutput)) == ".json" {
+				format = "json"
+			}
+		}
+		b, e := config.NewBundle(config.Default(), vars)
+		if e != nil {
+			exit(e)
+		}
+		data, e := b.Marshal(format)
+		if e != nil {
+			exit(e)
+		}
+		if bundleOutput == "" || bundleOutput == "-" {
+			fmt.Println(string(data))
+			return
+		}
+		if e := os.WriteFile(bundleOutput, data, 0600); e != nil {
+			exit(e)
+		}
+		fmt.Printf("Exported %d task(s) and %d account(s) to %s\n", len(b.Tasks), len(b.Authorities), bundleOutput)
+		for _, name := range b.Variables() {
+			if strings.HasPrefix(name, "SECRET_") {
+				fmt.Printf("Variable %s must be provided on import\n", name)
+			}
+		}
+	},
+}
+
+// ImportCmd creates or updates tasks from a bundle.
+var ImportCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Import tasks, accounts and settings from a bundle",
+	Long: `Import a bundle created by "config export". Use "-" to read it from the standard input.
+
+Tasks that already exist (same UUID) are updated, other ones are created. Missing local folders
+are created. Hooks are never imported, as they run local commands: existing tasks keep their hooks. Variables like ${HOME} are replaced by their value on this machine, they can be
+overridden with --var NAME=VALUE or defined as environment variables.
+
+Accounts tokens are not part of the bundle: accounts that are not logged in on this machine are
+listed, and with --login a browser is opened on the running instance to log in each of them.
+Global settings are only imported with --globals.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var data []byte
+		var e error
+		if args[0] == "-" {
+			data, e = io.ReadAll(os.Stdin)
+		} else {
+			data, e = os.ReadFile(args[0])
+		}
+		if e != nil {
+			exit(e)
+		}
+		b, e := config.ParseBundle(data)
+		if e != nil {
+			exit(e)
+		}
+		vars, e := parseBundleVars()
+		if e != nil {
+			exit(e)
+		}
+		var undefined []string
+		for _, name := range b.Variables() {
+			if _, ok := vars[name]; ok {
+				continue
+			}
+			if _, ok := os.LookupEnv(name); !ok {
+				undefined = append(undefined, name)
+			}
+		}
+		if len(undefined) > 0 {
+			exit(fmt.Errorf("please provide values for variables %s", strings.Join(undefined, ", ")))
+		}
+		b.Expand(vars)
+
+		running := instanceRunning()
+		missing := b.MissingAuthorities(config.Default())
+		var failed int
+		for _, t := range b.Tasks {
+			for _, uri := range []string{t.LeftURI, t.RightURI} {
+				if folder := localFolder(uri); folder != "" {
+					if _, er := os.Stat(folder); os.IsNotExist(er) {
+						if er := os.MkdirAll(folder, 0755); er == nil {
+							fmt.Println("Created folder " + folder)
+						}
+					}
+				}
+			}
+			if e := validateTask(t); e != nil && !requiresAuthority(t, missing) {
+				fmt.Printf("Skipping task %s: %s\n", t.Label, e.Error())
+				failed++
+				continue
+			}
+			op := "create"
+			for _, existing := range config.Default().Tasks {
+				if existing.Uuid == t.Uuid {
+					op = "edit"
+					// Hooks are not imported, keep the local ones
+					t.Hooks = existing.Hooks
+					break
+				}
+			}
+			if e := saveTask(op, t); e != nil {
+				fmt.Printf("Cannot save task %s: %s\n", t.Label, e.Error())
+				failed++
+				continue
+			}
+			fmt.Printf("Imported task %s\n", t.Label)
+		}
+		if bundleGlobals {
+			if e := importGlobals(b, running); e != nil {
+				fmt.Println("Cannot import global settings: " + e.Error())
+				failed++
+			}
+		}
+		for _, a := range missing {
+			if bundleLogin && running {
+				fmt.Printf("Opening browser to log in %s on %s\n", a.Username, a.URI)
+				_ = open.Run(strings.TrimRight(configUrl, "/") + "/servers/external?manager=" + nurl.QueryEscape(a.URI))
+			} else {
+				fmt.Printf("Account %s on %s is not logged in on this machine\n", a.Username, a.URI)
+			}
+		}
+		if len(missing) > 0 && bundleLogin && !running {
+			fmt.Println("Please start the application to log in the accounts")
+		}
+		if failed > 0 {
+			exit(fmt.Errorf("%d element(s) could not be imported", failed))
+		}
+	},
+}
+
+func init() {
+	ExportCmd.Flags().StringVarP(&bundleOutput, "output", "o", "", "Output file (default to standard output)")
+	ExportCmd.Flags().StringVar(&bundleFormat, "format", "", "Bundle format, yaml or json (detected from output extension)")
+	ExportCmd.Flags().StringArrayVar(&bundleVars, "var", []string{}, "Path substitution variable NAME=VALUE (can be repeated)")
+	ImportCmd.Flags().StringArrayVar(&bundleVars, "var", []string{}, "Variable NAME=VALUE used for substitution (can be repeated)")
+	ImportCmd.Flags().BoolVar(&bundleGlobals, "globals", false, "Also import global settings")
+	ImportCmd.Flags().BoolVar(&bundleLogin, "login", false, "Open a browser to log in accounts whose tokens are missing")
+	CfgCmd.AddCommand(ExportCmd, ImportCmd)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+var (
+	credentialsLogin  string
+	credentialsSecret string
+)
+
+// CredentialsCmd groups the commands managing the credentials used by endpoints authenticating with a login and a secret.
+var CredentialsCmd = &cobra.Command{
+	Use:   "credentials",
+	Short: "Manage credentials used by webdav and s3 endpoints",
+	Long: `Credentials are registered for a scheme, an optional user and a host, e.g. webdavs://user@host:port,
+and are used by all the endpoints URIs starting with this prefix. Secrets are stored in the OS keyring when it
+is available, they must never be written in the endpoints URIs.
+
+For s3, the user part of the URI is the name of the credentials and the login is the API key, e.g. credentials
+registered with "set s3://backup@s3.amazonaws.com --login API_KEY" are used by s3://backup@s3.amazonaws.com/bucket.
+Secrets written inline in s3 URIs (s3://API_KEY:SECRET@host/bucket) are moved to credentials when the task is saved.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// CredentialsListCmd lists the registered credentials.
+var CredentialsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List credentials",
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLOGIN")
+		for _, c := range config.Default().Credentials {
+			fmt.Fprintf(w, "%s\t%s\n", c.Id, c.Login)
+		}
+		w.Flush()
+	},
+}
+
+// CredentialsSetCmd creates or replaces credentials.
+var CredentialsSetCmd = &cobra.Command{
+	Use:   "set URI",
+	Short: "Create or replace credentials, the secret is prompted if not passed as a flag",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		login, secret := credentialsLogin, credentialsSecret
+		var e error
+		if login == "" {
+			if login, e = (&promptui.Prompt{Label: "Login"}).Run(); e != nil {
+				exit(e)
+			}
+		}
+		if secret == "" {
+			if secret, e = (&promptui.Prompt{Label: "Secret", Mask: '*'}).Run(); e != nil {
+				exit(e)
+			}
+		}
+		creds, e := config.NewCredentials(args[0], login, secret)
+		if e != nil {
+			exit(e)
+		}
+		if e := config.Default().SetCredentials(creds); e != nil {
+			exit(e)
+		}
+		fmt.Println("Saved credentials " + creds.Id)
+	},
+}
+
+// CredentialsDeleteCmd removes credentials.
+var CredentialsDeleteCmd = &cobra.Command{
+	Use:   "delete ID",
+	Short: "Remove credentials",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if e := config.Default().RemoveCredentials(args[0]); e != nil {
+			exit(e)
+		}
+	},
+}
+
+func init() {
+	CredentialsSetCmd.Flags().StringVarP(&credentialsLogin, "login", "l", "", "Login")
+	CredentialsSetCmd.Flags().StringVar(&credentialsSecret, "secret", "", "Secret (prompted if empty)")
+	CredentialsCmd.AddCommand(CredentialsListCmd, CredentialsSetCmd, CredentialsDeleteCmd)
+	CfgCmd.AddCommand(CredentialsCmd)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+var encryptionKeyValue string
+
+// EncryptionKeyCmd groups the commands managing the keys used by encrypted endpoints.
+var EncryptionKeyCmd = &cobra.Command{
+	Use:   "encryption-key",
+	Short: "Manage keys used by encrypted endpoints",
+	Long: `Any endpoint URI can be prefixed with "enc+" to encrypt files contents and names before they are stored,
+e.g. enc+webdavs://user@host/path?key=NAME. Keys are only stored in the OS keyring, under the name passed with
+the "key" parameter ("default" if empty). Export the key and keep it safe: encrypted files cannot be recovered without it.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// EncryptionKeyGenerateCmd creates a random key.
+var EncryptionKeyGenerateCmd = &cobra.Command{
+	Use:   "generate [NAME]",
+	Short: "Generate a random key and store it in the keyring",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := encryptionKeyName(args)
+		if _, e := config.EncryptionKeyFromKeyring(name); e == nil {
+			exit(fmt.Errorf("key %s already exists, delete it first", name))
+		}
+		key, e := endpoint.NewEncryptionKey()
+		if e != nil {
+			exit(e)
+		}
+		if e := config.EncryptionKeyToKeyring(name, key); e != nil {
+			exit(e)
+		}
+		fmt.Println("Generated key " + name)
+	},
+}
+
+// EncryptionKeyImportCmd stores an existing key.
+var EncryptionKeyImportCmd = &cobra.Command{
+	Use:   "import [NAME]",
+	Short: "Store an exported key in the keyring, the key is prompted if not passed as a flag",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := encryptionKeyName(args)
+		value := encryptionKeyValue
+		var e error
+		if value == "" {
+			if value, e = (&promptui.Prompt{Label: "Key", Mask: '*'}).Run(); e != nil {
+				exit(e)
+			}
+		}
+		key, e := base64.StdEncoding.DecodeString(value)
+		if e != nil || len(key) != endpoint.EncryptionKeySize {
+			exit(fmt.Errorf("invalid key, expected %d bytes encoded in base64", endpoint.EncryptionKeySize))
+		}
+		if e := config.EncryptionKeyToKeyring(name, key); e != nil {
+			exit(e)
+		}
+		fmt.Println("Imported key " + name)
+	},
+}
+
+// EncryptionKeyExportCmd prints a key, to back it up or to use it on another computer.
+var EncryptionKeyExportCmd = &cobra.Command{
+	Use:   "export [NAME]",
+	Short: "Print a key encoded in base64",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, e := config.EncryptionKeyFromKeyring(encryptionKeyName(args))
+		if e != nil {
+			exit(e)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+	},
+}
+
+// EncryptionKeyDeleteCmd removes a key from the keyring.
+var EncryptionKeyDeleteCmd = &cobra.Command{
+	Use:   "delete [NAME]",
+	Short: "Remove a key from the keyring",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if e := config.ClearEncryptionKeyring(encryptionKeyName(args)); e != nil {
+			exit(e)
+		}
+	},
+}
+
+func encryptionKeyName(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return endpoint.DefaultEncryptionKey
+}
+
+func init() {
+	EncryptionKeyImportCmd.Flags().StringVar(&encryptionKeyValue, "key", "", "Key encoded in base64 (prompted if empty)")
+	EncryptionKeyCmd.AddCommand(EncryptionKeyGenerateCmd, EncryptionKeyImportCmd, EncryptionKeyExportCmd, EncryptionKeyDeleteCmd)
+	CfgCmd.AddCommand(EncryptionKeyCmd)
+}
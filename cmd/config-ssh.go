@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+var (
+	sshKeyFile             string
+	sshKnownHosts          string
+	sshInsecureSkipHostKey bool
+)
+
+// SSHCmd groups the commands managing the identities used by sftp:// endpoints.
+var SSHCmd = &cobra.Command{
+	Use:   "ssh",
+	Short: "Manage SSH identities used by sftp endpoints",
+	Long: `sftp://user@host:port/path endpoints authenticate with keys only. By default, keys are provided
+by the running SSH agent (SSH_AUTH_SOCK) and servers are verified against ~/.ssh/known_hosts.
+An identity registered for user@host:port can instead reference a private key file and a known_hosts file.
+Keys themselves are never stored in the config.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+// SSHListCmd lists the registered identities.
+var SSHListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List SSH identities",
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKEY FILE\tKNOWN HOSTS")
+		for _, i := range config.Default().SSHIdentities {
+			keyFile := i.KeyFile
+			if keyFile == "" {
+				keyFile = "(agent)"
+			}
+			knownHosts := i.KnownHosts
+			if i.InsecureSkipHostKey {
+				knownHosts = "(not verified)"
+			} else if knownHosts == "" {
+				knownHosts = "(default)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", i.Id, keyFile, knownHosts)
+		}
+		w.Flush()
+	},
+}
+
+// SSHSetCmd creates or replaces an identity.
+var SSHSetCmd = &cobra.Command{
+	Use:   "set USER@HOST[:PORT]",
+	Short: "Create or replace an SSH identity",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.SplitN(args[0], "@", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			exit(fmt.Errorf("invalid identity %s, expected user@host[:port]", args[0]))
+		}
+		identity := &config.SSHIdentity{
+			Id:                  config.SSHIdentityId(parts[0], parts[1]),
+			InsecureSkipHostKey: sshInsecureSkipHostKey,
+		}
+		for _, f := range []struct {
+			value  string
+			target *string
+		}{{sshKeyFile, &identity.KeyFile}, {sshKnownHosts, &identity.KnownHosts}} {
+			if f.value == "" {
+				continue
+			}
+			abs, e := filepath.Abs(f.value)
+			if e != nil {
+				exit(e)
+			}
+			if _, e := os.Stat(abs); e != nil {
+				exit(e)
+			}
+			*f.target = abs
+		}
+		if e := config.Default().SetSSHIdentity(identity); e != nil {
+			exit(e)
+		}
+		fmt.Println("Saved identity " + identity.Id)
+	},
+}
+
+// SSHDeleteCmd removes an identity.
+var SSHDeleteCmd = &cobra.Command{
+	Use:   "delete USER@HOST[:PORT]",
+	Short: "Remove an SSH identity",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.SplitN(args[0], "@", 2)
+		if len(parts) != 2 {
+			exit(fmt.Errorf("invalid identity %s, expected user@host[:port]", args[0]))
+		}
+		if e := config.Default().RemoveSSHIdentity(config.SSHIdentityId(parts[0], parts[1])); e != nil {
+			exit(e)
+		}
+	},
+}
+
+func init() {
+	SSHSetCmd.Flags().StringVarP(&sshKeyFile, "key-file", "k", "", "Path to an unencrypted private key (the SSH agent is used if empty)")
+	SSHSetCmd.Flags().StringVar(&sshKnownHosts, "known-hosts", "", "Path to a known_hosts file (default ~/.ssh/known_hosts)")
+	SSHSetCmd.Flags().BoolVar(&sshInsecureSkipHostKey, "insecure-skip-host-key", false, "Do not verify the server host key (not recommended)")
+	SSHCmd.AddCommand(SSHListCmd, SSHSetCmd, SSHDeleteCmd)
+	CfgCmd.AddCommand(SSHCmd)
+}
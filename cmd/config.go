@@ -21,18 +21,23 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	nurl "net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/manifoldco/promptui"
 	"github.com/pborman/uuid"
 	"github.com/spf13/cobra"
 
+	"github.com/pydio/cells-sync/common"
 	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
 	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/utils/schedule"
 )
 
 func exit(err error) {
@@ -43,6 +48,271 @@ func exit(err error) {
 	os.Exit(0)
 }
 
+// promptIgnoreRules asks for a comma-separated list of gitignore-style rules and validates them.
+func promptIgnoreRules(task *config.Task) ([]string, error) {
+	p := &promptui.Prompt{
+		Label:   "Ignore rules (comma-separated)",
+		Default: strings.Join(task.GetIgnoreRules(), ", "),
+		Validate: func(s string) error {
+			_, e := endpoint.NewIgnoreMatcher(splitIgnoreRules(s))
+			return e
+		},
+	}
+	res, e := p.Run()
+	if e != nil {
+		return nil, e
+	}
+	return splitIgnoreRules(res), nil
+}
+
+// promptConflictPolicy asks how conflicts should be resolved for a bidirectional task.
+func promptConflictPolicy(task *config.Task) (string, error) {
+	if task.Direction != "Bi" {
+		return task.ConflictPolicy, nil
+	}
+	items := []string{"none", config.ConflictPolicyKeepBoth, config.ConflictPolicyPreferLeft, config.ConflictPolicyPreferRight, config.ConflictPolicyPreferNewest}
+	s := promptui.Select{Label: "Conflict Policy", Items: items}
+	for i, item := range items {
+		if item == task.ConflictPolicy {
+			s.CursorPos = i
+		}
+	}
+	_, res, e := s.Run()
+	if e != nil || res == "none" {
+		return "", e
+	}
+	return res, nil
+}
+
+// promptTrash asks whether files deleted or overwritten on a local endpoint are kept in the task trash.
+func promptTrash(task *config.Task) (bool, error) {
+	if !strings.HasPrefix(task.LeftURI, "fs://") && !strings.HasPrefix(task.RightURI, "fs://") {
+		return task.Trash, nil
+	}
+	s := promptui.Select{Label: "Keep deleted and overwritten local files in trash?", Items: []string{"No", "Yes"}}
+	if task.Trash {
+		s.CursorPos = 1
+	}
+	i, _, e := s.Run()
+	return i == 1, e
+}
+
+func splitIgnoreRules(s string) []string {
+	rules := []string{}
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+var (
+	taskUuid           string
+	taskLabel          string
+	taskLeft           string
+	taskRight          string
+	taskDirection      string
+	taskSelectiveRoots []string
+	taskRealtime       bool
+	taskLoopInterval   string
+	taskHardInterval   string
+	taskConflictPolicy string
+	taskIgnoreRules    string
+	taskTrash          bool
+	configUrl          string
+)
+
+// taskFlags are the flags describing a task, setting one of them switches commands to non-interactive mode.
+var taskFlags = []string{"uuid", "label", "left", "right", "direction", "selective-root", "realtime", "loop-interval", "hard-interval", "conflict-policy", "ignore", "trash"}
+
+// addTaskFlags registers the task flags. Existing tasks can additionally be selected by UUID.
+func addTaskFlags(cmd *cobra.Command, existing, selectOnly bool) {
+	if existing {
+		cmd.Flags().StringVar(&taskUuid, "uuid", "", "Select task by UUID")
+	}
+	if selectOnly {
+		cmd.Flags().StringVar(&taskLabel, "label", "", "Select task by label")
+		return
+	}
+	cmd.Flags().StringVar(&taskLabel, "label", "", "Task label")
+	cmd.Flags().StringVar(&taskLeft, "left", "", "Left endpoint URI")
+	cmd.Flags().StringVar(&taskRight, "right", "", "Right endpoint URI")
+	cmd.Flags().StringVar(&taskDirection, "direction", "Bi", "Sync direction (Bi, Left, Right)")
+	cmd.Flags().StringArrayVar(&taskSelectiveRoots, "selective-root", []string{}, "Restrict sync to this folder (can be repeated)")
+	cmd.Flags().BoolVar(&taskRealtime, "realtime", false, "Watch endpoints for realtime changes")
+	cmd.Flags().StringVar(&taskLoopInterval, "loop-interval", "", "ISO8601 interval for triggering sync loops (e.g. R/2020-01-01T00:00:00Z/PT10M)")
+	cmd.Flags().StringVar(&taskHardInterval, "hard-interval", "", "ISO8601 interval for triggering full resyncs")
+	cmd.Flags().StringVar(&taskConflictPolicy, "conflict-policy", "", "Conflict policy (Bi only)")
+	cmd.Flags().StringVar(&taskIgnoreRules, "ignore", "", "Comma-separated ignore rules")
+	cmd.Flags().BoolVar(&taskTrash, "trash", false, "Keep deleted and overwritten local files in trash")
+}
+
+func nonInteractive(cmd *cobra.Command) bool {
+	for _, f := range taskFlags {
+		if fl := cmd.Flags().Lookup(f); fl != nil && fl.Changed {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTaskFlags copies the flags that were explicitly set to the task.
+func applyTaskFlags(cmd *cobra.Command, task *config.Task) {
+	changed := func(name string) bool {
+		return cmd.Flags().Changed(name)
+	}
+	if changed("label") {
+		task.Label = taskLabel
+	}
+	if changed("left") {
+		task.LeftURI = taskLeft
+	}
+	if changed("right") {
+		task.RightURI = taskRight
+	}
+	if changed("direction") || task.Direction == "" {
+		task.Direction = taskDirection
+	}
+	if changed("selective-root") {
+		task.SelectiveRoots = taskSelectiveRoots
+	}
+	if changed("realtime") {
+		task.Realtime = taskRealtime
+	}
+	if changed("loop-interval") {
+		task.LoopInterval = taskLoopInterval
+	}
+	if changed("hard-interval") {
+		task.HardInterval = taskHardInterval
+	}
+	if changed("conflict-policy") {
+		task.ConflictPolicy = taskConflictPolicy
+	}
+	if changed("ignore") {
+		task.IgnoreRules = splitIgnoreRules(taskIgnoreRules)
+	}
+	if changed("trash") {
+		task.Trash = taskTrash
+	}
+}
+
+// validateTask checks the task values before it is saved. Endpoints are opened in browse-only mode.
+func validateTask(task *config.Task) error {
+	if task.LeftURI == "" || task.RightURI == "" {
+		return fmt.Errorf("left and right endpoints URI are required")
+	}
+	if task.Direction != "Bi" && task.Direction != "Left" && task.Direction != "Right" {
+		return fmt.Errorf("unsupported direction type, please use one of Bi, Left, Right")
+	}
+	switch task.ConflictPolicy {
+	case "", config.ConflictPolicyKeepBoth, config.ConflictPolicyPreferLeft, config.ConflictPolicyPreferRight, config.ConflictPolicyPreferNewest:
+	default:
+		return fmt.Errorf("unsupported conflict policy %s", task.ConflictPolicy)
+	}
+	for _, interval := range []string{task.LoopInterval, task.HardInterval} {
+		if interval == "" {
+			continue
+		}
+		if _, e := schedule.NewTickerScheduleFromISO(interval); e != nil {
+			return fmt.Errorf("invalid interval %s: %s", interval, e.Error())
+		}
+	}
+	if _, e := endpoint.NewIgnoreMatcher(task.GetIgnoreRules()); e != nil {
+		return e
+	}
+	if ep, e := endpoint.EndpointFromURI(task.LeftURI, task.RightURI, true); e != nil {
+		return fmt.Errorf("invalid left endpoint: %s", e.Error())
+	} else {
+		endpoint.CloseEndpoint(ep)
+	}
+	if ep, e := endpoint.EndpointFromURI(task.RightURI, task.LeftURI, true); e != nil {
+		return fmt.Errorf("invalid right endpoint: %s", e.Error())
+	} else {
+		endpoint.CloseEndpoint(ep)
+	}
+	return nil
+}
+
+// findTask selects a task using the --uuid or --label flags, or prompts the user.
+func findTask(cmd *cobra.Command, label string) (*config.Task, error) {
+	tasks := config.Default().Tasks
+	if cmd.Flags().Changed("uuid") {
+		for _, t := range tasks {
+			if t.Uuid == taskUuid {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot find task with uuid %s", taskUuid)
+	}
+	if cmd.Flags().Changed("label") {
+		for _, t := range tasks {
+			if t.Label == taskLabel {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot find task with label %s", taskLabel)
+	}
+	if nonInteractive(cmd) {
+		return nil, fmt.Errorf("please select a task with --uuid or --label")
+	}
+	tS := promptui.Select{Label: label, Items: config.Default().Items()}
+	i, _, e := tS.Run()
+	if e != nil {
+		return nil, e
+	}
+	return tasks[i], nil
+}
+
+// configAckTimeout is the time left to a running instance to apply a change sent by saveTask.
+const configAckTimeout = 10 * time.Second
+
+// saveTask sends the change to the running instance if it can be reached, so that it is applied
+// immediately, and waits for its answer. Otherwise the config file is directly updated.
+func saveTask(cmd string, task *config.Task) error {
+	if conn, e := statusConnect(configUrl, 2*time.Second); e == nil {
+		defer ctlClose(conn)
+		if e := conn.WriteJSON(&common.Message{Type: "CONFIG", Content: &common.ConfigContent{Cmd: cmd, Task: task}}); e != nil {
+			return e
+		}
+		if e := waitConfigAck(conn); e != nil {
+			return e
+		}
+		fmt.Println("Change applied by running instance")
+		return nil
+	}
+	switch cmd {
+	case "create":
+		return config.Default().CreateTask(task)
+	case "edit":
+		return config.Default().UpdateTask(task)
+	case "delete":
+		return config.Default().RemoveTask(task)
+	}
+	return fmt.Errorf("unsupported command %s", cmd)
+}
+
+// waitConfigAck reads the messages of the running instance until the CONFIG change is acknowledged or refused.
+// Other messages, like the states broadcasted by the tasks, are skipped.
+func waitConfigAck(conn *websocket.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(configAckTimeout))
+	for {
+		messageType, data, e := conn.ReadMessage()
+		if e != nil {
+			return fmt.Errorf("no answer from running instance: %s", e.Error())
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		switch m := common.MessageFromData(data); m.Type {
+		case "CONFIG":
+			return nil
+		case "ERROR":
+			return fmt.Errorf("running instance refused the change: %v", m.Content)
+		}
+	}
+}
+
 var CfgCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Manage configurations manually",
@@ -60,19 +330,39 @@ var AddCmd = &cobra.Command{
 Endpoint URI support the following schemes: 
  - router: Direct connexion to Cells server running on the same machine
  - fs:     Path to a local folder
- - s3:     S3 compliant
- - memdb:  In-memory DB for testing purposes
+ - s3:     S3 compliant, s3://NAME@host/bucket/path using the credentials NAME (see "config credentials")
+ - db:     Local store persisting nodes and contents, db:///path/to/store (db:// is an in-memory DB for testing purposes)
 
 Direction can be:
  - Bi:     Bidirectionnal sync between two endpoints
  - Left:   Changes are only propagated from right to left
  - Right:  Changes are only propagated from left to right
 
+Conflict policy (Bi only) can be:
+ - none:          Conflicts are reported and must be resolved manually
+ - keep-both:     Left version is kept, right version is renamed with a conflict suffix
+ - prefer-left:   Left version overwrites right version
+ - prefer-right:  Right version overwrites left version
+ - prefer-newest: Most recently modified version wins
+
+Ignore rules use the gitignore syntax and are separated by commas. Additional rules
+can be stored in a .cellsignore file inside any folder of a local endpoint.
+
+When trash is enabled, files deleted or overwritten on a local endpoint are moved to
+the task trash. Use the "trash" command to list, restore or empty it.
+
 Example
  - LeftUri : "router:///personal/admin/folder"
  - RightUri: "fs:///Users/name/Pydio/folder"
  - Direction: "Bi"
+ - Conflict policy: "prefer-newest"
+ - Ignore rules: ".git*, node_modules/, *.tmp"
+
+Task values can also be passed as flags, in which case no prompt is displayed:
 
+ $ cells-sync config add --left fs:///home/name/left --right fs:///home/name/right --direction Bi --realtime
+
+If an instance is running, the new task is sent to it and started immediately.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -80,28 +370,44 @@ Example
 			Uuid: uuid.New(),
 		}
 		var e error
-		l := &promptui.Prompt{Label: "Left endpoint URI"}
-		r := &promptui.Prompt{Label: "Right endpoint URI"}
-		s := promptui.Select{Label: "Sync Direction", Items: []string{"Bi", "Left", "Right"}}
-		t.LeftURI, e = l.Run()
-		if e != nil {
-			exit(e)
+		if nonInteractive(cmd) {
+			applyTaskFlags(cmd, t)
+		} else {
+			l := &promptui.Prompt{Label: "Left endpoint URI"}
+			r := &promptui.Prompt{Label: "Right endpoint URI"}
+			s := promptui.Select{Label: "Sync Direction", Items: []string{"Bi", "Left", "Right"}}
+			t.LeftURI, e = l.Run()
+			if e != nil {
+				exit(e)
+			}
+			t.RightURI, e = r.Run()
+			if e != nil {
+				exit(e)
+			}
+			_, t.Direction, e = s.Run()
+			if e != nil {
+				exit(e)
+			}
+			t.ConflictPolicy, e = promptConflictPolicy(t)
+			if e != nil {
+				exit(e)
+			}
+			t.IgnoreRules, e = promptIgnoreRules(t)
+			if e != nil {
+				exit(e)
+			}
+			t.Trash, e = promptTrash(t)
+			if e != nil {
+				exit(e)
+			}
 		}
-		t.RightURI, e = r.Run()
-		if e != nil {
+		if e = validateTask(t); e != nil {
 			exit(e)
 		}
-		_, t.Direction, e = s.Run()
-		if e != nil {
+		if e = saveTask("create", t); e != nil {
 			exit(e)
 		}
 
-		config.Default().Tasks = append(config.Default().Tasks, t)
-		er := config.Save()
-		if er != nil {
-			exit(er)
-		}
-
 	},
 }
 
@@ -109,33 +415,64 @@ Example
 var EditCmd = &cobra.Command{
 	Use:   "edit",
 	Short: "Exit existing sync via command line",
+	Long: `Edit an existing sync task.
+
+The task can be selected with --uuid or --label. When other flags are passed, only the
+corresponding values are modified and no prompt is displayed. To rename a task, select
+it with --uuid and pass the new --label.
+`,
 	Run: func(cmd *cobra.Command, args []string) {
-		tS := promptui.Select{Label: "Select Sync to Edit", Items: config.Default().Items()}
-		i, _, e := tS.Run()
+		task, e := findTask(cmd, "Select Sync to Edit")
 		if e != nil {
 			exit(e)
 		}
-
-		task := config.Default().Tasks[i]
-		l := &promptui.Prompt{Label: "Left endpoint URI", Default: task.LeftURI}
-		r := &promptui.Prompt{Label: "Right endpoint URI", Default: task.RightURI}
-		s := promptui.Select{Label: "Sync Direction", Items: []string{"Bi", "Left", "Right"}}
-		task.LeftURI, e = l.Run()
-		if e != nil {
-			exit(e)
+		// Work on a copy so that the config is left untouched if validation fails
+		edited := *task
+		task = &edited
+		if nonInteractive(cmd) {
+			if cmd.Flags().Changed("uuid") {
+				applyTaskFlags(cmd, task)
+			} else {
+				// --label is used for selection
+				label := task.Label
+				applyTaskFlags(cmd, task)
+				task.Label = label
+			}
+		} else {
+			l := &promptui.Prompt{Label: "Left endpoint URI", Default: task.LeftURI}
+			r := &promptui.Prompt{Label: "Right endpoint URI", Default: task.RightURI}
+			s := promptui.Select{Label: "Sync Direction", Items: []string{"Bi", "Left", "Right"}}
+			task.LeftURI, e = l.Run()
+			if e != nil {
+				exit(e)
+			}
+			task.RightURI, e = r.Run()
+			if e != nil {
+				exit(e)
+			}
+			_, task.Direction, e = s.Run()
+			if e != nil {
+				exit(e)
+			}
+			task.ConflictPolicy, e = promptConflictPolicy(task)
+			if e != nil {
+				exit(e)
+			}
+			task.IgnoreRules, e = promptIgnoreRules(task)
+			if e != nil {
+				exit(e)
+			}
+			task.Trash, e = promptTrash(task)
+			if e != nil {
+				exit(e)
+			}
 		}
-		task.RightURI, e = r.Run()
-		if e != nil {
+		if e = validateTask(task); e != nil {
 			exit(e)
 		}
-		_, task.Direction, e = s.Run()
-		if e != nil {
+		if e = saveTask("edit", task); e != nil {
 			exit(e)
 		}
-		er := config.Save()
-		if er != nil {
-			exit(er)
-		}
 	},
 }
 
@@ -144,21 +481,12 @@ var DeleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete existing sync via command line",
 	Run: func(cmd *cobra.Command, args []string) {
-		tS := promptui.Select{Label: "Select Sync to Edit", Items: config.Default().Items()}
-		i, _, e := tS.Run()
+		task, e := findTask(cmd, "Select Sync to Delete")
 		if e != nil {
 			exit(e)
 		}
-		tasks := config.Default().Tasks
-		last := len(tasks) - 1
-		lastTask := tasks[last]
-		tasks[last] = tasks[i]
-		tasks[i] = lastTask
-		tasks = tasks[:last]
-		config.Default().Tasks = tasks
-		er := config.Save()
-		if er != nil {
-			exit(er)
+		if e = saveTask("delete", task); e != nil {
+			exit(e)
 		}
 
 	},
@@ -235,6 +563,10 @@ Create or edit an existing account by manually setting a user token instead of g
 }
 
 func init() {
+	CfgCmd.PersistentFlags().StringVar(&configUrl, "url", config.GetHttpURL(), "Web server URL of a running instance to notify")
+	addTaskFlags(AddCmd, false, false)
+	addTaskFlags(EditCmd, true, false)
+	addTaskFlags(DeleteCmd, true, true)
 	RootCmd.AddCommand(CfgCmd)
 	CfgCmd.AddCommand(AccountCmd, AddCmd, EditCmd, DeleteCmd)
 }
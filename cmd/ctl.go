@@ -0,0 +1,394 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// Exit codes of the ctl commands.
+const (
+	CtlExitOK        = 0
+	CtlExitError     = 1
+	CtlExitUnhealthy = 2
+	CtlExitUnknown   = 3
+)
+
+var (
+	ctlUrl     string
+	ctlJson    bool
+	ctlAll     bool
+	ctlTimeout time.Duration
+)
+
+// CtlTaskStatus is the summary of a task state printed by ctl commands.
+type CtlTaskStatus struct {
+	Uuid           string
+	Label          string
+	Status         string
+	Healthy        bool
+	LeftConnected  bool
+	RightConnected bool
+	LastSyncTime   time.Time `json:",omitempty"`
+	LastOpsTime    time.Time `json:",omitempty"`
+	Message        string    `json:",omitempty"`
+	Error          string    `json:",omitempty"`
+}
+
+// CtlCommandResult is printed after a command was sent to the running instance.
+type CtlCommandResult struct {
+	Cmd   string
+	Uuid  string `json:",omitempty"`
+	Label string `json:",omitempty"`
+	Sent  bool
+}
+
+func ctlExit(code int, err error) {
+	if err != nil {
+		if ctlJson {
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			fmt.Println(string(data))
+		} else {
+			fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		}
+	}
+	os.Exit(code)
+}
+
+func ctlPrintJson(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(data))
+}
+
+// statusConnect opens the /status websocket of the instance running at the given web server URL.
+func statusConnect(serverUrl string, timeout time.Duration) (*websocket.Conn, error) {
+	parsed, e := url.Parse(serverUrl)
+	if e != nil {
+		return nil, e
+	}
+	if parsed.Scheme == "https" {
+		parsed.Scheme = "wss"
+	} else {
+		parsed.Scheme = "ws"
+	}
+	parsed.Path = "/status"
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = timeout
+	conn, _, e := dialer.Dial(parsed.String(), nil)
+	if e != nil {
+		return nil, fmt.Errorf("cannot connect to running instance at %s: %s", serverUrl, e.Error())
+	}
+	return conn, nil
+}
+
+// ctlConnect opens the /status websocket of the running instance.
+func ctlConnect() (*websocket.Conn, error) {
+	return statusConnect(ctlUrl, ctlTimeout)
+}
+
+// ctlClose properly closes the websocket, so that sent messages are processed by the server.
+func ctlClose(conn *websocket.Conn) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// ctlStates sends a PING and collects the states broadcasted by the tasks, until all configured tasks
+// have answered or the timeout is reached.
+func ctlStates(conn *websocket.Conn) (map[string]*common.ConcreteSyncState, error) {
+	if e := conn.WriteJSON(&common.Message{Type: "PING"}); e != nil {
+		return nil, e
+	}
+	expected := len(config.Default().Tasks)
+	states := make(map[string]*common.ConcreteSyncState)
+	deadline := time.Now().Add(ctlTimeout)
+	for len(states) < expected {
+		_ = conn.SetReadDeadline(deadline)
+		messageType, data, e := conn.ReadMessage()
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return nil, e
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		m := common.MessageFromData(data)
+		if m.Type != "STATE" {
+			continue
+		}
+		if state, ok := m.Content.(*common.ConcreteSyncState); ok && state.UUID != "" {
+			states[state.UUID] = state
+		} else {
+			// Empty state: no tasks are running
+			break
+		}
+	}
+	return states, nil
+}
+
+// ctlTaskStatus summarizes a state. A task is unhealthy if it is on error or if one of its endpoints is disconnected.
+func ctlTaskStatus(task *config.Task, state *common.ConcreteSyncState) *CtlTaskStatus {
+	st := &CtlTaskStatus{
+		Uuid:   task.Uuid,
+		Label:  task.Label,
+		Status: "unknown",
+	}
+	if state == nil {
+		return st
+	}
+	st.Status = common.TaskStatusName(state.Status)
+	st.LastSyncTime = state.LastSyncTime
+	st.LastOpsTime = state.LastOpsTime
+	st.LeftConnected = state.LeftInfo != nil && state.LeftInfo.Connected
+	st.RightConnected = state.RightInfo != nil && state.RightInfo.Connected
+	if ps := state.LastProcessStatus; ps != nil {
+		st.Message = ps.String()
+		if ps.IsError() && ps.Error() != nil {
+			st.Error = ps.Error().Error()
+		}
+	}
+	st.Healthy = state.Status != model.TaskStatusError && st.LeftConnected && st.RightConnected
+	return st
+}
+
+// ctlFindTasks resolves tasks by UUID or label. All tasks are returned if refs is empty.
+func ctlFindTasks(refs []string) ([]*config.Task, error) {
+	tasks := config.Default().Tasks
+	if len(refs) == 0 {
+		return tasks, nil
+	}
+	var found []*config.Task
+	for _, ref := range refs {
+		var task *config.Task
+		for _, t := range tasks {
+			if t.Uuid == ref || t.Label == ref {
+				task = t
+				break
+			}
+		}
+		if task == nil {
+			return nil, fmt.Errorf("cannot find task %s", ref)
+		}
+		found = append(found, task)
+	}
+	return found, nil
+}
+
+// ctlPrintStatus prints the tasks states and exits with a code reflecting their health.
+func ctlPrintStatus(args []string, detailed bool) {
+	tasks, e := ctlFindTasks(args)
+	if e != nil {
+		ctlExit(CtlExitError, e)
+	}
+	conn, e := ctlConnect()
+	if e != nil {
+		ctlExit(CtlExitError, e)
+	}
+	states, e := ctlStates(conn)
+	ctlClose(conn)
+	if e != nil {
+		ctlExit(CtlExitError, e)
+	}
+	code := CtlExitOK
+	var statuses []*CtlTaskStatus
+	for _, t := range tasks {
+		st := ctlTaskStatus(t, states[t.Uuid])
+		if states[t.Uuid] == nil {
+			code = CtlExitUnknown
+		} else if !st.Healthy && code == CtlExitOK {
+			code = CtlExitUnhealthy
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Label < statuses[j].Label
+	})
+	if ctlJson {
+		ctlPrintJson(statuses)
+		os.Exit(code)
+	}
+	if detailed {
+		for _, st := range statuses {
+			fmt.Printf("Task:        %s (%s)\n", st.Label, st.Uuid)
+			fmt.Printf("Status:      %s\n", st.Status)
+			fmt.Printf("Healthy:     %t\n", st.Healthy)
+			fmt.Printf("Connections: left=%t right=%t\n", st.LeftConnected, st.RightConnected)
+			if !st.LastSyncTime.IsZero() {
+				fmt.Printf("Last sync:   %s\n", st.LastSyncTime.Format(time.RFC3339))
+			}
+			if !st.LastOpsTime.IsZero() {
+				fmt.Printf("Last ops:    %s\n", st.LastOpsTime.Format(time.RFC3339))
+			}
+			if st.Message != "" {
+				fmt.Printf("Message:     %s\n", st.Message)
+			}
+			if st.Error != "" {
+				fmt.Printf("Error:       %s\n", st.Error)
+			}
+			fmt.Println()
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tLABEL\tSTATUS\tLEFT\tRIGHT\tLAST SYNC")
+		for _, st := range statuses {
+			last := ""
+			if !st.LastSyncTime.IsZero() {
+				last = st.LastSyncTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%s\n", st.Uuid, st.Label, st.Status, st.LeftConnected, st.RightConnected, last)
+		}
+		w.Flush()
+	}
+	os.Exit(code)
+}
+
+// ctlSendCmd sends a command to the selected tasks of the running instance.
+func ctlSendCmd(cmd string, args []string) {
+	if len(args) == 0 && !ctlAll {
+		ctlExit(CtlExitError, fmt.Errorf("please provide at least one task label or UUID, or use --all"))
+	}
+	var tasks []*config.Task
+	if len(args) > 0 {
+		var e error
+		if tasks, e = ctlFindTasks(args); e != nil {
+			ctlExit(CtlExitError, e)
+		}
+	}
+	conn, e := ctlConnect()
+	if e != nil {
+		ctlExit(CtlExitError, e)
+	}
+	var results []*CtlCommandResult
+	if len(tasks) == 0 {
+		// Sent to all tasks
+		e = conn.WriteJSON(&common.Message{Type: "CMD", Content: &common.CmdContent{Cmd: cmd}})
+		results = append(results, &CtlCommandResult{Cmd: cmd, Sent: e == nil})
+	} else {
+		for _, t := range tasks {
+			if e = conn.WriteJSON(&common.Message{Type: "CMD", Content: &common.CmdContent{UUID: t.Uuid, Cmd: cmd}}); e != nil {
+				break
+			}
+			results = append(results, &CtlCommandResult{Cmd: cmd, Uuid: t.Uuid, Label: t.Label, Sent: true})
+		}
+	}
+	ctlClose(conn)
+	if ctlJson {
+		ctlPrintJson(results)
+	} else {
+		for _, r := range results {
+			target := "all tasks"
+			if r.Uuid != "" {
+				target = r.Label + " (" + r.Uuid + ")"
+			}
+			fmt.Printf("Sent %s to %s\n", r.Cmd, target)
+		}
+	}
+	if e != nil {
+		ctlExit(CtlExitError, e)
+	}
+}
+
+func ctlCmd(use, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use + " [TASK...]",
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctlSendCmd(use, args)
+		},
+	}
+}
+
+// CtlCmd controls a running instance through its websocket.
+var CtlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control a running instance from the command line",
+	Long: `Connect to a running instance and send commands to its sync tasks. Tasks are designated by their label or UUID.
+
+Exit codes of the list and status commands reflect the tasks health:
+ - 0: all tasks are running and connected
+ - 1: the command failed or the instance cannot be reached
+ - 2: at least one task is on error or one of its endpoints is disconnected
+ - 3: the state of at least one task was not received
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// CtlListCmd lists the tasks states.
+var CtlListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List tasks and their status",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctlPrintStatus(nil, false)
+	},
+}
+
+// CtlStatusCmd prints the detailed state of some tasks.
+var CtlStatusCmd = &cobra.Command{
+	Use:   "status [TASK...]",
+	Short: "Show detailed status of tasks",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctlPrintStatus(args, true)
+	},
+}
+
+// CtlQuitCmd stops the running instance.
+var CtlQuitCmd = &cobra.Command{
+	Use:   "quit",
+	Short: "Stop the running instance",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctlAll = true
+		ctlSendCmd("quit", nil)
+	},
+}
+
+func init() {
+	CtlCmd.PersistentFlags().StringVar(&ctlUrl, "url", "http://localhost:3636", "Web server URL of the running instance")
+	CtlCmd.PersistentFlags().BoolVar(&ctlJson, "json", false, "Print output as JSON")
+	CtlCmd.PersistentFlags().DurationVar(&ctlTimeout, "timeout", 5*time.Second, "Maximum time to wait for the instance")
+	CtlCmd.AddCommand(CtlListCmd, CtlStatusCmd, CtlQuitCmd)
+	for _, c := range []*cobra.Command{
+		ctlCmd("pause", "Pause tasks"),
+		ctlCmd("resume", "Resume paused tasks"),
+		ctlCmd("resync", "Launch a full resync of tasks"),
+		ctlCmd("loop", "Trigger a sync loop on tasks"),
+		ctlCmd("interrupt", "Interrupt running tasks"),
+	} {
+		c.Flags().BoolVar(&ctlAll, "all", false, "Send command to all tasks")
+		CtlCmd.AddCommand(c)
+	}
+	RootCmd.AddCommand(CtlCmd)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gobwas/glob"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/service/context"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+var (
+	dryRunTask  string
+	dryRunJson  bool
+	dryRunForce bool
+	dryRunUrl   string
+)
+
+// remoteDryRun asks a running instance to compute the dry-run. The returned boolean is false if the instance
+// cannot be reached.
+func remoteDryRun(task *config.Task) (*control.DryRunReport, bool, error) {
+	u := fmt.Sprintf("%s/tasks/%s/dry-run", strings.TrimRight(dryRunUrl, "/"), task.Uuid)
+	if dryRunForce {
+		u += "?force=true"
+	}
+	resp, e := http.Post(u, "application/json", nil)
+	if e != nil {
+		return nil, false, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		return nil, true, fmt.Errorf("dry-run failed: %s", data["error"])
+	}
+	report := &control.DryRunReport{}
+	if e := json.NewDecoder(resp.Body).Decode(report); e != nil {
+		return nil, true, e
+	}
+	return report, true, nil
+}
+
+// localDryRun opens the task endpoints to compute the dry-run when the application is not running.
+func localDryRun(task *config.Task) (*control.DryRunReport, error) {
+	ctx := servicecontext.WithServiceName(context.Background(), "dry-run")
+	left, e := endpoint.EndpointFromURI(task.LeftURI, task.RightURI)
+	if e != nil {
+		return nil, e
+	}
+	right, e := endpoint.EndpointFromURI(task.RightURI, task.LeftURI)
+	if e != nil {
+		return nil, e
+	}
+	var direction model.DirectionType
+	switch task.Direction {
+	case "Bi":
+		direction = model.DirectionBi
+	case "Left":
+		direction = model.DirectionLeft
+	case "Right":
+		direction = model.DirectionRight
+	default:
+		return nil, fmt.Errorf("unsupported direction type, please use one of Bi, Left, Right")
+	}
+	ignores, e := endpoint.NewIgnoreMatcher(task.GetIgnoreRules(), endpoint.LocalRootsFromURIs(task.LeftURI, task.RightURI)...)
+	if e != nil {
+		return nil, e
+	}
+	ignores.SetNodeSources(left, right)
+	var snapshots model.SnapshotFactory
+	configPath := filepath.Join(config.SyncClientDataDir(), task.Uuid)
+	if _, er := os.Stat(configPath); er == nil && !dryRunForce {
+		snapshots = endpoint.NewSnapshotFactory(configPath, left, right)
+		defer snapshots.Close(ctx)
+	}
+	patch, fullScan, e := control.ComputeDryRun(ctx, left, right, direction, task.SelectiveRoots, []glob.Glob{ignores}, snapshots)
+	if e != nil {
+		return nil, e
+	}
+	report := control.NewDryRunReport(task.Uuid, task.Direction, patch, left, right)
+	report.FullScan = fullScan
+	return report, nil
+}
+
+func printDryRunReport(report *control.DryRunReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tTARGET\tPATH\tSIZE")
+	for _, group := range []string{control.DryRunCreateFolder, control.DryRunCreateFile, control.DryRunUpdateFile, control.DryRunMoveFolder, control.DryRunMoveFile, control.DryRunDelete, control.DryRunConflict} {
+		for _, op := range report.Operations[group] {
+			p := op.Path
+			if op.MoveFrom != "" {
+				p = op.MoveFrom + " => " + op.Path
+			}
+			size := ""
+			if op.Size > 0 {
+				size = fmt.Sprintf("%d", op.Size)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", group, op.Target, p, size)
+		}
+	}
+	w.Flush()
+	var total int
+	var parts []string
+	for group, count := range report.Counts {
+		total += count
+		parts = append(parts, fmt.Sprintf("%s: %d", group, count))
+	}
+	sort.Strings(parts)
+	if total == 0 {
+		fmt.Println("Nothing to synchronize")
+		return
+	}
+	fmt.Printf("\n%d operations (%s), %d bytes to transfer\n", total, strings.Join(parts, ", "), report.TotalBytes)
+	if report.FullScan {
+		fmt.Println("Changes were computed by comparing both endpoints contents")
+	}
+}
+
+// DryRunCmd previews the operations that the next sync would apply.
+var DryRunCmd = &cobra.Command{
+	Use:   "dry-run",
+	Short: "Preview the operations that would be applied by a sync task",
+	Long: `Compute the changes between the two endpoints of a task without applying them.
+
+If the application is running, the computation is performed by the running task, otherwise the task
+endpoints are directly opened. Unless --force is used, bidirectional changes are computed from the
+last snapshots like a normal sync loop. With --force, both endpoints contents are compared as a full
+resync would do.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		task, e := selectTask(dryRunTask)
+		if e != nil {
+			exit(e)
+		}
+		report, reached, e := remoteDryRun(task)
+		if !reached {
+			report, e = localDryRun(task)
+		}
+		if e != nil {
+			exit(e)
+		}
+		if dryRunJson {
+			data, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(data))
+			return
+		}
+		printDryRunReport(report)
+	},
+}
+
+func init() {
+	DryRunCmd.Flags().StringVarP(&dryRunTask, "task", "t", "", "Task UUID or label")
+	DryRunCmd.Flags().BoolVar(&dryRunJson, "json", false, "Print report as JSON")
+	DryRunCmd.Flags().BoolVarP(&dryRunForce, "force", "f", false, "Compare endpoints contents instead of using snapshots")
+	DryRunCmd.Flags().StringVar(&dryRunUrl, "url", "http://localhost:3636", "Web server URL of a running instance")
+	RootCmd.AddCommand(DryRunCmd)
+}
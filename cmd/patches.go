@@ -0,0 +1,275 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+var (
+	patchesTask  string
+	patchesUrl   string
+	patchesJson  bool
+	searchPath   string
+	searchTypes  []string
+	searchErrors bool
+	searchFrom   string
+	searchTo     string
+	searchLimit  int
+	historyLimit int
+)
+
+// parseSearchTime accepts RFC3339 dates, YYYY-MM-DD days or durations relative to now (e.g. 24h).
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, e := time.ParseDuration(value); e == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, e := time.ParseInLocation("2006-01-02", value, time.Local); e == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// patchesGet queries a running instance and decodes its response. The returned boolean is false if the
+// instance cannot be reached.
+func patchesGet(task *config.Task, route string, values url.Values, response interface{}) (bool, error) {
+	u := fmt.Sprintf("%s/tasks/%s/%s?%s", strings.TrimRight(patchesUrl, "/"), task.Uuid, route, values.Encode())
+	resp, e := http.Get(u)
+	if e != nil {
+		return false, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		return true, fmt.Errorf("request failed: %s", data["error"])
+	}
+	return true, json.NewDecoder(resp.Body).Decode(response)
+}
+
+// remotePatchSearch asks a running instance to search its patch store.
+func remotePatchSearch(task *config.Task, query endpoint.PatchSearchQuery) ([]*endpoint.PatchSearchResult, bool, error) {
+	values := url.Values{}
+	values.Set("path", query.Path)
+	for _, t := range query.Types {
+		values.Add("type", t.String())
+	}
+	if query.ErrorsOnly {
+		values.Set("errors", "true")
+	}
+	if !query.From.IsZero() {
+		values.Set("from", query.From.Format(time.RFC3339))
+	}
+	if !query.To.IsZero() {
+		values.Set("to", query.To.Format(time.RFC3339))
+	}
+	values.Set("limit", strconv.Itoa(query.Limit))
+	response := &control.PatchSearchResponse{}
+	reached, e := patchesGet(task, "patches/search", values, response)
+	return response.Results, reached, e
+}
+
+// openPatchStore opens the task patch store for reading when the application is not running. It returns nil
+// if the task has no patches yet.
+func openPatchStore(task *config.Task) (*endpoint.PatchStore, error) {
+	configPath := filepath.Join(config.SyncClientDataDir(), task.Uuid)
+	if _, e := os.Stat(filepath.Join(configPath, "patches")); e != nil {
+		return nil, nil
+	}
+	left, e := endpoint.EndpointFromURI(task.LeftURI, task.RightURI)
+	if e != nil {
+		return nil, e
+	}
+	right, e := endpoint.EndpointFromURI(task.RightURI, task.LeftURI)
+	if e != nil {
+		return nil, e
+	}
+	return endpoint.OpenPatchStoreReadOnly(configPath, left, right)
+}
+
+// printOperations displays search or history results as a table. With details, the direction, size and
+// etag of operations are displayed.
+func printOperations(results []*endpoint.PatchSearchResult, details bool) {
+	if patchesJson {
+		if results == nil {
+			results = []*endpoint.PatchSearchResult{}
+		}
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(results) == 0 {
+		fmt.Println("No operations found")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if details {
+		fmt.Fprintln(w, "DATE\tOPERATION\tDIRECTION\tPATH\tSIZE\tETAG\tERROR")
+	} else {
+		fmt.Fprintln(w, "DATE\tOPERATION\tTARGET\tPATH\tERROR")
+	}
+	for _, r := range results {
+		p := r.Path
+		if r.MoveFrom != "" {
+			p = r.MoveFrom + " => " + r.Path
+		}
+		date := r.PatchStamp.Local().Format("2006-01-02 15:04:05")
+		if details {
+			var size string
+			if r.Size > 0 {
+				size = fmt.Sprintf("%d", r.Size)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s => %s\t%s\t%s\t%s\t%s\n", date, r.Type, r.Source, r.Target, p, size, r.Etag, r.Error)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", date, r.Type, r.Target, p, r.Error)
+		}
+	}
+	w.Flush()
+}
+
+// PatchesCmd groups the commands for browsing the patches applied by sync tasks.
+var PatchesCmd = &cobra.Command{
+	Use:   "patches",
+	Short: "Browse the patches applied by sync tasks",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// PatchesSearchCmd finds operations in the patches of a task.
+var PatchesSearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Find operations in the patches applied by a sync task",
+	Long: `Search the operations stored in the patches history of a task, most recent first.
+
+--path is a path prefix, or a glob pattern if it contains one of the *?[{ characters. --type can be
+repeated or comma-separated with operation types: CreateFile, CreateFolder, UpdateFile, MoveFile,
+MoveFolder, Delete, Conflict... --from and --to accept RFC3339 dates, YYYY-MM-DD days or durations
+relative to now (e.g. 24h). The TARGET column shows the side that was modified.
+
+Example: find when a file was deleted and on which side
+  cells-sync patches search --task Documents --path reports/2019.pdf --type Delete
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		task, e := selectTask(patchesTask)
+		if e != nil {
+			exit(e)
+		}
+		query := endpoint.PatchSearchQuery{
+			Path:       searchPath,
+			ErrorsOnly: searchErrors,
+			Limit:      searchLimit,
+		}
+		for _, name := range searchTypes {
+			t, e := endpoint.ParseOperationType(strings.TrimSpace(name))
+			if e != nil {
+				exit(e)
+			}
+			query.Types = append(query.Types, t)
+		}
+		if query.From, e = parseSearchTime(searchFrom); e != nil {
+			exit(fmt.Errorf("invalid --from: %s", e.Error()))
+		}
+		if query.To, e = parseSearchTime(searchTo); e != nil {
+			exit(fmt.Errorf("invalid --to: %s", e.Error()))
+		}
+		results, reached, e := remotePatchSearch(task, query)
+		if !reached {
+			var store *endpoint.PatchStore
+			if store, e = openPatchStore(task); e == nil && store != nil {
+				results, e = store.Search(query)
+				store.Stop()
+			}
+		}
+		if e != nil {
+			exit(e)
+		}
+		printOperations(results, false)
+	},
+}
+
+// PatchesHistoryCmd shows all operations that touched a path.
+var PatchesHistoryCmd = &cobra.Command{
+	Use:   "history PATH",
+	Short: "Show the chronological list of operations that touched a path",
+	Long: `Display every stored operation applied on a path, in chronological order, including moves from and
+to this path and moves or deletions of its parent folders.
+
+The DIRECTION column shows the side where the change was detected and the side that was modified,
+SIZE and ETAG are set for file contents changes. This is useful to understand why a file "reverted".
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		task, e := selectTask(patchesTask)
+		if e != nil {
+			exit(e)
+		}
+		values := url.Values{}
+		values.Set("path", args[0])
+		values.Set("limit", strconv.Itoa(historyLimit))
+		response := &control.FileHistoryResponse{}
+		reached, e := patchesGet(task, "files/history", values, response)
+		if !reached {
+			var store *endpoint.PatchStore
+			if store, e = openPatchStore(task); e == nil && store != nil {
+				response.Operations, e = store.History(args[0], historyLimit)
+				store.Stop()
+			}
+		}
+		if e != nil {
+			exit(e)
+		}
+		printOperations(response.Operations, true)
+	},
+}
+
+func init() {
+	PatchesCmd.PersistentFlags().StringVarP(&patchesTask, "task", "t", "", "Task UUID or label")
+	PatchesCmd.PersistentFlags().StringVar(&patchesUrl, "url", "http://localhost:3636", "Web server URL of a running instance")
+	PatchesCmd.PersistentFlags().BoolVar(&patchesJson, "json", false, "Print results as JSON")
+	PatchesSearchCmd.Flags().StringVarP(&searchPath, "path", "p", "", "Path prefix or glob pattern")
+	PatchesSearchCmd.Flags().StringSliceVar(&searchTypes, "type", nil, "Operation types")
+	PatchesSearchCmd.Flags().BoolVar(&searchErrors, "errors", false, "Only show operations in error")
+	PatchesSearchCmd.Flags().StringVar(&searchFrom, "from", "", "Only search patches applied after this date")
+	PatchesSearchCmd.Flags().StringVar(&searchTo, "to", "", "Only search patches applied before this date")
+	PatchesSearchCmd.Flags().IntVarP(&searchLimit, "limit", "l", endpoint.DefaultPatchSearchLimit, "Maximum number of results")
+	PatchesCmd.AddCommand(PatchesSearchCmd)
+	PatchesHistoryCmd.Flags().IntVarP(&historyLimit, "limit", "l", endpoint.DefaultPatchSearchLimit, "Maximum number of operations")
+	PatchesCmd.AddCommand(PatchesHistoryCmd)
+	RootCmd.AddCommand(PatchesCmd)
+}
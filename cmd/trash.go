@@ -0,0 +1,139 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+var (
+	trashTask string
+)
+
+// selectTask finds a task by its uuid or label, or asks the user to pick one.
+func selectTask(ref string) (*config.Task, error) {
+	tasks := config.Default().Tasks
+	if ref != "" {
+		for _, t := range tasks {
+			if t.Uuid == ref || t.Label == ref {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot find task %s", ref)
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("no task configured")
+	} else if len(tasks) == 1 {
+		return tasks[0], nil
+	}
+	s := promptui.Select{Label: "Select Sync", Items: config.Default().Items()}
+	i, _, e := s.Run()
+	if e != nil {
+		return nil, e
+	}
+	return tasks[i], nil
+}
+
+// openTrash opens the trash of the selected task. It is read directly from the task data dir,
+// so that it can be managed whether the application is running or not.
+func openTrash() *endpoint.Trash {
+	task, e := selectTask(trashTask)
+	if e != nil {
+		exit(e)
+	}
+	return endpoint.NewTrash(filepath.Join(config.SyncClientDataDir(), task.Uuid, "trash"), task.GetTrashRetention())
+}
+
+// TrashCmd groups the commands for managing tasks trash.
+var TrashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Manage files deleted or overwritten by sync tasks",
+	Long: `When trash is enabled on a task, files deleted or overwritten on a local (fs://) endpoint
+are moved to a trash folder inside the task data directory. They are kept until the trash
+retention (30 days by default) has expired.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// TrashListCmd lists the items of a task trash.
+var TrashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List files kept in trash",
+	Run: func(cmd *cobra.Command, args []string) {
+		items, e := openTrash().List()
+		if e != nil {
+			exit(e)
+		}
+		if len(items) == 0 {
+			fmt.Println("Trash is empty")
+			return
+		}
+		for _, item := range items {
+			kind := "file"
+			if item.IsDir {
+				kind = "folder"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%d\t%s\n", item.ID, item.Trashed.Format("2006-01-02 15:04:05"), item.Reason, kind, item.Size, item.Path)
+		}
+	},
+}
+
+// TrashRestoreCmd restores one or more items to their original location.
+var TrashRestoreCmd = &cobra.Command{
+	Use:   "restore ID [ID...]",
+	Short: "Restore files from trash to their original location",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		trash := openTrash()
+		for _, id := range args {
+			restored, e := trash.Restore(id)
+			if e != nil {
+				exit(e)
+			}
+			fmt.Println("Restored " + restored)
+		}
+	},
+}
+
+// TrashEmptyCmd removes all items of a task trash.
+var TrashEmptyCmd = &cobra.Command{
+	Use:   "empty",
+	Short: "Definitively remove all files kept in trash",
+	Run: func(cmd *cobra.Command, args []string) {
+		if e := openTrash().Empty(); e != nil {
+			exit(e)
+		}
+		fmt.Println("Trash has been emptied")
+	},
+}
+
+func init() {
+	TrashCmd.PersistentFlags().StringVarP(&trashTask, "task", "t", "", "Task UUID or label")
+	TrashCmd.AddCommand(TrashListCmd, TrashRestoreCmd, TrashEmptyCmd)
+	RootCmd.AddCommand(TrashCmd)
+}
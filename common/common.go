@@ -40,6 +40,25 @@ var (
 	PackageLabel = "Cells Sync Client"
 )
 
+var taskStatusNames = map[model.TaskStatus]string{
+	model.TaskStatusIdle:       "idle",
+	model.TaskStatusPaused:     "paused",
+	model.TaskStatusDisabled:   "disabled",
+	model.TaskStatusProcessing: "processing",
+	model.TaskStatusError:      "error",
+	model.TaskStatusRestarting: "restarting",
+	model.TaskStatusStopping:   "stopping",
+	model.TaskStatusRemoved:    "removed",
+}
+
+// TaskStatusName returns a human-readable name for a model.TaskStatus.
+func TaskStatusName(status model.TaskStatus) string {
+	if name, ok := taskStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
 // EndpointInfo provides information about a connection to an endpoint
 type EndpointInfo struct {
 	Stats          *model.EndpointRootStat
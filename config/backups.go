@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultConfigBackups is the number of previous versions of the config file that are kept.
+const DefaultConfigBackups = 10
+
+const backupTimeFormat = "20060102-150405.000000000"
+
+// Backup is a copy of a file kept by Backups.
+type Backup struct {
+	Name string
+	Time time.Time
+	Size int64
+}
+
+// Backups keeps the last copies of a file inside a folder.
+type Backups struct {
+	Folder string
+	Prefix string
+	Keep   int
+}
+
+// NewConfigBackups returns the Backups of the config file, stored in the application data dir.
+func NewConfigBackups() *Backups {
+	return &Backups{
+		Folder: filepath.Join(SyncClientDataDir(), "config-backups"),
+		Prefix: "config-",
+		Keep:   DefaultConfigBackups,
+	}
+}
+
+// Save stores a new copy of data and removes the oldest copies.
+func (b *Backups) Save(data []byte) (*Backup, error) {
+	if e := os.MkdirAll(b.Folder, 0700); e != nil {
+		return nil, e
+	}
+	now := time.Now()
+	name := b.Prefix + now.Format(backupTimeFormat) + ".json"
+	if e := WriteFileAtomic(filepath.Join(b.Folder, name), data, 0600); e != nil {
+		return nil, e
+	}
+	backups, e := b.List()
+	if e != nil {
+		return nil, e
+	}
+	for i := b.Keep; i < len(backups); i++ {
+		if e := os.Remove(filepath.Join(b.Folder, backups[i].Name)); e != nil {
+			return nil, e
+		}
+	}
+	return &Backup{Name: name, Time: now, Size: int64(len(data))}, nil
+}
+
+// List returns the backups, newest first.
+func (b *Backups) List() ([]*Backup, error) {
+	entries, e := os.ReadDir(b.Folder)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, nil
+		}
+		return nil, e
+	}
+	var backups []*Backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, b.Prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		t, er := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, b.Prefix), ".json"), time.Local)
+		if er != nil {
+			continue
+		}
+		backup := &Backup{Name: name, Time: t}
+		if info, er := entry.Info(); er == nil {
+			backup.Size = info.Size()
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// Read loads the content of a backup.
+func (b *Backups) Read(name string) ([]byte, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, b.Prefix) {
+		return nil, fmt.Errorf("invalid backup name %s", name)
+	}
+	return os.ReadFile(filepath.Join(b.Folder, name))
+}
+
+// WriteFileAtomic writes data to a temporary file in the same folder, syncs it to disk, then renames it
+// to the target path, so that the target is never left truncated.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, e := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-")
+	if e != nil {
+		return e
+	}
+	tmpName := tmp.Name()
+	clean := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if _, e := tmp.Write(data); e != nil {
+		return clean(e)
+	}
+	if e := tmp.Chmod(perm); e != nil {
+		return clean(e)
+	}
+	if e := tmp.Sync(); e != nil {
+		return clean(e)
+	}
+	if e := tmp.Close(); e != nil {
+		os.Remove(tmpName)
+		return e
+	}
+	if e := os.Rename(tmpName, path); e != nil {
+		os.Remove(tmpName)
+		return e
+	}
+	// Persist the rename itself, not supported on all platforms
+	if d, e := os.Open(dir); e == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
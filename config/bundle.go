@@ -0,0 +1,280 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BundleVersion is the version of the bundles produced by NewBundle.
+const BundleVersion = 1
+
+// bundleVarRegexp matches the ${NAME} variables, other "$" characters are left as is.
+var bundleVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Bundle is a portable copy of the configuration, used to replicate a setup on another machine.
+// Authorities are exported without their tokens, and notifications sinks are not exported as their
+// URLs may contain credentials. Tasks hooks run local commands, so they are neither exported nor imported.
+type Bundle struct {
+	Version     int
+	Tasks       []*Task
+	Authorities []*Authority
+	Logs        *Logs      `json:",omitempty"`
+	Updates     *Updates   `json:",omitempty"`
+	Debugging   *Debugging `json:",omitempty"`
+	Service     *Service   `json:",omitempty"`
+}
+
+// DefaultBundleVars returns the variables substituted in bundles paths when none are provided.
+func DefaultBundleVars() map[string]string {
+	vars := map[string]string{}
+	if home, e := os.UserHomeDir(); e == nil && home != "" {
+		vars["HOME"] = home
+	}
+	return vars
+}
+
+// NewBundle exports the tasks, authorities and global sections of a config. Occurrences of the vars values
+// in endpoints URIs and logs folder are replaced by ${NAME}. Passwords found in URIs (e.g. S3 secrets) are
+// replaced by ${SECRET_N} variables that must be provided on import.
+func NewBundle(g *Global, vars map[string]string) (*Bundle, error) {
+	b := &Bundle{Version: BundleVersion}
+	// Deep copy through JSON
+	data, e := json.Marshal(&Bundle{Tasks: g.Tasks, Logs: g.Logs, Updates: g.Updates, Debugging: g.Debugging, Service: g.Service})
+	if e != nil {
+		return nil, e
+	}
+	if e := json.Unmarshal(data, b); e != nil {
+		return nil, e
+	}
+	b.Version = BundleVersion
+	secrets := 0
+	hideSecret := func(uri string) string {
+		if hidden, ok := replaceURISecret(uri, fmt.Sprintf("SECRET_%d", secrets+1)); ok {
+			secrets++
+			return hidden
+		}
+		return uri
+	}
+	for _, t := range b.Tasks {
+		t.LeftURI = hideSecret(collapseVars(t.LeftURI, vars))
+		t.RightURI = hideSecret(collapseVars(t.RightURI, vars))
+		t.RealtimePaused = false
+		t.Hooks = nil
+	}
+	if b.Logs != nil {
+		b.Logs.Folder = collapseVars(b.Logs.Folder, vars)
+	}
+	b.Authorities = []*Authority{}
+	for _, a := range g.Authorities {
+		b.Authorities = append(b.Authorities, &Authority{
+			Id:                 a.Id,
+			URI:                a.URI,
+			InsecureSkipVerify: a.InsecureSkipVerify,
+			ServerLabel:        a.ServerLabel,
+			Username:           a.Username,
+		})
+	}
+	return b, nil
+}
+
+// ParseBundle reads a bundle in YAML or JSON format.
+func ParseBundle(data []byte) (*Bundle, error) {
+	// Decode as generic values first, so that YAML keys follow the JSON fields names.
+	var generic interface{}
+	if e := yaml.Unmarshal(data, &generic); e != nil {
+		return nil, e
+	}
+	jsonData, e := json.Marshal(generic)
+	if e != nil {
+		return nil, e
+	}
+	b := &Bundle{}
+	if e := json.Unmarshal(jsonData, b); e != nil {
+		return nil, e
+	}
+	if b.Version == 0 || b.Version > BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	for _, t := range b.Tasks {
+		t.Hooks = nil
+	}
+	return b, nil
+}
+
+// Marshal encodes the bundle in "json" or "yaml" format.
+func (b *Bundle) Marshal(format string) ([]byte, error) {
+	data, e := json.MarshalIndent(b, "", "  ")
+	if e != nil || format == "json" {
+		return data, e
+	}
+	if format != "yaml" {
+		return nil, fmt.Errorf("unsupported format %s, please use json or yaml", format)
+	}
+	// Go through a yaml.Node to keep fields ordering
+	var node yaml.Node
+	if e := yaml.Unmarshal(data, &node); e != nil {
+		return nil, e
+	}
+	resetYamlStyle(&node)
+	return yaml.Marshal(&node)
+}
+
+// Expand replaces ${NAME} variables in endpoints URIs and logs folder. Values are looked up in vars first,
+// then in the environment.
+func (b *Bundle) Expand(vars map[string]string) {
+	mapping := func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+	for _, t := range b.Tasks {
+		t.LeftURI = expandVars(t.LeftURI, mapping)
+		t.RightURI = expandVars(t.RightURI, mapping)
+	}
+	if b.Logs != nil {
+		b.Logs.Folder = expandVars(b.Logs.Folder, mapping)
+	}
+}
+
+// Variables lists the names of the ${NAME} variables used by the bundle.
+func (b *Bundle) Variables() []string {
+	found := map[string]struct{}{}
+	collect := func(s string) {
+		for _, match := range bundleVarRegexp.FindAllStringSubmatch(s, -1) {
+			found[match[1]] = struct{}{}
+		}
+	}
+	for _, t := range b.Tasks {
+		collect(t.LeftURI)
+		collect(t.RightURI)
+	}
+	if b.Logs != nil {
+		collect(b.Logs.Folder)
+	}
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MissingAuthorities lists the bundle authorities that are not logged in the given config.
+func (b *Bundle) MissingAuthorities(g *Global) []*Authority {
+	var missing []*Authority
+	for _, a := range b.Authorities {
+		found := false
+		for _, existing := range g.Authorities {
+			if existing.Id == a.Id && existing.RefreshToken != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, a)
+		}
+	}
+	return missing
+}
+
+// collapseVars replaces the beginning of the path by a ${NAME} variable if it starts with one of the values.
+// Only whole path segments are matched, and the longest values are tried first, so that nested paths are
+// matched by the most specific variable.
+func collapseVars(s string, vars map[string]string) string {
+	var names []string
+	for name, value := range vars {
+		if value != "" && value != "/" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(vars[names[i]]) > len(vars[names[j]])
+	})
+	prefix, p := "", s
+	if i := strings.Index(s, "://"); i >= 0 {
+		prefix, p = s[:i+3], s[i+3:]
+	}
+	for _, name := range names {
+		value := strings.TrimRight(filepath.ToSlash(vars[name]), "/")
+		candidates := []string{value}
+		if !strings.HasPrefix(value, "/") {
+			// Windows paths are written /C:/... in URIs
+			candidates = append(candidates, "/"+value)
+		}
+		// Compare with slashes, the original separators are kept in the result
+		slashed := filepath.ToSlash(p)
+		for _, c := range candidates {
+			if !strings.HasPrefix(slashed, c) {
+				continue
+			}
+			if rest := slashed[len(c):]; rest == "" || strings.ContainsAny(rest[:1], "/?#") {
+				return prefix + p[:len(c)-len(value)] + "${" + name + "}" + p[len(c):]
+			}
+		}
+	}
+	return s
+}
+
+// expandVars replaces the ${NAME} variables with their values.
+func expandVars(s string, mapping func(string) string) string {
+	return bundleVarRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		return mapping(match[2 : len(match)-1])
+	})
+}
+
+// replaceURISecret replaces the password part of the URI user info by a ${NAME} variable.
+// The raw string is modified, as url.URL would escape the variable.
+func replaceURISecret(uri, name string) (string, bool) {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return uri, false
+	}
+	rest := uri[i+3:]
+	end := strings.Index(rest, "/")
+	if end < 0 {
+		end = len(rest)
+	}
+	at := strings.LastIndex(rest[:end], "@")
+	if at < 0 {
+		return uri, false
+	}
+	colon := strings.Index(rest[:at], ":")
+	if colon < 0 {
+		return uri, false
+	}
+	return uri[:i+3] + rest[:colon+1] + "${" + name + "}" + rest[at:], true
+}
+
+func resetYamlStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		resetYamlStyle(c)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Credentials are a login and a secret used by endpoints that authenticate without OAuth (e.g. webdav, s3).
+// The secret is stored in the OS keyring and never written to the config file: Credentials cannot be saved if the
+// keyring is not available.
+type Credentials struct {
+	// Id identifies the server and the login, see CredentialsId.
+	Id    string `json:"id"`
+	Login string `json:"login"`
+	// Secret is only read from the config file (e.g. after a migration), it is moved to the keyring on save.
+	Secret string `json:"secret,omitempty"`
+
+	secret string
+}
+
+// CredentialsId builds the identifier of the Credentials used by an endpoint URI: its scheme, user and host.
+// Wrapping schemes (e.g. enc+s3) share the Credentials of the wrapped endpoint. For s3 URIs, the user is the name
+// of the Credentials, which defaults to the access key.
+func CredentialsId(u *url.URL) string {
+	scheme := u.Scheme
+	if i := strings.LastIndex(scheme, "+"); i >= 0 {
+		scheme = scheme[i+1:]
+	}
+	id := url.URL{Scheme: scheme, Host: u.Host}
+	if u.User != nil {
+		id.User = url.User(u.User.Username())
+	}
+	return id.String()
+}
+
+// NewCredentials creates Credentials for the given endpoint URI.
+func NewCredentials(uri, login, secret string) (*Credentials, error) {
+	u, e := url.Parse(uri)
+	if e != nil {
+		return nil, e
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid URI %s, expected scheme://[user@]host[:port]", uri)
+	}
+	return &Credentials{Id: CredentialsId(u), Login: login, secret: secret}, nil
+}
+
+// ExtractURISecret removes the secret of an s3 URI written as s3://key:secret@host/bucket, and returns the URI
+// referencing the Credentials by their Id instead, along with the Credentials to register. It returns nil Credentials
+// if the URI has no inline secret.
+func ExtractURISecret(uri string) (string, *Credentials) {
+	u, e := url.Parse(uri)
+	if e != nil || u.User == nil || !strings.HasSuffix(u.Scheme, "s3") {
+		return uri, nil
+	}
+	secret, ok := u.User.Password()
+	if !ok {
+		return uri, nil
+	}
+	u.User = url.User(u.User.Username())
+	return u.String(), &Credentials{Id: CredentialsId(u), Login: u.User.Username(), secret: secret}
+}
+
+// GetSecret returns the secret, that is never exposed in JSON once loaded.
+func (c *Credentials) GetSecret() string {
+	return c.secret
+}
+
+// BeforeSave stores the secret in keyring and returns a copy of the Credentials to be saved in the config.
+// It fails if the keyring is not available rather than saving the secret in clear.
+func (c *Credentials) BeforeSave() (*Credentials, error) {
+	saved := &Credentials{Id: c.Id, Login: c.Login}
+	if c.secret != "" {
+		if e := SecretToKeyring(c.Id, c.secret); e != nil {
+			return nil, fmt.Errorf("cannot store secret of credentials %s in keyring: %s", c.Id, e.Error())
+		}
+	}
+	return saved, nil
+}
+
+// AfterLoad moves the secret found in the config or in the keyring to the private field.
+func (c *Credentials) AfterLoad() {
+	if c.Secret != "" {
+		c.secret = c.Secret
+		c.Secret = ""
+	} else if s, e := SecretFromKeyring(c.Id); e == nil {
+		c.secret = s
+	}
+}
+
+// FindCredentials looks up Credentials by their Id. It returns nil if none are registered.
+func (g *Global) FindCredentials(id string) *Credentials {
+	for _, c := range g.Credentials {
+		if c.Id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// SetCredentials creates or replaces Credentials and saves the config.
+func (g *Global) SetCredentials(creds *Credentials) error {
+	for idx, c := range g.Credentials {
+		if c.Id == creds.Id {
+			g.Credentials[idx] = creds
+			return Save()
+		}
+	}
+	g.Credentials = append(g.Credentials, creds)
+	return Save()
+}
+
+// extractTaskSecrets moves the inline secrets of the task URIs to the Credentials, so that they are never saved in
+// the tasks. It does not save the config.
+func (g *Global) extractTaskSecrets(t *Task) {
+	for _, uri := range []*string{&t.LeftURI, &t.RightURI} {
+		stripped, creds := ExtractURISecret(*uri)
+		if creds == nil {
+			continue
+		}
+		*uri = stripped
+		if existing := g.FindCredentials(creds.Id); existing != nil {
+			existing.Login = creds.Login
+			existing.secret = creds.secret
+		} else {
+			g.Credentials = append(g.Credentials, creds)
+		}
+	}
+}
+
+// RemoveCredentials removes Credentials from the config and their secret from the keyring.
+func (g *Global) RemoveCredentials(id string) error {
+	var creds []*Credentials
+	for _, c := range g.Credentials {
+		if c.Id != id {
+			creds = append(creds, c)
+		}
+	}
+	if len(creds) == len(g.Credentials) {
+		return fmt.Errorf("cannot find credentials %s", id)
+	}
+	_ = ClearSecretKeyring(id)
+	g.Credentials = creds
+	return Save()
+}
@@ -22,8 +22,11 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pydio/cells/v4/common/log"
 )
@@ -34,21 +37,56 @@ const (
 	UpdateDefaultPublicKey = "-----BEGIN PUBLIC KEY-----\nMIIBCgKCAQEAwh/ofjZTITlQc4h/qDZMR3RquBxlG7UTunDKLG85JQwRtU7EL90v\nlWxamkpSQsaPeqho5Q6OGkhJvZkbWsLBJv6LZg+SBhk6ZSPxihD+Kfx8AwCcWZ46\nDTpKpw+mYnkNH1YEAedaSfJM8d1fyU1YZ+WM3P/j1wTnUGRgebK9y70dqZEo2dOK\nn98v3kBP7uEN9eP/wig63RdmChjCpPb5gK1/WKnY4NFLQ60rPAOBsXurxikc9N/3\nEvbIB/1vQNqm7yEwXk8LlOC6Fp8W/6A0DIxr2BnZAJntMuH2ulUfhJgw0yJalMNF\nDR0QNzGVktdLOEeSe8BSrASe9uZY2SDbTwIDAQAB\n-----END PUBLIC KEY-----"
 )
 
+// Conflict policies that can be set on a Task. An empty policy leaves conflicts unresolved.
+const (
+	ConflictPolicyKeepBoth     = "keep-both"
+	ConflictPolicyPreferLeft   = "prefer-left"
+	ConflictPolicyPreferRight  = "prefer-right"
+	ConflictPolicyPreferNewest = "prefer-newest"
+)
+
+// DefaultHookTimeout is the maximum duration of a hook command if it does not define its own Timeout.
+const DefaultHookTimeout = time.Minute
+
+// DefaultHistoryRetention is the duration during which the tasks history is kept.
+const DefaultHistoryRetention = 30 * 24 * time.Hour
+
+// DefaultTrashRetention is the duration during which trashed files are kept.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// DefaultPatchRetention is applied to tasks that do not define their own PatchRetention.
+var DefaultPatchRetention = PatchRetention{MaxCount: 100, MaxSize: 50}
+
+// DefaultIgnoreRules are applied to tasks that do not define their own IgnoreRules.
+var DefaultIgnoreRules = []string{".git*"}
+
 // Global is the main struct representing configs.
 type Global struct {
+	// Version is the schema version of the config file, see ConfigVersion.
+	Version     int
 	Tasks       []*Task
 	Authorities []*Authority
 	Logs        *Logs
 	Updates     *Updates
 	Debugging   *Debugging
 	Service     *Service
+	// Notifications lists the URLs receiving sync events.
+	Notifications []*NotificationSink
+	// SSHIdentities reference the keys used by sftp:// endpoints.
+	SSHIdentities []*SSHIdentity `json:",omitempty"`
+	// Credentials are used by endpoints authenticating with a login and a secret.
+	Credentials []*Credentials `json:",omitempty"`
 	changes     []chan interface{}
+	// readOnly prevents overwriting a config file that could not be loaded.
+	readOnly error
 }
 
 // TaskChange is an event sent when something changes inside the configs tasks.
 type TaskChange struct {
 	Type string
 	Task *Task
+	// Previous is the task before modification, for "update" events.
+	Previous *Task
 }
 
 // Task represents a sync task configuration.
@@ -59,12 +97,129 @@ type Task struct {
 	RightURI       string
 	Direction      string
 	SelectiveRoots []string
+	// IgnoreRules is a list of gitignore-style patterns, nil means DefaultIgnoreRules.
+	IgnoreRules []string
+	// ConflictPolicy is used to automatically resolve conflicts, see ConflictPolicy* constants.
+	ConflictPolicy string
+	// Hooks are optional local commands executed around patches processing.
+	Hooks *Hooks
+	// HistoryRetention is a duration string (e.g. "168h"), DefaultHistoryRetention is used if empty.
+	HistoryRetention string
+	// Trash moves files deleted or overwritten on local endpoints to the task trash instead of removing them.
+	Trash bool
+	// TrashRetention is a duration string (e.g. "168h"), DefaultTrashRetention is used if empty.
+	TrashRetention string
+	// PatchRetention limits the patches kept in the task history, DefaultPatchRetention is used if nil.
+	PatchRetention *PatchRetention
 
 	Realtime       bool
 	RealtimePaused bool
 
 	LoopInterval string
 	HardInterval string
+
+	// invalid is set when the task does not validate on load, see LoadError.
+	invalid error
+}
+
+// GetIgnoreRules returns the task IgnoreRules or a copy of the DefaultIgnoreRules if they are not set.
+func (t *Task) GetIgnoreRules() []string {
+	if t.IgnoreRules == nil {
+		return append([]string{}, DefaultIgnoreRules...)
+	}
+	return t.IgnoreRules
+}
+
+// GetHistoryRetention parses the task HistoryRetention or returns the DefaultHistoryRetention.
+func (t *Task) GetHistoryRetention() time.Duration {
+	if d, e := time.ParseDuration(t.HistoryRetention); e == nil && d > 0 {
+		return d
+	}
+	return DefaultHistoryRetention
+}
+
+// GetTrashRetention parses the task TrashRetention or returns the DefaultTrashRetention.
+func (t *Task) GetTrashRetention() time.Duration {
+	if d, e := time.ParseDuration(t.TrashRetention); e == nil && d > 0 {
+		return d
+	}
+	return DefaultTrashRetention
+}
+
+// GetPatchRetention returns the task PatchRetention or the DefaultPatchRetention.
+func (t *Task) GetPatchRetention() PatchRetention {
+	if t.PatchRetention == nil {
+		return DefaultPatchRetention
+	}
+	return *t.PatchRetention
+}
+
+// PatchRetention defines which patches are kept in a task history. Zero values disable the corresponding limit.
+type PatchRetention struct {
+	// MaxCount is the maximum number of patches.
+	MaxCount int
+	// MaxAge is a duration string (e.g. "720h"), older patches are removed.
+	MaxAge string
+	// MaxSize is the maximum size of stored patches, in megabytes.
+	MaxSize int
+}
+
+// GetMaxAge parses MaxAge, it returns 0 if it is empty or invalid.
+func (r PatchRetention) GetMaxAge() time.Duration {
+	if d, e := time.ParseDuration(r.MaxAge); e == nil && d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Hook is a local command that receives a description of the patch as JSON on its standard input.
+type Hook struct {
+	Command string
+	Args    []string
+	// Timeout is a duration string (e.g. "30s"), DefaultHookTimeout is used if empty.
+	Timeout string
+}
+
+// Hooks defines the commands to run at each step of a patch processing.
+type Hooks struct {
+	BeforePatch       *Hook
+	AfterPatchSuccess *Hook
+	AfterPatchError   *Hook
+}
+
+// GetTimeout parses the hook Timeout or returns the DefaultHookTimeout.
+func (h *Hook) GetTimeout() time.Duration {
+	if d, e := time.ParseDuration(h.Timeout); e == nil && d > 0 {
+		return d
+	}
+	return DefaultHookTimeout
+}
+
+// NotificationSink is an URL receiving sync events as JSON payloads.
+type NotificationSink struct {
+	Url string
+	// Secret is used to sign payloads with HMAC-SHA256. No signature is sent if empty.
+	Secret string
+	// Events restricts the notified events. All events are sent if empty.
+	Events []string
+	// MaxRetries is the number of retries after a failed delivery, DefaultNotificationRetries is used if 0.
+	MaxRetries int
+}
+
+// DefaultNotificationRetries is the number of retries for a failed notification delivery.
+const DefaultNotificationRetries = 5
+
+// Accepts checks if the event is sent to this sink.
+func (n *NotificationSink) Accepts(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
 }
 
 // Logs represents the logs configuration.
@@ -128,8 +283,26 @@ func NewUpdates() *Updates {
 	}
 }
 
-// CreateTask adds a Task to the config and emits a TaskChange event "create".
+// HasTask checks if a task with this UUID exists.
+func (g *Global) HasTask(uuid string) bool {
+	for _, t := range g.Tasks {
+		if t.Uuid == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateTask validates a Task, adds it to the config and emits a TaskChange event "create".
+// Inline secrets of the endpoints URIs are moved to the Credentials.
 func (g *Global) CreateTask(t *Task) error {
+	if e := t.Validate(); e != nil {
+		return e
+	}
+	if g.HasTask(t.Uuid) {
+		return fmt.Errorf("task uuid %s is already used", t.Uuid)
+	}
+	g.extractTaskSecrets(t)
 	g.Tasks = append(g.Tasks, t)
 	e := Save()
 	if e == nil {
@@ -162,11 +335,18 @@ func (g *Global) RemoveTask(task *Task) error {
 	return e
 }
 
-// UpdateTask updates a Task inside the config and emits a TaskChange event "update".
+// UpdateTask validates a Task, updates it inside the config and emits a TaskChange event "update".
+// Inline secrets of the endpoints URIs are moved to the Credentials.
 func (g *Global) UpdateTask(task *Task) error {
+	if e := task.Validate(); e != nil {
+		return e
+	}
+	g.extractTaskSecrets(task)
 	var newTasks []*Task
+	var previous *Task
 	for _, t := range g.Tasks {
 		if t.Uuid == task.Uuid {
+			previous = t
 			newTasks = append(newTasks, task)
 		} else {
 			newTasks = append(newTasks, t)
@@ -178,7 +358,7 @@ func (g *Global) UpdateTask(task *Task) error {
 	}
 	go func() {
 		for _, c := range g.changes {
-			c <- &TaskChange{Type: "update", Task: task}
+			c <- &TaskChange{Type: "update", Task: task, Previous: previous}
 		}
 	}()
 	return nil
@@ -277,7 +457,23 @@ func Default() *Global {
 		if c, e := LoadFromFile(); e == nil {
 			def = c
 		} else {
-			def = &Global{}
+			def = &Global{Version: ConfigVersion}
+			var corrupt *CorruptConfigError
+			var unsupported *UnsupportedVersionError
+			if errors.As(e, &corrupt) {
+				if target, er := quarantineConfig(); er == nil {
+					log.Logger(context.Background()).Error("Config file is invalid and was moved to " + target + ", starting with an empty config: " + e.Error())
+				} else {
+					def.readOnly = e
+					log.Logger(context.Background()).Error("Config file is invalid and cannot be moved, it will not be overwritten: " + e.Error())
+				}
+			} else if errors.As(e, &unsupported) {
+				def.readOnly = e
+				log.Logger(context.Background()).Error(e.Error())
+			} else if !os.IsNotExist(e) {
+				def.readOnly = e
+				log.Logger(context.Background()).Error("Cannot read config file, it will not be overwritten: " + e.Error())
+			}
 		}
 		if def.Logs == nil {
 			def.Logs = NewLogs()
@@ -298,19 +494,54 @@ func Default() *Global {
 				a.AfterLoad()
 			}
 		}
+		plainSecrets := false
+		for _, c := range def.Credentials {
+			plainSecrets = plainSecrets || c.Secret != ""
+			c.AfterLoad()
+		}
+		// Move secrets found in the file (e.g. migrated from the tasks URIs) to the keyring
+		if plainSecrets && def.readOnly == nil {
+			if e := Save(); e != nil {
+				log.Logger(context.Background()).Error("Cannot move credentials secrets to keyring: " + e.Error())
+			}
+		}
 	}
 	return def
 }
 
+// LoadError returns the error that prevented loading the config file, if any. In that case, the config
+// is not saved to preserve the original file.
+func LoadError() error {
+	return Default().readOnly
+}
+
 // Save writes the config to the JSON file.
 func Save() error {
+	return save(true)
+}
+
+// save writes the config to the JSON file. Saves that only refresh tokens pass backup=false, as they
+// would otherwise quickly rotate out the backups of actual changes.
+func save(backup bool) error {
+	if def.readOnly != nil {
+		return fmt.Errorf("config was not saved to preserve the original file (%s)", def.readOnly.Error())
+	}
 	// Copy def and update Authorities before saving
 	toSave := *def
+	toSave.Version = ConfigVersion
 	toSave.Authorities = []*Authority{}
 	for _, a := range def.Authorities {
 		toSave.Authorities = append(toSave.Authorities, a.BeforeSave())
 	}
-	return WriteToFile(&toSave)
+	toSave.Credentials = nil
+	for _, c := range def.Credentials {
+		saved, e := c.BeforeSave()
+		if e != nil {
+			return e
+		}
+		toSave.Credentials = append(toSave.Credentials, saved)
+	}
+	return writeToFile(&toSave, backup)
 }
 
 // Watch provides a chan emitting events on config changes.
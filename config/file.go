@@ -20,34 +20,87 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 func getPath() string {
 	return filepath.Join(SyncClientDataDir(), "config.json")
 }
 
-// LoadFromFile loads a Global config from a JSON file.
+// LoadFromFile loads a Global config from a JSON file, migrating it to the current ConfigVersion if necessary.
 func LoadFromFile() (*Global, error) {
 	data, err := os.ReadFile(getPath())
 	if err != nil {
 		return nil, err
 	}
-	g := Global{}
-	if e := json.Unmarshal(data, &g); e == nil {
-		return &g, nil
-	} else {
-		return nil, e
+	setLastData(data)
+	return ParseConfig(data)
+}
+
+// quarantineConfig renames an invalid config file so that it is not overwritten by the next save.
+func quarantineConfig() (string, error) {
+	target := getPath() + ".corrupt-" + time.Now().Format("20060102-150405")
+	if e := os.Rename(getPath(), target); e != nil {
+		return "", e
 	}
+	return target, nil
 }
 
-// WriteToFile stores a Global config JSON-encoded.
+// WriteToFile stores a Global config JSON-encoded. The previous version of the file is kept in the config backups.
 func WriteToFile(config *Global) error {
+	return writeToFile(config, true)
+}
+
+// writeToFile stores a Global config JSON-encoded, backing up the previous version of the file if backup is true.
+func writeToFile(config *Global, backup bool) error {
 	data, e := json.Marshal(config)
 	if e != nil {
 		return e
 	}
-	return os.WriteFile(getPath(), data, 0755)
+	if backup {
+		if e := backupConfig(data); e != nil {
+			return e
+		}
+	}
+	if e := WriteFileAtomic(getPath(), data, 0600); e != nil {
+		return e
+	}
+	setLastData(data)
+	return nil
+}
+
+// backupConfig saves the current config file to the backups if it is about to be modified.
+func backupConfig(newData []byte) error {
+	current, e := os.ReadFile(getPath())
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil
+		}
+		return e
+	}
+	if bytes.Equal(current, newData) {
+		return nil
+	}
+	_, e = NewConfigBackups().Save(current)
+	return e
+}
+
+// RestoreBackup replaces the config file by one of its backups, after validating it. The current file
+// is itself backed up first.
+func RestoreBackup(name string) error {
+	data, e := NewConfigBackups().Read(name)
+	if e != nil {
+		return e
+	}
+	if _, e := ParseConfig(data); e != nil {
+		return e
+	}
+	if e := backupConfig(data); e != nil {
+		return e
+	}
+	return WriteFileAtomic(getPath(), data, 0600)
 }
@@ -39,21 +39,19 @@ func GetHttpProtocol() string {
 	return "http"
 }
 
+// GetHttpURL returns the URL of the web server as configured, without checking the port availability.
+// It is used by command line clients to reach a running instance.
+func GetHttpURL() string {
+	hostname, port := configuredHostPort()
+	return fmt.Sprintf("%s://%s:%d", GetHttpProtocol(), hostname, port)
+}
+
 // GetHttpAddress tries to bind to an available port between 3636 and 3666 and returns the first port available.
 // This range of port is important for the OAuth2 authentication mechanism as the associated redirect_uris are
 // automatically registered inside the server.
 func GetHttpAddress() (string, error) {
 	httpOnce.Do(func() {
-		hostname := "localhost"
-		if ho := os.Getenv("CELLS_SYNC_HTTP_HOST"); ho != "" {
-			hostname = ho
-		}
-		port := 3636
-		if po := os.Getenv("CELLS_SYNC_HTTP_PORT"); po != "" {
-			if p, e := strconv.Atoi(po); e == nil {
-				port = p
-			}
-		}
+		hostname, port := configuredHostPort()
 		for ; port <= 3666; port++ {
 			if err := net.CheckPortAvailability(fmt.Sprintf("%d", port)); err == nil {
 				break
@@ -67,3 +65,18 @@ func GetHttpAddress() (string, error) {
 	})
 	return httpAddress, noAvail
 }
+
+// configuredHostPort reads the hostname and the first port to try from the environment.
+func configuredHostPort() (string, int) {
+	hostname := "localhost"
+	if ho := os.Getenv("CELLS_SYNC_HTTP_HOST"); ho != "" {
+		hostname = ho
+	}
+	port := 3636
+	if po := os.Getenv("CELLS_SYNC_HTTP_PORT"); po != "" {
+		if p, e := strconv.Atoi(po); e == nil {
+			port = p
+		}
+	}
+	return hostname, port
+}
@@ -20,6 +20,7 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strings"
 
@@ -78,3 +79,45 @@ func ClearKeyring(a *Authority) error {
 	}
 	return err
 }
+
+// SecretToKeyring tries to store a Credentials secret in local keychain
+func SecretToKeyring(id, secret string) error {
+	if e := keyring.Set(keyringService, id+"::Secret", secret); e != nil {
+		return e
+	}
+	log.Logger(oidcContext).Debug("Saved secret in keyring for credentials " + id)
+	return nil
+}
+
+// SecretFromKeyring tries to find a Credentials secret inside local keychain
+func SecretFromKeyring(id string) (string, error) {
+	return keyring.Get(keyringService, id+"::Secret")
+}
+
+// ClearSecretKeyring removes a Credentials secret from local keychain, if it is present
+func ClearSecretKeyring(id string) error {
+	return keyring.Delete(keyringService, id+"::Secret")
+}
+
+// EncryptionKeyToKeyring stores an encryption key in local keychain. Encryption keys are never written to the conf.
+func EncryptionKeyToKeyring(name string, key []byte) error {
+	if e := keyring.Set(keyringService, name+"::EncryptionKey", base64.StdEncoding.EncodeToString(key)); e != nil {
+		return e
+	}
+	log.Logger(oidcContext).Debug("Saved encryption key in keyring " + name)
+	return nil
+}
+
+// EncryptionKeyFromKeyring finds an encryption key inside local keychain
+func EncryptionKeyFromKeyring(name string) ([]byte, error) {
+	value, e := keyring.Get(keyringService, name+"::EncryptionKey")
+	if e != nil {
+		return nil, e
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// ClearEncryptionKeyring removes an encryption key from local keychain, if it is present
+func ClearEncryptionKeyring(name string) error {
+	return keyring.Delete(keyringService, name+"::EncryptionKey")
+}
@@ -0,0 +1,244 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// ConfigVersion is the current version of the config file schema. Files without a version are considered
+// as version 0 and are migrated on load.
+const ConfigVersion = 2
+
+// migration transforms a raw config from version N to version N+1.
+type migration func(raw map[string]interface{}) error
+
+// migrations are indexed by the version they migrate from.
+var migrations = []migration{
+	migrateV0,
+	migrateV1,
+}
+
+// CorruptConfigError is returned when the config file cannot be parsed or is not valid.
+type CorruptConfigError struct {
+	Err error
+}
+
+func (c *CorruptConfigError) Error() string {
+	return "invalid config: " + c.Err.Error()
+}
+
+func (c *CorruptConfigError) Unwrap() error {
+	return c.Err
+}
+
+// UnsupportedVersionError is returned when the config file was written by a more recent version of the application.
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (u *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("config version %d is not supported by this application (max %d), please upgrade", u.Version, ConfigVersion)
+}
+
+// ParseConfig migrates the JSON config to the current version, decodes it strictly and validates it.
+func ParseConfig(data []byte) (*Global, error) {
+	raw := map[string]interface{}{}
+	if e := json.Unmarshal(data, &raw); e != nil {
+		return nil, &CorruptConfigError{Err: e}
+	}
+	version := 0
+	if v, ok := raw["Version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, &CorruptConfigError{Err: fmt.Errorf("invalid version %v", v)}
+		}
+		version = int(f)
+	}
+	if version > ConfigVersion {
+		return nil, &UnsupportedVersionError{Version: version}
+	}
+	for ; version < ConfigVersion; version++ {
+		if e := migrations[version](raw); e != nil {
+			return nil, &CorruptConfigError{Err: fmt.Errorf("migration from version %d failed: %s", version, e.Error())}
+		}
+	}
+	raw["Version"] = ConfigVersion
+
+	migrated, e := json.Marshal(raw)
+	if e != nil {
+		return nil, &CorruptConfigError{Err: e}
+	}
+	dec := json.NewDecoder(bytes.NewReader(migrated))
+	dec.DisallowUnknownFields()
+	g := &Global{}
+	if e := dec.Decode(g); e != nil {
+		return nil, &CorruptConfigError{Err: e}
+	}
+	if e := g.Validate(); e != nil {
+		return nil, &CorruptConfigError{Err: e}
+	}
+	g.flagInvalidTasks()
+	return g, nil
+}
+
+// Validate checks the consistency of the authorities and notifications, and that no task is empty.
+// Invalid tasks do not invalidate the whole config, they are flagged on load, see Task.LoadError.
+func (g *Global) Validate() error {
+	var errs []string
+	for i, t := range g.Tasks {
+		if t == nil {
+			errs = append(errs, fmt.Sprintf("task #%d is empty", i))
+		}
+	}
+	for i, a := range g.Authorities {
+		if a == nil {
+			errs = append(errs, fmt.Sprintf("authority #%d is empty", i))
+		} else if u, e := url.Parse(a.URI); e != nil || u.Scheme == "" {
+			errs = append(errs, fmt.Sprintf("authority #%d has an invalid URI", i))
+		}
+	}
+	for i, n := range g.Notifications {
+		if n == nil {
+			errs = append(errs, fmt.Sprintf("notification sink #%d is empty", i))
+		} else if u, e := url.Parse(n.Url); e != nil || u.Scheme == "" {
+			errs = append(errs, fmt.Sprintf("notification sink #%d has an invalid URL", i))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Validate checks that the task has a uuid, valid endpoint URIs and a supported direction.
+func (t *Task) Validate() error {
+	var errs []string
+	if t.Uuid == "" {
+		errs = append(errs, "task has no uuid")
+	}
+	for _, uri := range []string{t.LeftURI, t.RightURI} {
+		if u, e := url.Parse(uri); e != nil || u.Scheme == "" {
+			errs = append(errs, fmt.Sprintf("invalid endpoint URI %q", uri))
+		}
+	}
+	if t.Direction != "Bi" && t.Direction != "Left" && t.Direction != "Right" {
+		errs = append(errs, fmt.Sprintf("invalid direction %q", t.Direction))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// LoadError returns the reason why the task was flagged as invalid when loading the config file, if any.
+// Such tasks are kept in the file but are not started.
+func (t *Task) LoadError() error {
+	return t.invalid
+}
+
+// flagInvalidTasks sets the LoadError of the tasks that do not validate or that reuse the uuid of a previous task.
+func (g *Global) flagInvalidTasks() {
+	uuids := map[string]bool{}
+	for _, t := range g.Tasks {
+		if e := t.Validate(); e != nil {
+			t.invalid = e
+		} else if uuids[t.Uuid] {
+			t.invalid = fmt.Errorf("task uuid %s is used twice", t.Uuid)
+		}
+		uuids[t.Uuid] = true
+	}
+}
+
+// migrateV0 migrates configs written before versioning: tasks without uuid or direction receive defaults,
+// and the legacy token_status field of authorities is removed.
+func migrateV0(raw map[string]interface{}) error {
+	if tasks, ok := raw["Tasks"].([]interface{}); ok {
+		for _, t := range tasks {
+			task, ok := t.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if id, _ := task["Uuid"].(string); id == "" {
+				task["Uuid"] = uuid.New()
+			}
+			if dir, _ := task["Direction"].(string); dir == "" {
+				task["Direction"] = "Bi"
+			}
+		}
+	}
+	if auths, ok := raw["Authorities"].([]interface{}); ok {
+		for _, a := range auths {
+			auth, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// Status is computed again by the token monitor
+			delete(auth, "token_status")
+		}
+	}
+	return nil
+}
+
+// migrateV1 moves the secrets written inline in s3 task URIs to Credentials. Their secret is kept in the file
+// until the config is saved again, when it is moved to the keyring.
+func migrateV1(raw map[string]interface{}) error {
+	tasks, ok := raw["Tasks"].([]interface{})
+	if !ok {
+		return nil
+	}
+	creds, _ := raw["Credentials"].([]interface{})
+	known := map[string]bool{}
+	for _, c := range creds {
+		if cred, ok := c.(map[string]interface{}); ok {
+			if id, _ := cred["id"].(string); id != "" {
+				known[id] = true
+			}
+		}
+	}
+	for _, t := range tasks {
+		task, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"LeftURI", "RightURI"} {
+			uri, _ := task[key].(string)
+			stripped, c := ExtractURISecret(uri)
+			if c == nil {
+				continue
+			}
+			task[key] = stripped
+			if !known[c.Id] {
+				known[c.Id] = true
+				creds = append(creds, map[string]interface{}{"id": c.Id, "login": c.Login, "secret": c.GetSecret()})
+			}
+		}
+	}
+	if len(creds) > 0 {
+		raw["Credentials"] = creds
+	}
+	return nil
+}
@@ -330,7 +330,8 @@ func (g *Global) UpdateAuthority(a *Authority, isRefresh bool) error {
 			}
 		}
 	}
-	e := Save()
+	// Token refreshes are not backed up
+	e := save(!isRefresh)
 	if e == nil {
 		go func() {
 			for _, c := range g.changes {
@@ -354,11 +355,15 @@ func (a *Authority) BeforeSave() *Authority {
 
 // AfterLoad tries to read tokens from keyring and replace them in the Authority
 func (a *Authority) AfterLoad() {
-	// Load tokens from keyring if possible
+	a.loadTokens()
+	getTokenMonitor(a, nil)
+}
+
+// loadTokens reads tokens from keyring if possible.
+func (a *Authority) loadTokens() {
 	if b, err := AuthFromKeyring(*a); err == nil {
 		a.IdToken = b.IdToken
 		a.AccessToken = b.AccessToken
 		a.RefreshToken = b.RefreshToken
 	}
-	getTokenMonitor(a, nil)
 }
@@ -30,6 +30,11 @@ var monitors map[string]*tokenMonitor
 
 var monitorsLock *sync.Mutex
 
+var (
+	refreshFailures     = make(map[string]uint64)
+	refreshFailuresLock = &sync.Mutex{}
+)
+
 // tokenMonitor automatically refresh IdToken as needed
 type tokenMonitor struct {
 	a             *Authority
@@ -85,6 +90,9 @@ func (t *tokenMonitor) Start() {
 		case <-t.trigger:
 			if e := t.a.Refresh(); e != nil {
 				log.Logger(oidcContext).Info("Refreshing token failed for " + t.a.key() + ", will retry in 10s :" + e.Error())
+				refreshFailuresLock.Lock()
+				refreshFailures[t.a.key()]++
+				refreshFailuresLock.Unlock()
 				t.a.RefreshStatus = &RefreshStatus{
 					Valid: false,
 					Error: e.Error(),
@@ -109,6 +117,17 @@ func (t *tokenMonitor) Start() {
 	}
 }
 
+// TokenRefreshFailures returns the number of failed token refreshes per authority Id since startup.
+func TokenRefreshFailures() map[string]uint64 {
+	refreshFailuresLock.Lock()
+	defer refreshFailuresLock.Unlock()
+	failures := make(map[string]uint64, len(refreshFailures))
+	for k, v := range refreshFailures {
+		failures[k] = v
+	}
+	return failures
+}
+
 func (t *tokenMonitor) Stop() {
 	close(t.done)
 }
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+var (
+	// lastData is the content of the config file as last read or written by this process.
+	lastData     []byte
+	lastDataLock sync.Mutex
+)
+
+func setLastData(data []byte) {
+	lastDataLock.Lock()
+	lastData = data
+	lastDataLock.Unlock()
+}
+
+// ReloadFromFile reads the config file again and, if it was modified by another process, applies it to the
+// Default config. It returns the TaskChange and AuthChange events that were emitted.
+func ReloadFromFile() ([]interface{}, error) {
+	data, e := os.ReadFile(getPath())
+	if e != nil {
+		return nil, e
+	}
+	lastDataLock.Lock()
+	same := bytes.Equal(data, lastData)
+	lastDataLock.Unlock()
+	if same {
+		return nil, nil
+	}
+	// Do not try to parse the same content twice
+	setLastData(data)
+	newConf, e := ParseConfig(data)
+	if e != nil {
+		return nil, e
+	}
+	return Default().Reload(newConf), nil
+}
+
+// Reload replaces the current config content by newConf, and emits the events corresponding to the
+// created, updated and removed tasks and authorities.
+func (g *Global) Reload(newConf *Global) []interface{} {
+	var events []interface{}
+
+	oldTasks := make(map[string]*Task, len(g.Tasks))
+	for _, t := range g.Tasks {
+		oldTasks[t.Uuid] = t
+	}
+	kept := make(map[string]bool, len(newConf.Tasks))
+	for _, t := range newConf.Tasks {
+		kept[t.Uuid] = true
+		if old, ok := oldTasks[t.Uuid]; !ok {
+			events = append(events, &TaskChange{Type: "create", Task: t})
+		} else if !sameJSON(old, t) {
+			events = append(events, &TaskChange{Type: "update", Task: t, Previous: old})
+		}
+	}
+	for _, t := range g.Tasks {
+		if !kept[t.Uuid] {
+			events = append(events, &TaskChange{Type: "remove", Task: t})
+		}
+	}
+
+	var auths []*Authority
+	keptAuths := make(map[string]bool, len(newConf.Authorities))
+	for _, a := range newConf.Authorities {
+		a.loadTokens()
+		keptAuths[a.Id] = true
+		var old *Authority
+		for _, o := range g.Authorities {
+			if o.Id == a.Id {
+				old = o
+				break
+			}
+		}
+		if old == nil {
+			getTokenMonitor(a, g.changes)
+			auths = append(auths, a)
+			events = append(events, &AuthChange{Type: "create", Authority: a})
+			continue
+		}
+		// Update in place, as the token monitor uses this pointer
+		if old.URI != a.URI || old.Username != a.Username || old.InsecureSkipVerify != a.InsecureSkipVerify ||
+			old.IdToken != a.IdToken || old.AccessToken != a.AccessToken || old.RefreshToken != a.RefreshToken || old.ExpiresAt != a.ExpiresAt {
+			old.URI = a.URI
+			old.Username = a.Username
+			old.InsecureSkipVerify = a.InsecureSkipVerify
+			old.IdToken = a.IdToken
+			old.AccessToken = a.AccessToken
+			old.RefreshToken = a.RefreshToken
+			old.ExpiresAt = a.ExpiresAt
+			events = append(events, &AuthChange{Type: "update", Authority: old})
+		}
+		auths = append(auths, old)
+	}
+	for _, a := range g.Authorities {
+		if !keptAuths[a.Id] {
+			stopMonitoringToken(a.Id)
+			events = append(events, &AuthChange{Type: "remove", Authority: a})
+		}
+	}
+
+	g.Version = newConf.Version
+	g.Tasks = newConf.Tasks
+	g.Authorities = auths
+	if newConf.Logs != nil {
+		g.Logs = newConf.Logs
+	}
+	if newConf.Updates != nil {
+		g.Updates = newConf.Updates
+	}
+	if newConf.Debugging != nil {
+		g.Debugging = newConf.Debugging
+	}
+	g.Notifications = newConf.Notifications
+	g.SSHIdentities = newConf.SSHIdentities
+	for _, c := range newConf.Credentials {
+		c.AfterLoad()
+	}
+	g.Credentials = newConf.Credentials
+
+	if len(events) > 0 {
+		changes := g.changes
+		go func() {
+			for _, c := range changes {
+				for _, ev := range events {
+					c <- ev
+				}
+			}
+		}()
+	}
+	return events
+}
+
+func sameJSON(a, b interface{}) bool {
+	d1, e1 := json.Marshal(a)
+	d2, e2 := json.Marshal(b)
+	return e1 == nil && e2 == nil && bytes.Equal(d1, d2)
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultSSHPort is used when an sftp:// URI does not specify a port.
+const DefaultSSHPort = "22"
+
+// SSHIdentity tells how to authenticate on an SSH server used by sftp:// endpoints. Private keys are never
+// stored in the config: either a key file is referenced, or the running SSH agent is used.
+type SSHIdentity struct {
+	// Id is the user@host:port this identity applies to, see SSHIdentityId.
+	Id string `json:"id"`
+	// KeyFile is the path to an unencrypted private key. If empty, keys are provided by the SSH agent (SSH_AUTH_SOCK).
+	KeyFile string `json:"keyFile,omitempty"`
+	// KnownHosts is the path to a known_hosts file used to verify the server, ~/.ssh/known_hosts is used if empty.
+	KnownHosts string `json:"knownHosts,omitempty"`
+	// InsecureSkipHostKey disables the server host key verification.
+	InsecureSkipHostKey bool `json:"insecureSkipHostKey,omitempty"`
+}
+
+// SSHIdentityId builds the identifier of an identity from a user name and a host, with an optional port.
+func SSHIdentityId(user, host string) string {
+	if _, _, e := net.SplitHostPort(host); e != nil {
+		host = net.JoinHostPort(host, DefaultSSHPort)
+	}
+	return user + "@" + host
+}
+
+// FindSSHIdentity looks up an identity by its Id. It returns nil if none is registered.
+func (g *Global) FindSSHIdentity(id string) *SSHIdentity {
+	for _, i := range g.SSHIdentities {
+		if i.Id == id {
+			return i
+		}
+	}
+	return nil
+}
+
+// SetSSHIdentity creates or replaces an identity and saves the config.
+func (g *Global) SetSSHIdentity(identity *SSHIdentity) error {
+	if !strings.Contains(identity.Id, "@") {
+		return fmt.Errorf("invalid identity %s, expected user@host[:port]", identity.Id)
+	}
+	for idx, i := range g.SSHIdentities {
+		if i.Id == identity.Id {
+			g.SSHIdentities[idx] = identity
+			return Save()
+		}
+	}
+	g.SSHIdentities = append(g.SSHIdentities, identity)
+	return Save()
+}
+
+// RemoveSSHIdentity removes an identity from the config and saves it.
+func (g *Global) RemoveSSHIdentity(id string) error {
+	var identities []*SSHIdentity
+	for _, i := range g.SSHIdentities {
+		if i.Id != id {
+			identities = append(identities, i)
+		}
+	}
+	if len(identities) == len(g.SSHIdentities) {
+		return fmt.Errorf("cannot find identity %s", id)
+	}
+	g.SSHIdentities = identities
+	return Save()
+}
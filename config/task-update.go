@@ -0,0 +1,86 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+// TaskUpdate is a set of flags describing which parts of a Task were modified, so that
+// running syncs are only restarted when necessary.
+type TaskUpdate int
+
+const (
+	// TaskUpdateCosmetic is set when fields that can be applied in place changed (label, hooks, paused state).
+	TaskUpdateCosmetic TaskUpdate = 1 << iota
+	// TaskUpdateSchedule is set when the loop or hard intervals changed: only the scheduler is restarted.
+	TaskUpdateSchedule
+	// TaskUpdateFilters is set when selective roots or ignore rules changed: the sync is restarted with
+	// the new filters and re-evaluated incrementally, without clearing snapshots.
+	TaskUpdateFilters
+	// TaskUpdateRestart is set when other fields changed (direction, realtime, trash...): the sync is
+	// restarted, but snapshots are kept.
+	TaskUpdateRestart
+	// TaskUpdateEndpoints is set when an endpoint URI changed: the sync is restarted and its snapshots cleared.
+	TaskUpdateEndpoints
+)
+
+// Has returns true if any of the flags is set.
+func (u TaskUpdate) Has(flags TaskUpdate) bool {
+	return u&flags != 0
+}
+
+// DiffTasks compares two versions of a Task and returns the kind of changes between them.
+// It returns 0 if both tasks are identical.
+func DiffTasks(previous, task *Task) TaskUpdate {
+	var u TaskUpdate
+	if previous.Label != task.Label || previous.RealtimePaused != task.RealtimePaused || !sameJSON(previous.Hooks, task.Hooks) {
+		u |= TaskUpdateCosmetic
+	}
+	if previous.LoopInterval != task.LoopInterval || previous.HardInterval != task.HardInterval {
+		u |= TaskUpdateSchedule
+	}
+	if !sameStrings(previous.SelectiveRoots, task.SelectiveRoots) || !sameStrings(previous.GetIgnoreRules(), task.GetIgnoreRules()) {
+		u |= TaskUpdateFilters
+	}
+	if previous.LeftURI != task.LeftURI || previous.RightURI != task.RightURI {
+		u |= TaskUpdateEndpoints
+	}
+	// Blank all known fields to detect other changes
+	p, t := *previous, *task
+	for _, c := range []*Task{&p, &t} {
+		c.Label, c.RealtimePaused, c.Hooks = "", false, nil
+		c.LoopInterval, c.HardInterval = "", ""
+		c.SelectiveRoots, c.IgnoreRules = nil, nil
+		c.LeftURI, c.RightURI = "", ""
+	}
+	if !sameJSON(&p, &t) {
+		u |= TaskUpdateRestart
+	}
+	return u
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
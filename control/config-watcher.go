@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/log"
+	servicecontext "github.com/pydio/cells/v4/common/service/context"
+)
+
+// ConfigWatcher is a supervisor service polling the config file, to reload it when it is modified
+// by another process.
+type ConfigWatcher struct {
+	path     string
+	interval time.Duration
+	logCtx   context.Context
+	stop     chan bool
+	modTime  time.Time
+	size     int64
+}
+
+// NewConfigWatcher creates a new ConfigWatcher.
+func NewConfigWatcher() *ConfigWatcher {
+	w := &ConfigWatcher{
+		path:     filepath.Join(config.SyncClientDataDir(), "config.json"),
+		interval: 2 * time.Second,
+		logCtx:   servicecontext.WithServiceName(context.Background(), "config-watcher"),
+		stop:     make(chan bool, 1),
+	}
+	if info, e := os.Stat(w.path); e == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	return w
+}
+
+// Serve implements supervisor service interface.
+func (w *ConfigWatcher) Serve() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Stop implements supervisor service interface.
+func (w *ConfigWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *ConfigWatcher) check() {
+	info, e := os.Stat(w.path)
+	if e != nil || (info.ModTime().Equal(w.modTime) && info.Size() == w.size) {
+		return
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	events, e := config.ReloadFromFile()
+	if e != nil {
+		log.Logger(w.logCtx).Error("Config file was modified but cannot be loaded, ignoring it: " + e.Error())
+		return
+	}
+	if len(events) > 0 {
+		log.Logger(w.logCtx).Info(fmt.Sprintf("Config file was modified, applying %d change(s)", len(events)))
+	}
+}
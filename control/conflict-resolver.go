@@ -0,0 +1,297 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	errors2 "github.com/pydio/cells/v4/common/service/errors"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// ConflictResolver applies a config.Task ConflictPolicy to the conflicts found in a patch.
+// Each conflict is settled by building small unidirectional patches that are then processed
+// like any other patch, and the chosen resolution is attached to the conflict operation status.
+type ConflictResolver struct {
+	policy string
+	left   model.Endpoint
+	right  model.Endpoint
+}
+
+// Actions that can be used to manually resolve a conflict, mapped to the corresponding policy.
+const (
+	ConflictActionKeepLeft  = "keep-left"
+	ConflictActionKeepRight = "keep-right"
+	ConflictActionKeepBoth  = "keep-both"
+)
+
+var conflictActions = map[string]string{
+	ConflictActionKeepLeft:  config.ConflictPolicyPreferLeft,
+	ConflictActionKeepRight: config.ConflictPolicyPreferRight,
+	ConflictActionKeepBoth:  config.ConflictPolicyKeepBoth,
+}
+
+// ConflictResolveRequest is sent on the bus to a Syncer to manually resolve one of its open conflicts.
+// The result is sent back on the Done channel.
+type ConflictResolveRequest struct {
+	ID     string
+	Action string
+	Done   chan error `json:"-"`
+}
+
+// NewConflictResolver creates a ConflictResolver for the given endpoints. It returns nil if the
+// policy is empty or unknown, in which case conflicts are left unresolved.
+func NewConflictResolver(policy string, left, right model.Endpoint) *ConflictResolver {
+	switch policy {
+	case config.ConflictPolicyKeepBoth, config.ConflictPolicyPreferLeft, config.ConflictPolicyPreferRight, config.ConflictPolicyPreferNewest:
+		return &ConflictResolver{policy: policy, left: left, right: right}
+	default:
+		return nil
+	}
+}
+
+// Resolve settles the OpConflict operations of the patch that were not already handled, and returns the
+// patches that must be processed to apply the resolutions.
+func (c *ConflictResolver) Resolve(ctx context.Context, patch merger.Patch) (resolutions []merger.Patch) {
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		if op.GetStatus() != nil {
+			continue
+		}
+		p := op.GetNode().GetPath()
+		pp, msg, e := c.ResolvePath(ctx, p)
+		op.AttachToPatch(patch)
+		if e != nil {
+			log.Logger(ctx).Error("Cannot resolve conflict on " + p + ": " + e.Error())
+			op.Status(model.NewProcessingStatus(fmt.Sprintf("Conflict policy %s failed: %s", c.policy, e.Error())).SetError(e))
+			continue
+		}
+		log.Logger(ctx).Info("Conflict on " + p + " resolved with policy " + c.policy + ": " + msg)
+		op.Status(model.NewProcessingStatus(fmt.Sprintf("Resolved with policy %s: %s", c.policy, msg)).SetProgress(1))
+		resolutions = append(resolutions, pp...)
+	}
+	return
+}
+
+// Pending returns true if the patch has conflicts that were not handled by Resolve yet.
+func (c *ConflictResolver) Pending(patch merger.Patch) bool {
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		if op.GetStatus() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Settled returns true if the patch has conflicts and all of them were successfully resolved.
+func (c *ConflictResolver) Settled(patch merger.Patch) bool {
+	conflicts := patch.OperationsByType([]merger.OperationType{merger.OpConflict})
+	for _, op := range conflicts {
+		if st := op.GetStatus(); st == nil || st.IsError() {
+			return false
+		}
+	}
+	return len(conflicts) > 0
+}
+
+// PatchErrors returns the errors of a patch like HasErrors, except for the conflicts that were resolved: the
+// patch reports all conflict operations as errors, even once a policy resolved them.
+func PatchErrors(patch merger.Patch) ([]error, bool) {
+	errs, ok := patch.HasErrors()
+	if !ok {
+		return nil, false
+	}
+	resolved := map[string]int{}
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		if st := op.GetStatus(); st != nil && !st.IsError() && op.Error() == nil {
+			resolved[fmt.Sprintf("conflict on path %s", op.GetRefPath())]++
+		}
+	}
+	var real []error
+	for _, e := range errs {
+		if resolved[e.Error()] > 0 {
+			resolved[e.Error()]--
+			continue
+		}
+		real = append(real, e)
+	}
+	return real, len(real) > 0
+}
+
+// ResolvePath applies the policy to a conflicting path. It returns the patches to be processed and a
+// human-readable description of the resolution.
+func (c *ConflictResolver) ResolvePath(ctx context.Context, p string) ([]merger.Patch, string, error) {
+	leftSource, ok1 := model.AsPathSyncSource(c.left)
+	rightSource, ok2 := model.AsPathSyncSource(c.right)
+	leftTarget, ok3 := model.AsPathSyncTarget(c.left)
+	rightTarget, ok4 := model.AsPathSyncTarget(c.right)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, "", fmt.Errorf("endpoints must be both sources and targets")
+	}
+	leftNode, _ := leftSource.LoadNode(ctx, p)
+	rightNode, _ := rightSource.LoadNode(ctx, p)
+
+	leftWins := true
+	switch c.policy {
+	case config.ConflictPolicyPreferRight:
+		leftWins = false
+	case config.ConflictPolicyPreferNewest:
+		if leftNode == nil || rightNode == nil {
+			leftWins = leftNode != nil
+		} else {
+			leftWins = leftNode.GetMTime() >= rightNode.GetMTime()
+		}
+	case config.ConflictPolicyKeepBoth:
+		if leftNode == nil || rightNode == nil {
+			// Nothing to keep on one side, just restore the existing one
+			leftWins = leftNode != nil
+			break
+		}
+		// Right version is renamed by a patch, so that it goes through the patch store and hooks, then both versions
+		// are copied to the other side. Patches are processed in order.
+		copyPath := conflictCopyPath(p)
+		moveType := merger.OpMoveFile
+		if !rightNode.IsLeaf() {
+			moveType = merger.OpMoveFolder
+		}
+		rename := merger.NewPatch(leftSource, rightTarget, merger.PatchOptions{})
+		origin := tree.LightNode(rightNode.GetType(), rightNode.GetUuid(), p, rightNode.GetEtag(), rightNode.GetSize(), rightNode.GetMTime(), rightNode.GetMode())
+		rename.Enqueue(merger.NewOperation(moveType, model.EventInfo{Path: copyPath}, origin))
+		toRight, e := c.copyPatch(ctx, leftSource, rightTarget, p, p, leftNode, nil)
+		if e != nil {
+			return nil, "", e
+		}
+		toLeft, e := c.copyPatch(ctx, rightSource, leftTarget, p, copyPath, rightNode, nil)
+		if e != nil {
+			return nil, "", e
+		}
+		return []merger.Patch{rename, toRight, toLeft}, "kept left version, right version renamed to " + copyPath, nil
+	}
+
+	var pa merger.Patch
+	var e error
+	var msg string
+	if leftWins {
+		pa, e = c.copyPatch(ctx, leftSource, rightTarget, p, p, leftNode, rightNode)
+		msg = "kept left version"
+	} else {
+		pa, e = c.copyPatch(ctx, rightSource, leftTarget, p, p, rightNode, leftNode)
+		msg = "kept right version"
+	}
+	if e != nil {
+		return nil, "", e
+	}
+	return []merger.Patch{pa}, msg, nil
+}
+
+// copyPatch builds a patch that makes targetPath on the target identical to sourcePath on the source. The existing
+// target node is deleted if the source node is missing or of a different type. Otherwise the source node is
+// recursively created, and the target children missing from the source are deleted.
+func (c *ConflictResolver) copyPatch(ctx context.Context, source model.PathSyncSource, target model.PathSyncTarget, sourcePath, targetPath string, sourceNode, targetNode tree.N) (merger.Patch, error) {
+	patch := merger.NewPatch(source, target, merger.PatchOptions{})
+	if targetNode != nil && (sourceNode == nil || sourceNode.IsLeaf() != targetNode.IsLeaf()) {
+		patch.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: targetPath}, targetNode))
+		targetNode = nil
+	}
+	if sourceNode == nil {
+		return patch, nil
+	}
+	copied := map[string]bool{}
+	enqueueCreate := func(np string, n tree.N) {
+		np = targetPath + strings.TrimPrefix(np, sourcePath)
+		copied[np] = true
+		opType := merger.OpCreateFolder
+		if n.IsLeaf() {
+			opType = merger.OpCreateFile
+		}
+		n = tree.LightNode(n.GetType(), n.GetUuid(), np, n.GetEtag(), n.GetSize(), n.GetMTime(), n.GetMode())
+		patch.Enqueue(merger.NewOperation(opType, model.NodeToEventInfo(ctx, np, n, model.EventCreate), n))
+	}
+	enqueueCreate(sourcePath, sourceNode)
+	if sourceNode.IsLeaf() {
+		return patch, nil
+	}
+	e := source.Walk(ctx, func(np string, n tree.N, err error) error {
+		if err == nil {
+			enqueueCreate(np, n)
+		}
+		return err
+	}, sourcePath, true)
+	if e != nil {
+		return nil, e
+	}
+	targetSource, ok := model.AsPathSyncSource(target)
+	if targetNode == nil || !ok {
+		return patch, nil
+	}
+	var deleted []string
+	e = targetSource.Walk(ctx, func(np string, n tree.N, err error) error {
+		if err != nil || copied[np] {
+			return err
+		}
+		for _, d := range deleted {
+			if strings.HasPrefix(np, d+"/") {
+				// Removed with its parent
+				return nil
+			}
+		}
+		deleted = append(deleted, np)
+		patch.Enqueue(merger.NewOperation(merger.OpDelete, model.EventInfo{Path: np}, n))
+		return nil
+	}, targetPath, true)
+	if e != nil {
+		return nil, e
+	}
+	return patch, nil
+}
+
+// conflictCleared checks if a conflicting path is now identical on both endpoints, or was removed from both.
+func conflictCleared(ctx context.Context, left, right model.PathSyncSource, p string) bool {
+	leftNode, le := left.LoadNode(ctx, p)
+	rightNode, re := right.LoadNode(ctx, p)
+	if le != nil || re != nil {
+		return isNotFound(le) && isNotFound(re)
+	}
+	if leftNode.IsLeaf() != rightNode.IsLeaf() {
+		return false
+	}
+	return !leftNode.IsLeaf() || (leftNode.GetEtag() != "" && leftNode.GetEtag() == rightNode.GetEtag())
+}
+
+func isNotFound(e error) bool {
+	return e != nil && (errors.Is(e, fs.ErrNotExist) || errors2.FromError(e).Code == http.StatusNotFound)
+}
+
+// conflictCopyPath computes a unique path for keeping a copy of a conflicting node.
+func conflictCopyPath(p string) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	return fmt.Sprintf("%s-conflict-%s%s", base, time.Now().Format("20060102-150405"), ext)
+}
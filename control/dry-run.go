@@ -0,0 +1,238 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gobwas/glob"
+
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// Groups of operations in a DryRunReport.
+const (
+	DryRunCreateFolder = "CreateFolder"
+	DryRunCreateFile   = "CreateFile"
+	DryRunUpdateFile   = "UpdateFile"
+	DryRunMoveFolder   = "MoveFolder"
+	DryRunMoveFile     = "MoveFile"
+	DryRunDelete       = "Delete"
+	DryRunConflict     = "Conflict"
+)
+
+var dryRunTypes = map[merger.OperationType]string{
+	merger.OpCreateFolder: DryRunCreateFolder,
+	merger.OpCreateFile:   DryRunCreateFile,
+	merger.OpUpdateFile:   DryRunUpdateFile,
+	merger.OpMoveFolder:   DryRunMoveFolder,
+	merger.OpMoveFile:     DryRunMoveFile,
+	merger.OpDelete:       DryRunDelete,
+	merger.OpConflict:     DryRunConflict,
+}
+
+// DryRunOperation is an operation that would be applied by the next sync.
+type DryRunOperation struct {
+	Path string
+	// MoveFrom is the original path of a move
+	MoveFrom string `json:",omitempty"`
+	// Target is the side that would be modified: left, right, or both for conflicts
+	Target string
+	Size   int64 `json:",omitempty"`
+	IsDir  bool  `json:",omitempty"`
+	// ConflictType is set for conflicts only
+	ConflictType merger.ConflictType `json:",omitempty"`
+}
+
+// DryRunReport describes the patch computed by a dry-run, grouped by operation type.
+type DryRunReport struct {
+	TaskUuid   string
+	Direction  string
+	Time       time.Time
+	FullScan   bool
+	Operations map[string][]*DryRunOperation
+	Counts     map[string]int
+	TotalBytes int64
+}
+
+// DryRunRequest is sent to a Syncer to compute the next patch without applying it.
+// Report is set before a nil error is sent on Done.
+type DryRunRequest struct {
+	// Force compares both endpoints contents as a full resync would, instead of using snapshots.
+	Force  bool
+	Report *DryRunReport
+	Done   chan error
+}
+
+// NewDryRunReport transforms a patch into a DryRunReport. Left and right endpoints are used to find
+// the target side of each operation.
+func NewDryRunReport(taskUuid, direction string, patch merger.Patch, left, right model.Endpoint) *DryRunReport {
+	report := &DryRunReport{
+		TaskUuid:   taskUuid,
+		Direction:  direction,
+		Time:       time.Now(),
+		Operations: make(map[string][]*DryRunOperation),
+		Counts:     make(map[string]int),
+	}
+	if patch == nil {
+		return report
+	}
+	patch.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+		group, ok := dryRunTypes[operation.Type()]
+		if !ok {
+			return
+		}
+		op := &DryRunOperation{
+			Path:   operation.GetRefPath(),
+			Target: "both",
+		}
+		if operation.IsTypeMove() {
+			op.MoveFrom = operation.GetMoveOriginPath()
+		}
+		if n := operation.GetNode(); n != nil {
+			if op.Path == "" {
+				op.Path = n.GetPath()
+			}
+			op.IsDir = !n.IsLeaf()
+			if group == DryRunCreateFile || group == DryRunUpdateFile {
+				op.Size = n.GetSize()
+				report.TotalBytes += op.Size
+			}
+		}
+		if co, ok := operation.(merger.ConflictOperation); ok {
+			op.ConflictType, _, _ = co.ConflictInfo()
+		} else if t := operation.Target(); t != nil {
+			switch model.Endpoint(t) {
+			case left:
+				op.Target = "left"
+			case right:
+				op.Target = "right"
+			}
+		}
+		report.Operations[group] = append(report.Operations[group], op)
+		report.Counts[group]++
+	})
+	return report
+}
+
+// ComputeDryRun computes the patch that the next sync would apply between left and right, without processing it.
+// If snapshots are provided and not empty, bidirectional changes are computed from them like a normal sync loop,
+// otherwise both endpoints are fully compared as a full resync would do.
+func ComputeDryRun(ctx context.Context, left, right model.Endpoint, direction model.DirectionType, roots []string, ignores []glob.Glob, snapshots model.SnapshotFactory) (merger.Patch, bool, error) {
+	source, ok1 := model.AsPathSyncSource(left)
+	target, ok2 := model.AsPathSyncSource(right)
+	if !ok1 || !ok2 {
+		return nil, false, fmt.Errorf("endpoints must be browsable")
+	}
+	if len(roots) == 0 {
+		roots = []string{"/"}
+	}
+
+	if direction != model.DirectionBi {
+		var patch merger.Patch
+		if direction == model.DirectionRight {
+			rightTarget, ok := model.AsPathSyncTarget(right)
+			if !ok {
+				return nil, false, fmt.Errorf("right endpoint must be writable")
+			}
+			patch = merger.NewPatch(source, rightTarget, merger.PatchOptions{MoveDetection: true})
+		} else {
+			leftTarget, ok := model.AsPathSyncTarget(left)
+			if !ok {
+				return nil, false, fmt.Errorf("left endpoint must be writable")
+			}
+			patch = merger.NewPatch(target, leftTarget, merger.PatchOptions{MoveDetection: true})
+		}
+		for _, r := range roots {
+			diff := merger.NewDiff(source, target)
+			if e := diff.Compute(ctx, r, nil, nil, ignores...); e != nil {
+				return nil, true, e
+			}
+			if e := diff.ToUnidirectionalPatch(ctx, direction, patch); e != nil {
+				return nil, true, e
+			}
+		}
+		patch.Filter(ctx, ignores...)
+		return patch, true, nil
+	}
+
+	leftTarget, ok1 := model.AsPathSyncTarget(left)
+	rightTarget, ok2 := model.AsPathSyncTarget(right)
+	if !ok1 || !ok2 {
+		return nil, false, fmt.Errorf("endpoints must be writable for a bidirectional sync")
+	}
+	bb := merger.NewBidirectionalPatch(ctx, left, right)
+	if snapshots != nil {
+		leftSnap, er1 := snapshots.Load(source)
+		rightSnap, er2 := snapshots.Load(target)
+		if er1 == nil && er2 == nil && !leftSnap.IsEmpty() && !rightSnap.IsEmpty() {
+			for _, r := range roots {
+				leftPatch, e := snapshotPatch(ctx, source, leftSnap, r, ignores)
+				if e != nil {
+					return nil, false, e
+				}
+				rightPatch, e := snapshotPatch(ctx, target, rightSnap, r, ignores)
+				if e != nil {
+					return nil, false, e
+				}
+				b, e := merger.ComputeBidirectionalPatch(ctx, leftPatch, rightPatch)
+				if b != nil {
+					bb.AppendBranch(ctx, b)
+				}
+				if e != nil {
+					return nil, false, e
+				}
+			}
+			return bb, false, nil
+		}
+	}
+
+	for _, r := range roots {
+		diff := merger.NewDiff(source, target)
+		if e := diff.Compute(ctx, r, nil, nil, ignores...); e != nil {
+			return nil, true, e
+		}
+		// An error is returned when conflicts are found, they are part of the report
+		if e := diff.ToBidirectionalPatch(ctx, leftTarget, rightTarget, bb); e != nil && len(bb.OperationsByType([]merger.OperationType{merger.OpConflict})) == 0 {
+			return nil, true, e
+		}
+	}
+	return bb, true, nil
+}
+
+// snapshotPatch computes the changes of an endpoint since its last snapshot.
+func snapshotPatch(ctx context.Context, source model.PathSyncSource, snap model.Snapshoter, root string, ignores []glob.Glob) (merger.Patch, error) {
+	diff := merger.NewDiff(source, snap)
+	if e := diff.Compute(ctx, root, nil, nil, ignores...); e != nil {
+		return nil, e
+	}
+	snapTarget, ok := model.AsPathSyncTarget(snap)
+	if !ok {
+		return nil, fmt.Errorf("snapshot cannot be used as a target")
+	}
+	patch := merger.NewPatch(source, snapTarget, merger.PatchOptions{MoveDetection: true})
+	if e := diff.ToUnidirectionalPatch(ctx, model.DirectionRight, patch); e != nil {
+		return nil, e
+	}
+	return patch, nil
+}
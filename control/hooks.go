@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/sync/merger"
+)
+
+// Events passed to the hooks commands.
+const (
+	HookBeforePatch       = "before-patch"
+	HookAfterPatchSuccess = "after-patch-success"
+	HookAfterPatchError   = "after-patch-error"
+)
+
+// HookInput is sent as JSON on the standard input of hooks commands.
+type HookInput struct {
+	Event     string
+	TaskUuid  string
+	TaskLabel string
+	PatchUUID string
+	Source    string
+	Target    string
+	Stats     map[string]interface{}
+	Paths     []string
+	Error     string `json:",omitempty"`
+}
+
+// NewHookInput describes a patch for the hooks. Paths lists all paths touched by the patch operations,
+// including the origin of moves.
+func NewHookInput(event string, task *config.Task, patch merger.Patch) *HookInput {
+	in := &HookInput{
+		Event:     event,
+		TaskUuid:  task.Uuid,
+		TaskLabel: task.Label,
+		PatchUUID: patch.GetUUID(),
+		Stats:     patch.Stats(),
+		Paths:     []string{},
+	}
+	if patch.Source() != nil {
+		in.Source = patch.Source().GetEndpointInfo().URI
+	}
+	if patch.Target() != nil {
+		in.Target = patch.Target().GetEndpointInfo().URI
+	}
+	patch.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+		if operation.IsTypeMove() {
+			in.Paths = append(in.Paths, operation.GetMoveOriginPath())
+		}
+		in.Paths = append(in.Paths, operation.GetRefPath())
+	})
+	if errs, ok := PatchErrors(patch); ok {
+		in.Error = errs[0].Error()
+	}
+	return in
+}
+
+// AfterPatchEvent returns the hook event for a processed patch: HookAfterPatchError if it has errors,
+// HookAfterPatchSuccess otherwise, or an empty string if the patch is empty.
+func AfterPatchEvent(patch merger.Patch, hasErrors bool) string {
+	if hasErrors {
+		return HookAfterPatchError
+	} else if patch.Size() == 0 {
+		return ""
+	}
+	return HookAfterPatchSuccess
+}
+
+// HookWaitDelay is the time left to a hook command to close its output once it is killed or has exited, as
+// child processes may keep it open.
+var HookWaitDelay = 5 * time.Second
+
+// RunHook executes the hook command, passing input as JSON on stdin. The command is killed if it
+// exceeds its timeout, and its combined output is sent line by line to the task log.
+func RunHook(ctx context.Context, hook *config.Hook, input *HookInput) error {
+	if hook == nil || hook.Command == "" {
+		return nil
+	}
+	data, e := json.Marshal(input)
+	if e != nil {
+		return e
+	}
+	tCtx, cancel := context.WithTimeout(ctx, hook.GetTimeout())
+	defer cancel()
+	cmd := exec.CommandContext(tCtx, hook.Command, hook.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = HookWaitDelay
+
+	log.Logger(ctx).Info(fmt.Sprintf("Running %s hook: %s", input.Event, hook.Command))
+	err := cmd.Run()
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		log.Logger(ctx).Info(fmt.Sprintf("[%s] %s", input.Event, scanner.Text()))
+	}
+	if tCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s hook timed out after %s", input.Event, hook.GetTimeout())
+	}
+	if err != nil {
+		log.Logger(ctx).Error(fmt.Sprintf("%s hook failed: %s", input.Event, err.Error()))
+	}
+	return err
+}
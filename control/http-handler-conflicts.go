@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+// ConflictsResponse lists the open conflicts of a sync task.
+type ConflictsResponse struct {
+	Conflicts []*endpoint.Conflict
+}
+
+// reqRespConflicts retrieves a pointer to the ConflictStore of a sync.
+func (h *HttpServer) reqRespConflicts(syncUUID string) (*endpoint.ConflictStore, error) {
+	response, e := h.reqRespSyncer(syncUUID, MessagePublishConflicts, TopicConflicts_)
+	if e != nil {
+		return nil, e
+	}
+	if store, ok := response.(*endpoint.ConflictStore); ok {
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown format received")
+}
+
+// listConflicts loads open conflicts from store
+func (h *HttpServer) listConflicts(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	store, e := h.reqRespConflicts(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	conflicts, e := store.List()
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, &ConflictsResponse{Conflicts: conflicts})
+}
+
+// resolveConflict sends a resolution request to the sync and waits for the result.
+func (h *HttpServer) resolveConflict(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	resolve := &ConflictResolveRequest{}
+	if e := json.NewDecoder(c.Request.Body).Decode(resolve); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	resolve.ID = c.Param("id")
+	resolve.Done = make(chan error, 1)
+	GetBus().Pub(resolve, TopicSync_+request.SyncUUID)
+	select {
+	case e := <-resolve.Done:
+		if e != nil {
+			h.writeError(c, e)
+			return
+		}
+	case <-time.After(30 * time.Second):
+		h.writeError(c, fmt.Errorf("timeout while resolving conflict"))
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"Success": true})
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+// CredentialsRequest registers the login and secret used for an endpoint URI.
+type CredentialsRequest struct {
+	URI    string
+	Login  string
+	Secret string
+}
+
+// CredentialsResponse lists the registered credentials, without their secrets.
+type CredentialsResponse struct {
+	Credentials []*config.Credentials
+}
+
+// SameOriginOnly rejects requests sent by pages of another origin. It protects the routes that must not be exposed
+// by the permissive CORS policy of the API, while requests without Origin (e.g. from the command line) are accepted.
+func SameOriginOnly(origin string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if o := c.GetHeader("Origin"); o != "" && o != origin {
+			c.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "cross-origin requests are not allowed"})
+		}
+	}
+}
+
+func publicCredentials() *CredentialsResponse {
+	response := &CredentialsResponse{Credentials: []*config.Credentials{}}
+	for _, c := range config.Default().Credentials {
+		response.Credentials = append(response.Credentials, &config.Credentials{Id: c.Id, Login: c.Login})
+	}
+	return response
+}
+
+// listCredentials returns the registered credentials.
+func (h *HttpServer) listCredentials(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, publicCredentials())
+}
+
+// putCredentials creates or replaces the credentials of an endpoint URI.
+func (h *HttpServer) putCredentials(c *gin.Context) {
+	var request CredentialsRequest
+	if e := json.NewDecoder(c.Request.Body).Decode(&request); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	creds, e := config.NewCredentials(request.URI, request.Login, request.Secret)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	if e := config.Default().SetCredentials(creds); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.JSON(http.StatusOK, publicCredentials())
+}
+
+// deleteCredentials removes credentials by their id.
+func (h *HttpServer) deleteCredentials(c *gin.Context) {
+	if e := config.Default().RemoveCredentials(c.Query("id")); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.JSON(http.StatusOK, publicCredentials())
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dryRun asks the sync to compute its next patch and returns the report. Pass force=true to compare
+// both endpoints contents as a full resync would do.
+func (h *HttpServer) dryRun(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	dry := &DryRunRequest{
+		Force: c.Query("force") == "true",
+		Done:  make(chan error, 1),
+	}
+	GetBus().Pub(dry, TopicSync_+request.SyncUUID)
+	select {
+	case e := <-dry.Done:
+		if e != nil {
+			h.writeError(c, e)
+			return
+		}
+	case <-c.Request.Context().Done():
+		return
+	case <-time.After(10 * time.Minute):
+		h.writeError(c, fmt.Errorf("timeout while computing dry-run"))
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, dry.Report)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HistoryResponse lists the history entries of a sync task, most recent first.
+type HistoryResponse struct {
+	Entries []*HistoryEntry
+}
+
+// parseHistoryTime accepts RFC3339 dates or unix timestamps.
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ts, e := strconv.ParseInt(value, 10, 64); e == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// listHistory loads the history of a task, filtered with the from, to, type and limit query parameters.
+func (h *HttpServer) listHistory(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	query := HistoryQuery{
+		Type:  c.Query("type"),
+		Limit: 200,
+	}
+	if query.From, e = parseHistoryTime(c.Query("from")); e != nil {
+		h.writeError(c, fmt.Errorf("invalid from parameter: %s", e.Error()))
+		return
+	}
+	if query.To, e = parseHistoryTime(c.Query("to")); e != nil {
+		h.writeError(c, fmt.Errorf("invalid to parameter: %s", e.Error()))
+		return
+	}
+	if l, er := strconv.Atoi(c.Query("limit")); er == nil && l > 0 {
+		query.Limit = l
+	}
+	response, e := h.reqRespSyncer(request.SyncUUID, MessagePublishHistory, TopicHistory_)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	history, ok := response.(*HistoryStateStore)
+	if !ok {
+		h.writeError(c, fmt.Errorf("unknown format received"))
+		return
+	}
+	entries, e := history.Load(query)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, &HistoryResponse{Entries: entries})
+}
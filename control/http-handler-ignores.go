@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// IgnoresPreviewRequest asks which paths of an endpoint would be excluded by a set of rules.
+type IgnoresPreviewRequest struct {
+	EndpointURI string
+	Path        string
+	Rules       []string
+	Limit       int
+}
+
+// IgnoresPreviewResponse lists the excluded paths. Children of an excluded folder are not listed.
+type IgnoresPreviewResponse struct {
+	Excluded  []string
+	Walked    int
+	Truncated bool
+}
+
+// previewIgnores walks an endpoint in browse-only mode and applies the rules to each path.
+func (h *HttpServer) previewIgnores(c *gin.Context) {
+	var request IgnoresPreviewRequest
+	dec := json.NewDecoder(c.Request.Body)
+	if e := dec.Decode(&request); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	if request.Limit <= 0 {
+		request.Limit = 1000
+	}
+	matcher, e := endpoint.NewIgnoreMatcher(request.Rules, endpoint.LocalRootsFromURIs(request.EndpointURI)...)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	ep, e := endpoint.EndpointFromURI(request.EndpointURI, "", true)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	defer endpoint.CloseEndpoint(ep)
+	source, ok := model.AsPathSyncSource(ep)
+	if !ok {
+		h.writeError(c, fmt.Errorf("endpoint cannot be walked"))
+		return
+	}
+
+	response := &IgnoresPreviewResponse{}
+	var excludedFolders []string
+	er := source.Walk(h.ctx, func(p string, node tree.N, err error) error {
+		if err != nil {
+			return nil
+		}
+		p = "/" + strings.TrimLeft(p, "/")
+		for _, f := range excludedFolders {
+			if strings.HasPrefix(p, f+"/") {
+				return nil
+			}
+		}
+		response.Walked++
+		if matcher.MatchNode(p, node) {
+			if len(response.Excluded) >= request.Limit {
+				response.Truncated = true
+				return nil
+			}
+			response.Excluded = append(response.Excluded, p)
+			if !node.IsLeaf() {
+				excludedFolders = append(excludedFolders, p)
+			}
+		}
+		return nil
+	}, request.Path, true)
+	if er != nil {
+		h.writeError(c, er)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
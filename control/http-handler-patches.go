@@ -23,7 +23,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/pydio/cells-sync/config"
@@ -74,37 +74,32 @@ func (h *HttpServer) parsePatchRequest(c *gin.Context) (*PatchesRequest, error)
 }
 
 // reqRespStore uses a Pub/Sub model to synchronously retrieve a pointer to the PatchStore of a sync.
-func (h *HttpServer) reqRespStore(syncUUID string) (store *endpoint.PatchStore, err error) {
-
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	ch := GetBus().Sub(TopicStore_ + syncUUID)
-	go func() {
-		defer func() {
-			wg.Done()
-			GetBus().Unsub(ch)
-		}()
-		for {
-			select {
-			case s := <-ch:
-				if data, ok := s.(*endpoint.PatchStore); ok {
-					store = data
-				} else if er, ok := s.(error); ok {
-					err = er
-				} else {
-					err = fmt.Errorf("unknown format received")
-				}
-				return
-			case <-time.After(250 * time.Millisecond):
-				err = fmt.Errorf("could not load store")
-				return
-			}
-		}
-	}()
-	GetBus().Pub(MessagePublishStore, TopicSync_+syncUUID)
-	wg.Wait()
+func (h *HttpServer) reqRespStore(syncUUID string) (*endpoint.PatchStore, error) {
+	response, e := h.reqRespSyncer(syncUUID, MessagePublishStore, TopicStore_)
+	if e != nil {
+		return nil, e
+	}
+	if store, ok := response.(*endpoint.PatchStore); ok {
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown format received")
+}
 
-	return
+// reqRespSyncer publishes a message to a sync and waits for its response on the given topic. Errors
+// received from the sync are returned as errors.
+func (h *HttpServer) reqRespSyncer(syncUUID string, message interface{}, topic string) (response interface{}, err error) {
+	ch := GetBus().Sub(topic + syncUUID)
+	defer GetBus().Unsub(ch)
+	GetBus().Pub(message, TopicSync_+syncUUID)
+	select {
+	case response = <-ch:
+		if er, ok := response.(error); ok {
+			return nil, er
+		}
+		return response, nil
+	case <-time.After(250 * time.Millisecond):
+		return nil, fmt.Errorf("no response received from sync")
+	}
 }
 
 // listPatches loads patches from store
@@ -134,3 +129,93 @@ func (h *HttpServer) listPatches(c *gin.Context) {
 	c.JSON(http.StatusOK, data)
 
 }
+
+// PatchSearchResponse lists the operations matching a search, most recent first.
+type PatchSearchResponse struct {
+	Results []*endpoint.PatchSearchResult
+}
+
+// searchPatches finds operations in the stored patches, filtered with the path, type, errors, from, to and
+// limit query parameters. Type can be repeated or comma-separated.
+func (h *HttpServer) searchPatches(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	query := endpoint.PatchSearchQuery{
+		Path:       c.Query("path"),
+		ErrorsOnly: c.Query("errors") == "true",
+	}
+	for _, param := range c.QueryArray("type") {
+		for _, name := range strings.Split(param, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			opType, er := endpoint.ParseOperationType(name)
+			if er != nil {
+				h.writeError(c, er)
+				return
+			}
+			query.Types = append(query.Types, opType)
+		}
+	}
+	if query.From, e = parseHistoryTime(c.Query("from")); e != nil {
+		h.writeError(c, fmt.Errorf("invalid from parameter: %s", e.Error()))
+		return
+	}
+	if query.To, e = parseHistoryTime(c.Query("to")); e != nil {
+		h.writeError(c, fmt.Errorf("invalid to parameter: %s", e.Error()))
+		return
+	}
+	if l, er := strconv.Atoi(c.Query("limit")); er == nil && l > 0 {
+		query.Limit = l
+	}
+	store, e := h.reqRespStore(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	results, e := store.Search(query)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, &PatchSearchResponse{Results: results})
+}
+
+// FileHistoryResponse lists the operations that touched a path, in chronological order.
+type FileHistoryResponse struct {
+	Path       string
+	Operations []*endpoint.PatchSearchResult
+}
+
+// fileHistory loads the operations touching the path query parameter, including moves and parent folders changes.
+func (h *HttpServer) fileHistory(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	path := c.Query("path")
+	if path == "" {
+		h.writeError(c, fmt.Errorf("please provide a path"))
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	store, e := h.reqRespStore(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	operations, e := store.History(path, limit)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, &FileHistoryResponse{Path: path, Operations: operations})
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/pydio/cells-sync/endpoint"
+)
+
+// TrashResponse lists the items kept in the trash of a sync task.
+type TrashResponse struct {
+	Items []*endpoint.TrashItem
+}
+
+// reqRespTrash retrieves a pointer to the Trash of a sync.
+func (h *HttpServer) reqRespTrash(syncUUID string) (*endpoint.Trash, error) {
+	response, e := h.reqRespSyncer(syncUUID, MessagePublishTrash, TopicTrash_)
+	if e != nil {
+		return nil, e
+	}
+	if trash, ok := response.(*endpoint.Trash); ok {
+		return trash, nil
+	}
+	return nil, fmt.Errorf("unknown format received")
+}
+
+// listTrash loads the trash items of a task.
+func (h *HttpServer) listTrash(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	trash, e := h.reqRespTrash(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	items, e := trash.List()
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Header("Pragma", "no-cache")
+	c.JSON(http.StatusOK, &TrashResponse{Items: items})
+}
+
+// restoreTrash moves an item back to the endpoint and triggers a sync loop to propagate it.
+func (h *HttpServer) restoreTrash(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	trash, e := h.reqRespTrash(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	restored, e := trash.Restore(c.Param("id"))
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	GetBus().Pub(MessageSyncLoop, TopicSync_+request.SyncUUID)
+	c.JSON(http.StatusOK, map[string]interface{}{"Success": true, "Path": restored})
+}
+
+// emptyTrash removes all items from the trash of a task.
+func (h *HttpServer) emptyTrash(c *gin.Context) {
+	request, e := h.parsePatchRequest(c)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	trash, e := h.reqRespTrash(request.SyncUUID)
+	if e != nil {
+		h.writeError(c, e)
+		return
+	}
+	if e := trash.Empty(); e != nil {
+		h.writeError(c, e)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"Success": true})
+}
@@ -156,6 +156,7 @@ func (h *HttpServer) ls(c *gin.Context) {
 		h.writeError(c, e)
 		return
 	}
+	defer endpoint.CloseEndpoint(request.endpoint)
 
 	log.Logger(h.ctx).Info("Browsing " + request.endpoint.GetEndpointInfo().URI + " on path " + request.Path)
 
@@ -207,6 +208,7 @@ func (h *HttpServer) mkdir(c *gin.Context) {
 		h.writeError(c, e)
 		return
 	}
+	defer endpoint.CloseEndpoint(request.endpoint)
 	target, ok := model.AsPathSyncTarget(request.endpoint)
 	if !ok {
 		h.writeError(c, fmt.Errorf("cannot.write"))
@@ -238,6 +240,7 @@ func (h *HttpServer) defaultDir(c *gin.Context) {
 		h.writeError(c, e)
 		return
 	}
+	defer endpoint.CloseEndpoint(request.endpoint)
 	outputDir := endpoint.DefaultDirForURI(request.EndpointURI)
 	epDir := outputDir
 	if outputDir == "" {
@@ -36,6 +36,7 @@ import (
 	"github.com/pydio/cells-sync/app/ux"
 	"github.com/pydio/cells-sync/common"
 	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
 	"github.com/pydio/cells/v4/common/log"
 	servicecontext "github.com/pydio/cells/v4/common/service/context"
 	"github.com/pydio/cells/v4/common/sync/model"
@@ -52,6 +53,7 @@ type HttpServer struct {
 	ctx           context.Context
 
 	logWriter *io.PipeWriter
+	metrics   *Metrics
 }
 
 // NewHttpServer creates a supervisor service for spinning the http server.
@@ -170,14 +172,33 @@ func (h *HttpServer) InitHandlers() {
 			if confContent, ok := data.Content.(*common.ConfigContent); ok {
 				confs := config.Default()
 				if confContent.Task != nil {
+					if confContent.Cmd == "create" || confContent.Cmd == "edit" {
+						if _, e := endpoint.NewIgnoreMatcher(confContent.Task.IgnoreRules); e != nil {
+							m := &common.Message{Type: "ERROR", Content: e.Error()}
+							session.Write(m.Bytes())
+							return
+						}
+					}
+					var e error
 					if confContent.Cmd == "create" {
-						confContent.Task.Uuid = uuid.New()
-						confs.CreateTask(confContent.Task)
+						// Imported tasks keep their UUID, so that importing them again updates them
+						if uuid.Parse(confContent.Task.Uuid) == nil || confs.HasTask(confContent.Task.Uuid) {
+							confContent.Task.Uuid = uuid.New()
+						}
+						keepConfiguredHooks(confs, confContent.Task)
+						e = confs.CreateTask(confContent.Task)
 					} else if confContent.Cmd == "edit" {
-						confs.UpdateTask(confContent.Task)
+						keepConfiguredHooks(confs, confContent.Task)
+						e = confs.UpdateTask(confContent.Task)
 					} else if confContent.Cmd == "delete" {
-						confs.RemoveTask(confContent.Task)
+						e = confs.RemoveTask(confContent.Task)
+					}
+					// Acknowledge the change to the sender, with the task as saved
+					m := &common.Message{Type: "CONFIG", Content: &common.ConfigContent{Cmd: confContent.Cmd, Task: confContent.Task}}
+					if e != nil {
+						m = &common.Message{Type: "ERROR", Content: e.Error()}
 					}
+					session.Write(m.Bytes())
 				} else if confContent.Authority != nil {
 					if confContent.Cmd == "create" {
 						confs.CreateAuthority(confContent.Authority)
@@ -225,6 +246,17 @@ func (h *HttpServer) InitHandlers() {
 
 }
 
+// keepConfiguredHooks replaces the hooks of a task received from a client by the ones found in the config file.
+// Hooks run local commands, so they can only be defined by editing the config file.
+func keepConfiguredHooks(confs *config.Global, task *config.Task) {
+	task.Hooks = nil
+	for _, t := range confs.Tasks {
+		if t.Uuid == task.Uuid {
+			task.Hooks = t.Hooks
+		}
+	}
+}
+
 func (h *HttpServer) drop(s common.SyncState) bool {
 	defer func() {
 		h.lastSyncState = s
@@ -319,7 +351,7 @@ func (h *HttpServer) Serve() {
 	// Simple RestAPI for browsing/creating nodes inside Endpoints
 	Server.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"PUT", "POST"},
+		AllowMethods:     []string{"PUT", "POST", "DELETE"},
 		AllowHeaders:     []string{"*"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -330,8 +362,39 @@ func (h *HttpServer) Serve() {
 	Server.POST("/tree", h.ls)
 	Server.PUT("/tree", h.mkdir)
 
+	// Preview paths excluded by ignore rules
+	Server.POST("/ignores", h.previewIgnores)
+
 	// Load Patch contents
 	Server.GET("/patches/:uuid/:offset/:limit", h.listPatches)
+	Server.GET("/tasks/:uuid/patches/search", h.searchPatches)
+	Server.GET("/tasks/:uuid/files/history", h.fileHistory)
+
+	// Manage open conflicts
+	Server.GET("/tasks/:uuid/conflicts", h.listConflicts)
+	Server.POST("/tasks/:uuid/conflicts/:id/resolve", h.resolveConflict)
+
+	// Preview next patch
+	Server.POST("/tasks/:uuid/dry-run", h.dryRun)
+
+	// Tasks states history
+	Server.GET("/tasks/:uuid/history", h.listHistory)
+
+	// Manage files kept in tasks trash
+	Server.GET("/tasks/:uuid/trash", h.listTrash)
+	Server.POST("/tasks/:uuid/trash/:id/restore", h.restoreTrash)
+	Server.DELETE("/tasks/:uuid/trash", h.emptyTrash)
+
+	// Expose Prometheus metrics
+	if h.metrics != nil {
+		Server.GET("/metrics", gin.WrapH(h.metrics.Handler()))
+	}
+
+	// Manage credentials used by webdav endpoints, only from the application itself
+	credentials := Server.Group("/credentials", SameOriginOnly(config.GetHttpProtocol()+"://"+addr))
+	credentials.GET("", h.listCredentials)
+	credentials.PUT("", h.putCredentials)
+	credentials.DELETE("", h.deleteCredentials)
 
 	// Manage global config
 	Server.GET("/config", h.loadConf)
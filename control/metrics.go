@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// PatchStatsEvent is published by a Syncer on TopicPatch each time a non-empty patch is done.
+type PatchStatsEvent struct {
+	TaskUuid   string
+	Processed  int
+	Errors     int
+	BytesTotal int64
+}
+
+// NewPatchStatsEvent counts processed and failed operations of a patch, and the size of the transferred files.
+func NewPatchStatsEvent(taskUuid string, patch merger.Patch) *PatchStatsEvent {
+	event := &PatchStatsEvent{TaskUuid: taskUuid}
+	stats := patch.Stats()
+	if val, ok := stats["Processed"]; ok {
+		event.Processed = val.(map[string]int)["Total"]
+	}
+	if val, ok := stats["Errors"]; ok {
+		event.Errors = val.(map[string]int)["Total"]
+	}
+	patch.WalkOperations([]merger.OperationType{merger.OpCreateFile, merger.OpUpdateFile}, func(operation merger.Operation) {
+		if operation.IsProcessed() {
+			event.BytesTotal += operation.GetNode().GetSize()
+		}
+	})
+	return event
+}
+
+type taskCounters struct {
+	processed float64
+	errors    float64
+	bytes     float64
+}
+
+var (
+	taskLabels     = []string{"task", "label"}
+	endpointLabels = []string{"task", "label", "side", "uri"}
+
+	descTaskStatus     = prometheus.NewDesc("cells_sync_task_status", "Current status of the sync task (1 for the current status).", append(taskLabels, "status"), nil)
+	descLastSyncTime   = prometheus.NewDesc("cells_sync_task_last_sync_timestamp_seconds", "Time of the last sync loop.", taskLabels, nil)
+	descLastOpsTime    = prometheus.NewDesc("cells_sync_task_last_ops_timestamp_seconds", "Time of the last processed operations.", taskLabels, nil)
+	descProcessed      = prometheus.NewDesc("cells_sync_task_processed_operations_total", "Number of successfully processed operations.", taskLabels, nil)
+	descErrors         = prometheus.NewDesc("cells_sync_task_error_operations_total", "Number of operations that ended on error, including conflicts.", taskLabels, nil)
+	descBytes          = prometheus.NewDesc("cells_sync_task_transferred_bytes_total", "Size of the transferred files.", taskLabels, nil)
+	descConnected      = prometheus.NewDesc("cells_sync_endpoint_connected", "Connection state of the task endpoints.", endpointLabels, nil)
+	descTokenFailures  = prometheus.NewDesc("cells_sync_token_refresh_failures_total", "Number of failed OIDC token refreshes.", []string{"authority"}, nil)
+	metricTaskStatuses = []model.TaskStatus{
+		model.TaskStatusIdle,
+		model.TaskStatusPaused,
+		model.TaskStatusDisabled,
+		model.TaskStatusProcessing,
+		model.TaskStatusError,
+		model.TaskStatusRestarting,
+		model.TaskStatusStopping,
+	}
+)
+
+// Metrics is a supervisor service listening to the bus to expose the tasks states and counters
+// in the Prometheus format. It implements the prometheus.Collector interface.
+type Metrics struct {
+	sync.Mutex
+	states   map[string]common.SyncState
+	counters map[string]*taskCounters
+	registry *prometheus.Registry
+	done     chan bool
+}
+
+// NewMetrics creates a new Metrics service with its own registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		states:   make(map[string]common.SyncState),
+		counters: make(map[string]*taskCounters),
+		registry: prometheus.NewRegistry(),
+		done:     make(chan bool),
+	}
+	m.registry.MustRegister(m)
+	m.registry.MustRegister(collectors.NewGoCollector())
+	m.registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// Handler returns an http.Handler serving the metrics.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve implements supervisor service interface.
+func (m *Metrics) Serve() {
+	bus := GetBus()
+	events := bus.Sub(TopicState, TopicPatch)
+	defer bus.Unsub(events, TopicState, TopicPatch)
+	// Ask all tasks for their current state
+	bus.Pub(MessagePublishState, TopicSyncAll)
+	for {
+		select {
+		case <-m.done:
+			return
+		case e := <-events:
+			m.Update(e)
+		}
+	}
+}
+
+// Stop implements supervisor service interface.
+func (m *Metrics) Stop() {
+	close(m.done)
+}
+
+// Update registers a SyncState or a PatchStatsEvent.
+func (m *Metrics) Update(e interface{}) {
+	m.Lock()
+	defer m.Unlock()
+	switch event := e.(type) {
+	case common.SyncState:
+		if event.Status == model.TaskStatusRemoved {
+			delete(m.states, event.UUID)
+			delete(m.counters, event.UUID)
+		} else {
+			m.states[event.UUID] = event
+		}
+	case *PatchStatsEvent:
+		c, ok := m.counters[event.TaskUuid]
+		if !ok {
+			c = &taskCounters{}
+			m.counters[event.TaskUuid] = c
+		}
+		c.processed += float64(event.Processed)
+		c.errors += float64(event.Errors)
+		c.bytes += float64(event.BytesTotal)
+	}
+}
+
+// Describe implements prometheus.Collector interface.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descTaskStatus, descLastSyncTime, descLastOpsTime, descProcessed, descErrors, descBytes, descConnected, descTokenFailures} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector interface.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.Lock()
+	defer m.Unlock()
+	for uuid, state := range m.states {
+		var label string
+		if state.Config != nil {
+			label = state.Config.Label
+		}
+		for _, st := range metricTaskStatuses {
+			var v float64
+			if st == state.Status {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(descTaskStatus, prometheus.GaugeValue, v, uuid, label, common.TaskStatusName(st))
+		}
+		if !state.LastSyncTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(descLastSyncTime, prometheus.GaugeValue, float64(state.LastSyncTime.Unix()), uuid, label)
+		}
+		if !state.LastOpsTime.IsZero() {
+			ch <- prometheus.MustNewConstMetric(descLastOpsTime, prometheus.GaugeValue, float64(state.LastOpsTime.Unix()), uuid, label)
+		}
+		c, ok := m.counters[uuid]
+		if !ok {
+			c = &taskCounters{}
+		}
+		ch <- prometheus.MustNewConstMetric(descProcessed, prometheus.CounterValue, c.processed, uuid, label)
+		ch <- prometheus.MustNewConstMetric(descErrors, prometheus.CounterValue, c.errors, uuid, label)
+		ch <- prometheus.MustNewConstMetric(descBytes, prometheus.CounterValue, c.bytes, uuid, label)
+		if state.Config != nil {
+			for side, info := range map[string]*common.EndpointInfo{"left": state.LeftInfo, "right": state.RightInfo} {
+				uri := state.Config.LeftURI
+				if side == "right" {
+					uri = state.Config.RightURI
+				}
+				if u, e := url.Parse(uri); e == nil {
+					// Do not expose credentials
+					u.User = nil
+					uri = u.String()
+				}
+				var v float64
+				if info != nil && info.Connected {
+					v = 1
+				}
+				ch <- prometheus.MustNewConstMetric(descConnected, prometheus.GaugeValue, v, uuid, label, side, uri)
+			}
+		}
+	}
+	for authority, failures := range config.TokenRefreshFailures() {
+		ch <- prometheus.MustNewConstMetric(descTokenFailures, prometheus.CounterValue, float64(failures), authority)
+	}
+}
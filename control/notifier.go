@@ -0,0 +1,255 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells/v4/common/log"
+	servicecontext "github.com/pydio/cells/v4/common/service/context"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// Events sent to the notification sinks.
+const (
+	NotificationStatusChanged = "status-changed"
+	NotificationPatchError    = "patch-error"
+)
+
+// Headers added to notification requests.
+const (
+	NotificationEventHeader     = "X-Cells-Sync-Event"
+	NotificationSignatureHeader = "X-Cells-Sync-Signature"
+)
+
+// PatchErrorEvent is published by a Syncer on TopicPatch when a patch with errors is stored.
+type PatchErrorEvent struct {
+	TaskUuid  string
+	TaskLabel string
+	PatchUUID string
+	Errors    []string
+	Conflicts int
+}
+
+// NewPatchErrorEvent creates a PatchErrorEvent from the patch errors, as returned by PatchErrors. It returns
+// nil if there are no errors.
+func NewPatchErrorEvent(task *config.Task, patch merger.Patch, errs []error) *PatchErrorEvent {
+	if len(errs) == 0 {
+		return nil
+	}
+	event := &PatchErrorEvent{
+		TaskUuid:  task.Uuid,
+		TaskLabel: task.Label,
+		PatchUUID: patch.GetUUID(),
+	}
+	for i, e := range errs {
+		if i >= 50 {
+			break
+		}
+		event.Errors = append(event.Errors, e.Error())
+	}
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		if st := op.GetStatus(); st == nil || st.IsError() {
+			event.Conflicts++
+		}
+	}
+	return event
+}
+
+// Notification is the JSON payload posted to the sinks.
+type Notification struct {
+	Event          string
+	Time           time.Time
+	TaskUuid       string
+	TaskLabel      string
+	Status         string   `json:",omitempty"`
+	PreviousStatus string   `json:",omitempty"`
+	Message        string   `json:",omitempty"`
+	PatchUUID      string   `json:",omitempty"`
+	Errors         []string `json:",omitempty"`
+	Conflicts      int      `json:",omitempty"`
+}
+
+// Notifier is a supervisor service listening to the bus and posting notifications
+// to the sinks returned by its sinks function, usually the config.Global Notifications.
+type Notifier struct {
+	ctx      context.Context
+	sinks    func() []*config.NotificationSink
+	done     chan bool
+	client   *http.Client
+	statuses map[string]model.TaskStatus
+	// Backoff is the delay before the first retry of a failed delivery, it is doubled at each retry.
+	Backoff time.Duration
+}
+
+// NewNotifier creates a new Notifier service. The sinks function is called for each notification, so that
+// configuration changes are applied without restarting the service.
+func NewNotifier(sinks func() []*config.NotificationSink) *Notifier {
+	return &Notifier{
+		ctx:      servicecontext.WithServiceName(context.Background(), "notifier"),
+		sinks:    sinks,
+		done:     make(chan bool),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		statuses: make(map[string]model.TaskStatus),
+		Backoff:  2 * time.Second,
+	}
+}
+
+// Serve implements supervisor service interface.
+func (n *Notifier) Serve() {
+	bus := GetBus()
+	events := bus.Sub(TopicState, TopicPatch)
+	defer bus.Unsub(events, TopicState, TopicPatch)
+	for {
+		select {
+		case <-n.done:
+			return
+		case e := <-events:
+			if notification := n.fromEvent(e); notification != nil {
+				n.Notify(notification)
+			}
+		}
+	}
+}
+
+// Stop implements supervisor service interface.
+func (n *Notifier) Stop() {
+	close(n.done)
+}
+
+// fromEvent transforms a bus message into a Notification, if it must be notified.
+func (n *Notifier) fromEvent(e interface{}) *Notification {
+	switch event := e.(type) {
+	case common.SyncState:
+		previous, known := n.statuses[event.UUID]
+		n.statuses[event.UUID] = event.Status
+		if known && previous == event.Status {
+			return nil
+		}
+		notification := &Notification{
+			Event:    NotificationStatusChanged,
+			Time:     time.Now(),
+			TaskUuid: event.UUID,
+			Status:   common.TaskStatusName(event.Status),
+		}
+		if known {
+			notification.PreviousStatus = common.TaskStatusName(previous)
+		}
+		if event.Config != nil {
+			notification.TaskLabel = event.Config.Label
+		}
+		if event.LastProcessStatus != nil {
+			notification.Message = event.LastProcessStatus.String()
+		}
+		return notification
+	case *PatchErrorEvent:
+		notification := &Notification{
+			Event:     NotificationPatchError,
+			Time:      time.Now(),
+			TaskUuid:  event.TaskUuid,
+			TaskLabel: event.TaskLabel,
+			PatchUUID: event.PatchUUID,
+			Errors:    event.Errors,
+			Conflicts: event.Conflicts,
+		}
+		return notification
+	}
+	return nil
+}
+
+// Notify posts the notification to all sinks accepting this event. Deliveries are performed in background.
+func (n *Notifier) Notify(notification *Notification) {
+	data, e := json.Marshal(notification)
+	if e != nil {
+		log.Logger(n.ctx).Error("Cannot marshal notification: " + e.Error())
+		return
+	}
+	for _, sink := range n.sinks() {
+		if sink.Url == "" || !sink.Accepts(notification.Event) {
+			continue
+		}
+		go n.deliver(sink, notification.Event, data)
+	}
+}
+
+// deliver posts the payload to the sink, retrying with an exponential backoff.
+func (n *Notifier) deliver(sink *config.NotificationSink, event string, data []byte) {
+	retries := sink.MaxRetries
+	if retries <= 0 {
+		retries = config.DefaultNotificationRetries
+	}
+	wait := n.Backoff
+	for i := 0; ; i++ {
+		e := n.post(sink, event, data)
+		if e == nil {
+			return
+		}
+		if i >= retries {
+			log.Logger(n.ctx).Error(fmt.Sprintf("Giving up notification to %s after %d attempts: %s", sink.Url, i+1, e.Error()))
+			return
+		}
+		log.Logger(n.ctx).Warn(fmt.Sprintf("Notification to %s failed (%s), retrying in %s", sink.Url, e.Error(), wait))
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *Notifier) post(sink *config.NotificationSink, event string, data []byte) error {
+	req, e := http.NewRequest(http.MethodPost, sink.Url, bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(NotificationEventHeader, event)
+	if sink.Secret != "" {
+		req.Header.Set(NotificationSignatureHeader, "sha256="+SignNotification(sink.Secret, data))
+	}
+	resp, e := n.client.Do(req)
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// SignNotification computes the hex-encoded HMAC-SHA256 of the payload.
+func SignNotification(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
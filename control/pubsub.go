@@ -30,12 +30,16 @@ var (
 )
 
 const (
-	TopicGlobal  = "cmd"
-	TopicSyncAll = "sync"
-	TopicSync_   = "sync-"
-	TopicState   = "state"
-	TopicStore_  = "store"
-	TopicUpdate  = "update"
+	TopicGlobal     = "cmd"
+	TopicSyncAll    = "sync"
+	TopicSync_      = "sync-"
+	TopicState      = "state"
+	TopicPatch      = "patch"
+	TopicStore_     = "store"
+	TopicConflicts_ = "conflicts"
+	TopicHistory_   = "history"
+	TopicTrash_     = "trash"
+	TopicUpdate     = "update"
 )
 
 type CommandMessage int
@@ -55,6 +59,9 @@ const (
 	MessagePublishStore
 	MessageRestartClean // Restart an clean snapshots
 	MessageHaltClean    // Halt task and remove all configs
+	MessagePublishConflicts
+	MessagePublishHistory
+	MessagePublishTrash
 )
 
 func init() {
@@ -25,6 +25,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
@@ -38,6 +39,9 @@ import (
 	servicecontext "github.com/pydio/cells/v4/common/service/context"
 )
 
+// restartTimeout is the maximum time to wait for a Syncer to stop before restarting it.
+const restartTimeout = 30 * time.Second
+
 // Supervisor is a service manager for starting syncs and other services and restarting them if necessary
 type Supervisor struct {
 	sync.Mutex
@@ -69,11 +73,12 @@ func NewSupervisor(noUi bool) *Supervisor {
 // The call is blocking until all services are stopped
 func (s *Supervisor) Serve() error {
 	httpServer := NewHttpServer()
+	metrics := NewMetrics()
+	httpServer.metrics = metrics
 	conf := config.Default()
 	if len(conf.Tasks) > 0 {
 		for _, t := range conf.Tasks {
-			syncer := NewSyncer(t)
-			s.tasksTokens[t.Uuid] = s.Add(syncer)
+			s.startTask(t)
 		}
 	}
 
@@ -88,6 +93,11 @@ func (s *Supervisor) Serve() error {
 	}
 	s.Add(httpServer)
 	s.Add(NewUpdater())
+	s.Add(NewNotifier(func() []*config.NotificationSink {
+		return config.Default().Notifications
+	}))
+	s.Add(metrics)
+	s.Add(NewConfigWatcher())
 
 	go s.listenBus()
 	go s.listenConfig()
@@ -100,45 +110,45 @@ func (s *Supervisor) listenConfig() {
 	c := config.Watch()
 	for event := range c {
 		if taskChange, ok := event.(*config.TaskChange); ok {
-			// Restart Scheduler
-			s.Remove(s.schedulerToken)
-			allTasks := config.Default().Tasks
-			s.schedulerToken = s.Add(NewScheduler(allTasks))
+			task := taskChange.Task
+			changes := config.TaskUpdateEndpoints
+			if taskChange.Type == "update" && taskChange.Previous != nil {
+				changes = config.DiffTasks(taskChange.Previous, task)
+			}
+
+			if taskChange.Type != "update" || changes.Has(config.TaskUpdateSchedule) {
+				// Restart Scheduler
+				s.Remove(s.schedulerToken)
+				allTasks := config.Default().Tasks
+				s.schedulerToken = s.Add(NewScheduler(allTasks))
+			}
 
 			// Start/stop sync tasks
 			if taskChange.Type == "create" {
-				log.Logger(s.ctx).Info("Starting New Task " + taskChange.Task.Uuid)
-				t := s.Add(NewSyncer(taskChange.Task))
-				s.Lock()
-				s.tasksTokens[taskChange.Task.Uuid] = t
-				s.Unlock()
+				log.Logger(s.ctx).Info("Starting New Task " + task.Uuid)
+				s.startTask(task)
 			} else if taskChange.Type == "update" {
-				s.Lock()
-				token, ok := s.tasksTokens[taskChange.Task.Uuid]
-				s.Unlock()
-				if ok {
-					log.Logger(s.ctx).Info("Restarting Task " + taskChange.Task.Uuid)
-					GetBus().Pub(MessageRestartClean, TopicSync_+taskChange.Task.Uuid)
-					s.Remove(token)
-					log.Logger(s.ctx).Info("Removed from Supervisor" + taskChange.Task.Uuid)
-					<-time.After(5 * time.Second)
+				if taskChange.Previous != nil && taskChange.Previous.LoadError() != nil {
+					// Previous version was not started
+					s.restartTask(task, false)
+				} else if changes.Has(config.TaskUpdateEndpoints | config.TaskUpdateRestart | config.TaskUpdateFilters) {
+					// Filters are read by the sync processor and watchers when they start
+					s.restartTask(task, changes.Has(config.TaskUpdateEndpoints))
+				} else if changes != 0 {
+					log.Logger(s.ctx).Info("Updating Task " + task.Uuid + " in place")
+					GetBus().Pub(&TaskUpdateRequest{Task: task, Changes: changes}, TopicSync_+task.Uuid)
 				}
-				log.Logger(s.ctx).Info("Starting Task " + taskChange.Task.Uuid)
-				t := s.Add(NewSyncer(taskChange.Task))
-				s.Lock()
-				s.tasksTokens[taskChange.Task.Uuid] = t
-				s.Unlock()
 			} else if taskChange.Type == "remove" {
 				s.Lock()
-				token, ok := s.tasksTokens[taskChange.Task.Uuid]
+				token, ok := s.tasksTokens[task.Uuid]
 				s.Unlock()
 				if ok {
-					log.Logger(s.ctx).Info("Removing Task " + taskChange.Task.Uuid)
-					GetBus().Pub(MessageHaltClean, TopicSync_+taskChange.Task.Uuid)
+					log.Logger(s.ctx).Info("Removing Task " + task.Uuid)
+					GetBus().Pub(MessageHaltClean, TopicSync_+task.Uuid)
 					s.Remove(token)
-					log.Logger(s.ctx).Info("Removed from Supervisor" + taskChange.Task.Uuid)
+					log.Logger(s.ctx).Info("Removed from Supervisor" + task.Uuid)
 					s.Lock()
-					delete(s.tasksTokens, taskChange.Task.Uuid)
+					delete(s.tasksTokens, task.Uuid)
 					s.Unlock()
 				}
 			}
@@ -146,6 +156,42 @@ func (s *Supervisor) listenConfig() {
 	}
 }
 
+// restartTask stops the running Syncer for this task, waits for it to release its resources, and starts a new
+// one with the updated config. If cleanSnapshots is true, snapshots are removed to launch a full resync.
+func (s *Supervisor) restartTask(task *config.Task, cleanSnapshots bool) {
+	s.Lock()
+	token, ok := s.tasksTokens[task.Uuid]
+	s.Unlock()
+	if ok {
+		log.Logger(s.ctx).Info("Restarting Task " + task.Uuid)
+		GetBus().Pub(MessageRestart, TopicSync_+task.Uuid)
+		if e := s.RemoveAndWait(token, restartTimeout); e != nil {
+			log.Logger(s.ctx).Error("Task " + task.Uuid + " did not stop properly: " + e.Error())
+		} else {
+			log.Logger(s.ctx).Info("Removed from Supervisor " + task.Uuid)
+		}
+	}
+	if cleanSnapshots {
+		log.Logger(s.ctx).Info("Endpoints have changed, clearing snapshots for task " + task.Uuid)
+		clearSnapshots(s.ctx, filepath.Join(config.SyncClientDataDir(), task.Uuid))
+	}
+	log.Logger(s.ctx).Info("Starting Task " + task.Uuid)
+	s.startTask(task)
+}
+
+// startTask adds a Syncer for this task to the supervisor, unless the task was flagged as invalid when
+// loading the config file.
+func (s *Supervisor) startTask(task *config.Task) {
+	if e := task.LoadError(); e != nil {
+		log.Logger(s.ctx).Error("Task " + task.Uuid + " is invalid and will not be started: " + e.Error())
+		return
+	}
+	t := s.Add(NewSyncer(task))
+	s.Lock()
+	s.tasksTokens[task.Uuid] = t
+	s.Unlock()
+}
+
 func (s *Supervisor) listenBus() {
 	c := GetBus().Sub(TopicGlobal)
 	for m := range c {
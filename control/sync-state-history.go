@@ -0,0 +1,305 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+var (
+	historyBucket = []byte("history")
+)
+
+// Types of HistoryEntry.
+const (
+	HistoryTypeStatus     = "status"
+	HistoryTypeConnection = "connection"
+	HistoryTypeSummary    = "summary"
+)
+
+// HistoryEntry is a timestamped event of a task life.
+type HistoryEntry struct {
+	Time           time.Time
+	Type           string
+	Status         string        `json:",omitempty"`
+	PreviousStatus string        `json:",omitempty"`
+	Endpoint       string        `json:",omitempty"`
+	Connected      bool          `json:",omitempty"`
+	Message        string        `json:",omitempty"`
+	Error          string        `json:",omitempty"`
+	Duration       time.Duration `json:",omitempty"`
+}
+
+// HistoryQuery filters the entries returned by HistoryStateStore.Load.
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	Type  string
+	Limit int
+}
+
+// HistoryStateStore wraps a StateStore to keep a timeline of status transitions, connection changes
+// and processing summaries in a BoltDB file. Entries older than the retention are pruned.
+type HistoryStateStore struct {
+	StateStore
+	sync.Mutex
+
+	db              *bbolt.DB
+	retention       time.Duration
+	entries         chan *HistoryEntry
+	wg              sync.WaitGroup
+	closed          bool
+	processingStart time.Time
+	writes          int
+}
+
+// NewHistoryStateStore opens the history file in the target folder and wraps the store.
+func NewHistoryStateStore(store StateStore, folderPath string, retention time.Duration) (*HistoryStateStore, error) {
+	options := *bbolt.DefaultOptions
+	options.Timeout = 5 * time.Second
+	db, err := bbolt.Open(filepath.Join(folderPath, "history"), 0644, &options)
+	if err != nil {
+		return nil, err
+	}
+	h := &HistoryStateStore{
+		StateStore: store,
+		db:         db,
+		retention:  retention,
+		entries:    make(chan *HistoryEntry, 100),
+	}
+	h.prune()
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for entry := range h.entries {
+			h.persist(entry)
+		}
+	}()
+	return h, nil
+}
+
+// UpdateSyncStatus records the status transition.
+func (h *HistoryStateStore) UpdateSyncStatus(s model.TaskStatus) common.SyncState {
+	previous := h.StateStore.LastState().Status
+	state := h.StateStore.UpdateSyncStatus(s)
+	h.recordTransition(previous, state, nil)
+	return state
+}
+
+// UpdateProcessStatus records the status transition, and a summary when a processing ends.
+func (h *HistoryStateStore) UpdateProcessStatus(processStatus model.Status, status ...model.TaskStatus) common.SyncState {
+	previous := h.StateStore.LastState().Status
+	state := h.StateStore.UpdateProcessStatus(processStatus, status...)
+	if len(status) > 0 {
+		h.recordTransition(previous, state, processStatus)
+	}
+	return state
+}
+
+// UpdateConnection records the connection change of an endpoint.
+func (h *HistoryStateStore) UpdateConnection(c bool, i model.EndpointInfo) common.SyncState {
+	// EndpointInfo are pointers shared with the inner state: read values before updating
+	left, right := h.connections()
+	state := h.StateStore.UpdateConnection(c, i)
+	if l, r := h.connections(); l != left || r != right {
+		h.Lock()
+		h.push(&HistoryEntry{
+			Type:      HistoryTypeConnection,
+			Endpoint:  i.URI,
+			Connected: c,
+		})
+		h.Unlock()
+	}
+	return state
+}
+
+// Close flushes pending entries and closes the DB.
+func (h *HistoryStateStore) Close() {
+	h.StateStore.Close()
+	h.Lock()
+	h.closed = true
+	close(h.entries)
+	h.Unlock()
+	h.wg.Wait()
+	h.db.Close()
+}
+
+// Load lists entries matching the query, most recent first.
+func (h *HistoryStateStore) Load(query HistoryQuery) (entries []*HistoryEntry, e error) {
+	e = h.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		var k, v []byte
+		if query.To.IsZero() {
+			k, v = c.Last()
+		} else if k, v = c.Seek(historyKey(query.To.Add(time.Nanosecond), 0)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				continue
+			}
+			if !query.To.IsZero() && entry.Time.After(query.To) {
+				continue
+			}
+			if !query.From.IsZero() && entry.Time.Before(query.From) {
+				break
+			}
+			if query.Type != "" && entry.Type != query.Type {
+				continue
+			}
+			entries = append(entries, &entry)
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (h *HistoryStateStore) connections() (left, right bool) {
+	state := h.StateStore.LastState()
+	if state.LeftInfo != nil {
+		left = state.LeftInfo.Connected
+	}
+	if state.RightInfo != nil {
+		right = state.RightInfo.Connected
+	}
+	return
+}
+
+func (h *HistoryStateStore) recordTransition(previous model.TaskStatus, state common.SyncState, processStatus model.Status) {
+	if previous == state.Status {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	entry := &HistoryEntry{
+		Type:           HistoryTypeStatus,
+		Status:         common.TaskStatusName(state.Status),
+		PreviousStatus: common.TaskStatusName(previous),
+	}
+	if processStatus != nil {
+		entry.Message = processStatus.String()
+	}
+	h.push(entry)
+	if state.Status == model.TaskStatusProcessing {
+		h.processingStart = time.Now()
+		return
+	}
+	if previous == model.TaskStatusProcessing && !h.processingStart.IsZero() {
+		summary := &HistoryEntry{
+			Type:     HistoryTypeSummary,
+			Status:   common.TaskStatusName(state.Status),
+			Duration: time.Since(h.processingStart),
+		}
+		if processStatus != nil {
+			summary.Message = processStatus.String()
+			if processStatus.IsError() && processStatus.Error() != nil {
+				summary.Error = processStatus.Error().Error()
+			}
+		}
+		h.push(summary)
+		h.processingStart = time.Time{}
+	}
+}
+
+// push sends the entry to the persistence queue, it must be called with the lock held.
+func (h *HistoryStateStore) push(entry *HistoryEntry) {
+	if h.closed {
+		return
+	}
+	entry.Time = time.Now()
+	h.entries <- entry
+}
+
+func (h *HistoryStateStore) persist(entry *HistoryEntry) {
+	e := h.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		seq, _ := bucket.NextSequence()
+		return bucket.Put(historyKey(entry.Time, seq), data)
+	})
+	if e != nil {
+		log.Logger(context.Background()).Error("Cannot store history entry: " + e.Error())
+	}
+	h.writes++
+	if h.writes%100 == 0 {
+		h.prune()
+	}
+}
+
+// prune removes entries older than the retention.
+func (h *HistoryStateStore) prune() {
+	if h.retention <= 0 {
+		return
+	}
+	limit := historyKey(time.Now().Add(-h.retention), 0)
+	h.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// historyKey sorts entries by time, the sequence avoids collisions.
+func historyKey(t time.Time, seq uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], seq)
+	return b
+}
@@ -53,6 +53,7 @@ type StateStore interface {
 
 	UpdateSyncStatus(s model.TaskStatus) common.SyncState
 	UpdateProcessStatus(processStatus model.Status, status ...model.TaskStatus) common.SyncState
+	UpdateConfig(c *config.Task) common.SyncState
 }
 
 // MemoryStateStore keeps all SyncStates in memory.
@@ -129,6 +130,15 @@ func (b *MemoryStateStore) UpdateProcessStatus(processStatus model.Status, statu
 	return b.state
 }
 
+// UpdateConfig replaces the task configuration attached to the state.
+func (b *MemoryStateStore) UpdateConfig(c *config.Task) common.SyncState {
+	b.Lock()
+	defer b.Unlock()
+	b.config = c
+	b.state.Config = c
+	return b.state
+}
+
 // UpdateConnection updates the connection status of one endpoint.
 func (b *MemoryStateStore) UpdateConnection(c bool, i model.EndpointInfo) common.SyncState {
 	b.Lock()
@@ -26,6 +26,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -34,31 +35,50 @@ import (
 	"github.com/pydio/cells-sync/endpoint"
 	"github.com/pydio/cells/v4/common/log"
 	"github.com/pydio/cells/v4/common/service/context"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
 	"github.com/pydio/cells/v4/common/sync/merger"
 	"github.com/pydio/cells/v4/common/sync/model"
 	"github.com/pydio/cells/v4/common/sync/task"
 )
 
+// TaskUpdateRequest is sent on the bus to a Syncer to apply a new configuration without restarting it.
+// Changes must only contain TaskUpdateCosmetic and TaskUpdateSchedule flags.
+type TaskUpdateRequest struct {
+	Task    *config.Task
+	Changes config.TaskUpdate
+}
+
 // Syncer is a supervisor service wrapping a sync task.
 type Syncer struct {
-	task    *task.Sync
-	stop    chan bool
-	uuid    string
-	watches bool
+	task *task.Sync
+	// conf is replaced by task updates, confLock protects it as it is read by the processing goroutines.
+	conf     *config.Task
+	confLock sync.RWMutex
+	stop     chan bool
+	uuid     string
+	watches  bool
 
 	eventsChan  chan interface{}
 	patchStatus chan model.Status
 	patchDone   chan interface{}
 	cmd         *model.Command
-
-	serviceCtx   context.Context
-	configPath   string
-	stateStore   StateStore
-	patchStore   *endpoint.PatchStore
-	snapFactory  model.SnapshotFactory
-	taskPaused   bool
-	lastPatch    merger.Patch
-	dirtyStopped bool
+	// resolvedPatches receives the patches back from resolveConflicts, statusDone is closed when dispatchStatus returns.
+	resolvedPatches chan merger.Patch
+	statusDone      chan struct{}
+
+	serviceCtx    context.Context
+	configPath    string
+	stateStore    StateStore
+	patchStore    *endpoint.PatchStore
+	conflictStore *endpoint.ConflictStore
+	trash         *endpoint.Trash
+	resolver      *ConflictResolver
+	endpoints     []model.Endpoint
+	snapFactory   model.SnapshotFactory
+	taskPaused    bool
+	lastPatch     merger.Patch
+	lastDonePatch string
+	dirtyStopped  bool
 
 	cleanSnapsAfterStop bool
 	cleanAllAfterStop   bool
@@ -89,6 +109,7 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 
 	syncer = &Syncer{
 		uuid:       conf.Uuid,
+		conf:       conf,
 		serviceCtx: ctx,
 		stop:       make(chan bool, 1),
 		stateStore: stateStore,
@@ -98,12 +119,7 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 	if knownVersion != common.Version {
 		if !isNew {
 			log.Logger(ctx).Warn("App version has changed, clearing snapshots and launching a full resync")
-			if er := os.Remove(filepath.Join(configPath, "snapshot-left")); er == nil {
-				log.Logger(ctx).Warn(" - Cleared snapshot-left")
-			}
-			if er := os.Remove(filepath.Join(configPath, "snapshot-right")); er == nil {
-				log.Logger(ctx).Warn(" - Cleared snapshot-right")
-			}
+			clearSnapshots(ctx, configPath)
 			syncer.dirtyStopped = true
 		} else {
 			if er := os.MkdirAll(configPath, 0755); er != nil {
@@ -115,6 +131,12 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 		}
 	}
 
+	if history, er := NewHistoryStateStore(stateStore, configPath, conf.GetHistoryRetention()); er == nil {
+		syncer.stateStore = history
+	} else {
+		log.Logger(ctx).Error("Cannot open history for task: " + er.Error())
+	}
+
 	if stateStore.PreviousState == model.TaskStatusProcessing {
 		log.Logger(ctx).Warn("Last Status on this task was 'processing', this is not normal, will relaunch a full resync")
 		syncer.dirtyStopped = true
@@ -122,7 +144,7 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 
 	defer func() {
 		if startError != nil {
-			stateStore.UpdateProcessStatus(model.NewProcessingStatus(startError.Error()).SetError(startError), model.TaskStatusError)
+			syncer.stateStore.UpdateProcessStatus(model.NewProcessingStatus(startError.Error()).SetError(startError), model.TaskStatusError)
 		}
 	}()
 
@@ -141,6 +163,17 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 		return
 	}
 
+	syncer.trash = endpoint.NewTrash(filepath.Join(configPath, "trash"), conf.GetTrashRetention())
+	if conf.Trash {
+		if fs, ok := leftEndpoint.(*filesystem.FSClient); ok {
+			leftEndpoint = endpoint.NewTrashFSClient(fs, syncer.trash)
+		}
+		if fs, ok := rightEndpoint.(*filesystem.FSClient); ok {
+			rightEndpoint = endpoint.NewTrashFSClient(fs, syncer.trash)
+		}
+	}
+	syncer.pruneTrash(ctx)
+
 	var direction model.DirectionType
 	switch conf.Direction {
 	case "Bi":
@@ -154,8 +187,16 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 		return
 	}
 
+	ignores, err := endpoint.NewIgnoreMatcher(conf.GetIgnoreRules(), endpoint.LocalRootsFromURIs(conf.LeftURI, conf.RightURI)...)
+	if err != nil {
+		startError = errors.Wrap(err, "cannot parse ignore rules")
+		return
+	}
+	ignores.SetNodeSources(leftEndpoint, rightEndpoint)
+
 	syncTask := task.NewSync(leftEndpoint, rightEndpoint, direction)
-	syncTask.SetFilters(conf.SelectiveRoots, []string{"**/.git**", "**/.pydio"})
+	syncTask.SetFilters(conf.SelectiveRoots, nil)
+	syncTask.Ignores = append(syncTask.Ignores, ignores)
 
 	if _, er := os.Stat(configPath); er != nil && os.IsNotExist(er) {
 		if er := os.MkdirAll(configPath, 0755); er != nil {
@@ -165,6 +206,8 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 	}
 
 	syncer.task = syncTask
+	syncer.resolver = NewConflictResolver(conf.ConflictPolicy, leftEndpoint, rightEndpoint)
+	syncer.endpoints = []model.Endpoint{leftEndpoint, rightEndpoint}
 	syncer.watches = conf.Realtime
 	if conf.RealtimePaused {
 		syncer.taskPaused = true
@@ -172,22 +215,39 @@ func NewSyncer(conf *config.Task) (syncer *Syncer) {
 	syncer.eventsChan = make(chan interface{})
 	syncer.patchStatus = make(chan model.Status)
 	syncer.patchDone = make(chan interface{})
+	syncer.resolvedPatches = make(chan merger.Patch)
+	syncer.statusDone = make(chan struct{})
 	syncer.cmd = model.NewCommand()
 
-	if patchStore, err := endpoint.NewPatchStore(configPath, leftEndpoint, rightEndpoint); err == nil {
+	if patchStore, err := endpoint.NewPatchStore(configPath, leftEndpoint, rightEndpoint, endpoint.NewPatchRetention(conf.GetPatchRetention())); err == nil {
 		syncer.patchStore = patchStore
-		syncTask.SetPatchListener(syncer.patchStore)
-
 	} else {
 		log.Logger(ctx).Error("Cannot open patch store: " + err.Error())
 	}
+	if conflictStore, err := endpoint.NewConflictStore(configPath); err == nil {
+		syncer.conflictStore = conflictStore
+	} else {
+		log.Logger(ctx).Error("Cannot open conflict store: " + err.Error())
+	}
+	syncTask.SetPatchListener(syncer)
 
 	return
 
 }
 
+// clearSnapshots removes the snapshots stored in the task folder, the next sync will be a full resync.
+func clearSnapshots(ctx context.Context, configPath string) {
+	if er := os.Remove(filepath.Join(configPath, "snapshot-left")); er == nil {
+		log.Logger(ctx).Warn(" - Cleared snapshot-left")
+	}
+	if er := os.Remove(filepath.Join(configPath, "snapshot-right")); er == nil {
+		log.Logger(ctx).Warn(" - Cleared snapshot-right")
+	}
+}
+
 func (s *Syncer) dispatchStatus(ctx context.Context) {
 
+	defer close(s.statusDone)
 	for {
 		select {
 		case l, ok := <-s.patchStatus:
@@ -211,58 +271,14 @@ func (s *Syncer) dispatchStatus(ctx context.Context) {
 			if !ok {
 				return
 			}
-			var idleStatus = model.TaskStatusIdle
-			if s.taskPaused {
-				idleStatus = model.TaskStatusPaused
-			}
-			deferIdle := true
-			stateStore := s.stateStore
-			if patch, ok := data.(merger.Patch); ok {
-				stats := patch.Stats()
-				if patch.Size() > 0 {
-					s.lastPatch = patch
-					s.stateStore.TouchLastOpsTime()
-					// Update Stats from snapshots
-					if snapStats, err := s.task.RootStats(ctx, true); err == nil {
-						log.Logger(ctx).Info("Stats after running patch")
-						stateStore.UpdateEndpointStats(snapStats[s.task.Source.GetEndpointInfo().URI], s.task.Source.GetEndpointInfo())
-						stateStore.UpdateEndpointStats(snapStats[s.task.Target.GetEndpointInfo().URI], s.task.Target.GetEndpointInfo())
-					} else {
-						log.Logger(ctx).Error("Cannot compute stats: " + err.Error())
-					}
-				}
-				if val, ok := stats["Errors"]; ok {
-					errs := val.(map[string]int)
-					msg := fmt.Sprintf("Processing ended on error (%d errors)!", errs["Total"])
-					log.Logger(ctx).Error(msg)
-					stateStore.UpdateProcessStatus(model.NewProcessingStatus(msg), model.TaskStatusError)
-					deferIdle = false
-				} else if err, ok := patch.HasErrors(); ok {
-					msg := fmt.Sprintf("Processing ended with %d errors!", len(err))
-					log.Logger(ctx).Error(msg)
-					erStatus := model.NewProcessingStatus(msg)
-					erStatus.SetError(err[0])
-					stateStore.UpdateProcessStatus(erStatus, model.TaskStatusError)
-					deferIdle = false
-				} else if val, ok := stats["Processed"]; ok {
-					processed := val.(map[string]int)
-					msg := fmt.Sprintf("Finished Processing %d files and folders", processed["Total"])
-					log.Logger(ctx).Info(msg)
-					stateStore.UpdateProcessStatus(model.NewProcessingStatus(msg), idleStatus)
-				} else {
-					stateStore.UpdateProcessStatus(model.NewProcessingStatus("Idle"), idleStatus)
-					deferIdle = false
-				}
-				if s.patchStore != nil {
-					s.patchStore.Store(patch)
-				}
-			}
-			if deferIdle {
-				go func() {
-					<-time.After(3 * time.Second)
-					stateStore.UpdateProcessStatus(model.NewProcessingStatus("Idle"), idleStatus)
-				}()
+			if patch, ok := data.(merger.Patch); ok && s.resolver != nil && s.resolver.Pending(patch) {
+				s.resolveConflicts(ctx, s.resolver, patch)
+				continue
 			}
+			s.onPatchDone(ctx, data)
+
+		case patch := <-s.resolvedPatches:
+			s.onPatchDone(ctx, patch)
 
 		case e := <-s.eventsChan:
 			go GetBus().Pub(e, TopicSync_+s.uuid)
@@ -276,6 +292,92 @@ func (s *Syncer) dispatchStatus(ctx context.Context) {
 
 }
 
+// onPatchDone updates the task status and stores the patch once it is processed.
+func (s *Syncer) onPatchDone(ctx context.Context, data interface{}) {
+	var idleStatus = model.TaskStatusIdle
+	if s.taskPaused {
+		idleStatus = model.TaskStatusPaused
+	}
+	deferIdle := true
+	stateStore := s.stateStore
+	if patch, ok := data.(merger.Patch); ok {
+		stats := patch.Stats()
+		resolved := s.resolver != nil && s.resolver.Settled(patch)
+		if patch.Size() > 0 {
+			if !resolved {
+				s.lastPatch = patch
+			}
+			s.stateStore.TouchLastOpsTime()
+			// Update Stats from snapshots
+			if snapStats, err := s.task.RootStats(ctx, true); err == nil {
+				log.Logger(ctx).Info("Stats after running patch")
+				stateStore.UpdateEndpointStats(snapStats[s.task.Source.GetEndpointInfo().URI], s.task.Source.GetEndpointInfo())
+				stateStore.UpdateEndpointStats(snapStats[s.task.Target.GetEndpointInfo().URI], s.task.Target.GetEndpointInfo())
+			} else {
+				log.Logger(ctx).Error("Cannot compute stats: " + err.Error())
+			}
+		}
+		if resolved {
+			// Conflicts are counted as errors in stats, although they are now resolved
+			msg := "Conflicts were resolved by policy, applying resolutions"
+			log.Logger(ctx).Info(msg)
+			stateStore.UpdateProcessStatus(model.NewProcessingStatus(msg), model.TaskStatusProcessing)
+			deferIdle = false
+		} else if val, ok := stats["Errors"]; ok {
+			errs := val.(map[string]int)
+			msg := fmt.Sprintf("Processing ended on error (%d errors)!", errs["Total"])
+			log.Logger(ctx).Error(msg)
+			stateStore.UpdateProcessStatus(model.NewProcessingStatus(msg), model.TaskStatusError)
+			deferIdle = false
+		} else if err, ok := patch.HasErrors(); ok {
+			msg := fmt.Sprintf("Processing ended with %d errors!", len(err))
+			log.Logger(ctx).Error(msg)
+			erStatus := model.NewProcessingStatus(msg)
+			erStatus.SetError(err[0])
+			stateStore.UpdateProcessStatus(erStatus, model.TaskStatusError)
+			deferIdle = false
+		} else if val, ok := stats["Processed"]; ok {
+			processed := val.(map[string]int)
+			msg := fmt.Sprintf("Finished Processing %d files and folders", processed["Total"])
+			log.Logger(ctx).Info(msg)
+			stateStore.UpdateProcessStatus(model.NewProcessingStatus(msg), idleStatus)
+		} else {
+			stateStore.UpdateProcessStatus(model.NewProcessingStatus("Idle"), idleStatus)
+			deferIdle = false
+		}
+		if s.patchStore != nil {
+			s.patchStore.Store(patch)
+		}
+		errs, hasErrors := PatchErrors(patch)
+		if s.conflictStore != nil {
+			if e := s.conflictStore.Record(patch); e != nil {
+				log.Logger(ctx).Error("Cannot record conflicts: " + e.Error())
+			}
+			if !hasErrors {
+				s.pruneConflicts(ctx, patch)
+			}
+		}
+		// Conflicting patches may be received twice
+		if patch.GetUUID() != s.lastDonePatch {
+			s.lastDonePatch = patch.GetUUID()
+			s.runAfterHooks(ctx, patch, hasErrors)
+			if event := NewPatchErrorEvent(s.getConf(), patch, errs); event != nil {
+				GetBus().Pub(event, TopicPatch)
+			}
+			if patch.Size() > 0 {
+				GetBus().Pub(NewPatchStatsEvent(s.uuid, patch), TopicPatch)
+				s.pruneTrash(ctx)
+			}
+		}
+	}
+	if deferIdle {
+		go func() {
+			<-time.After(3 * time.Second)
+			stateStore.UpdateProcessStatus(model.NewProcessingStatus("Idle"), idleStatus)
+		}()
+	}
+}
+
 func (s *Syncer) dispatchPublishBus(ctx context.Context, done chan bool) {
 	bus := GetBus()
 	topic := bus.Sub(TopicSyncAll, TopicSync_+s.uuid)
@@ -292,6 +394,24 @@ func (s *Syncer) dispatchPublishBus(ctx context.Context, done chan bool) {
 				} else {
 					bus.Pub(fmt.Errorf("patch store not ready"), TopicStore_+s.uuid)
 				}
+			case MessagePublishHistory:
+				if history, ok := s.stateStore.(*HistoryStateStore); ok {
+					bus.Pub(history, TopicHistory_+s.uuid)
+				} else {
+					bus.Pub(fmt.Errorf("history not available"), TopicHistory_+s.uuid)
+				}
+			case MessagePublishTrash:
+				if s.trash != nil {
+					bus.Pub(s.trash, TopicTrash_+s.uuid)
+				} else {
+					bus.Pub(fmt.Errorf("trash not available"), TopicTrash_+s.uuid)
+				}
+			case MessagePublishConflicts:
+				if s.conflictStore != nil {
+					bus.Pub(s.conflictStore, TopicConflicts_+s.uuid)
+				} else {
+					bus.Pub(fmt.Errorf("conflict store not ready"), TopicConflicts_+s.uuid)
+				}
 			case MessagePublishState:
 				// Broadcast current state
 				bus.Pub(s.stateStore.LastState(), TopicState)
@@ -301,6 +421,154 @@ func (s *Syncer) dispatchPublishBus(ctx context.Context, done chan bool) {
 
 }
 
+// PublishPatch implements merger.PatchListener interface. It is called by the processor right before
+// processing a non-empty patch: the before-patch hook is run synchronously, then the patch is stored.
+func (s *Syncer) PublishPatch(patch merger.Patch) {
+	conf := s.getConf()
+	if h := conf.Hooks; h != nil && h.BeforePatch != nil {
+		_ = RunHook(s.serviceCtx, h.BeforePatch, NewHookInput(HookBeforePatch, conf, patch))
+	}
+	if s.patchStore != nil {
+		s.patchStore.PublishPatch(patch)
+	}
+}
+
+// runAfterHooks runs the after-patch-success or after-patch-error hook in background. Empty patches are ignored.
+func (s *Syncer) runAfterHooks(ctx context.Context, patch merger.Patch, hasErrors bool) {
+	conf := s.getConf()
+	h := conf.Hooks
+	if h == nil {
+		return
+	}
+	event := AfterPatchEvent(patch, hasErrors)
+	hook := h.AfterPatchSuccess
+	if event == HookAfterPatchError {
+		hook = h.AfterPatchError
+	}
+	if event == "" || hook == nil {
+		return
+	}
+	input := NewHookInput(event, conf, patch)
+	go func() {
+		_ = RunHook(ctx, hook, input)
+	}()
+}
+
+// dryRun computes the patch that the next sync would apply and sends back a report. Unless the request
+// is forced, the bidirectional changes are computed from the snapshots, like a normal sync loop. Dry runs are
+// rejected while the task is processing, as the snapshots and the endpoints are being modified.
+func (s *Syncer) dryRun(ctx context.Context, request *DryRunRequest) {
+	if s.task == nil {
+		request.Done <- fmt.Errorf("task is not ready")
+		return
+	}
+	if s.stateStore.LastState().Status == model.TaskStatusProcessing {
+		request.Done <- fmt.Errorf("task is currently processing, please retry once it is idle")
+		return
+	}
+	var snapshots model.SnapshotFactory
+	if !request.Force {
+		snapshots = s.snapFactory
+	}
+	patch, fullScan, e := ComputeDryRun(ctx, s.task.Source, s.task.Target, s.task.Direction, s.task.Roots, s.task.Ignores, snapshots)
+	if e != nil {
+		request.Done <- e
+		return
+	}
+	request.Report = NewDryRunReport(s.uuid, s.getConf().Direction, patch, s.task.Source, s.task.Target)
+	request.Report.FullScan = fullScan
+	request.Done <- nil
+}
+
+// pruneTrash removes expired items from the task trash.
+func (s *Syncer) pruneTrash(ctx context.Context) {
+	if s.trash == nil {
+		return
+	}
+	if n, e := s.trash.Prune(); e != nil {
+		log.Logger(ctx).Error("Cannot prune trash: " + e.Error())
+	} else if n > 0 {
+		log.Logger(ctx).Info(fmt.Sprintf("Removed %d expired items from trash", n))
+	}
+}
+
+// resolveConflicts applies the conflict policy in background, as it loads, moves and walks nodes on the endpoints.
+// The patch is then sent back to dispatchStatus with the conflicts statuses, and the resolution patches are
+// processed, reporting to dispatchStatus as well.
+func (s *Syncer) resolveConflicts(ctx context.Context, resolver *ConflictResolver, patch merger.Patch) {
+	s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Resolving conflicts with policy "+resolver.policy), model.TaskStatusProcessing)
+	go func() {
+		resolutions := resolver.Resolve(ctx, patch)
+		select {
+		case s.resolvedPatches <- patch:
+		case <-s.statusDone:
+			return
+		}
+		for _, r := range resolutions {
+			s.task.ReApplyPatch(ctx, r)
+		}
+	}()
+}
+
+// pruneConflicts removes in background the open conflicts that cleared themselves since they were recorded,
+// once a patch is successfully processed.
+func (s *Syncer) pruneConflicts(ctx context.Context, patch merger.Patch) {
+	if s.task == nil {
+		return
+	}
+	left, ok1 := model.AsPathSyncSource(s.task.Source)
+	right, ok2 := model.AsPathSyncSource(s.task.Target)
+	if !ok1 || !ok2 {
+		return
+	}
+	store := s.conflictStore
+	go func() {
+		n, e := store.Prune(patch, func(conflict *endpoint.Conflict) bool {
+			return conflictCleared(ctx, left, right, conflict.Path)
+		})
+		if e != nil {
+			log.Logger(ctx).Error("Cannot prune conflicts: " + e.Error())
+		} else if n > 0 {
+			log.Logger(ctx).Info(fmt.Sprintf("Removed %d conflicts that are now cleared", n))
+		}
+	}()
+}
+
+// resolveConflict applies a manual resolution to an open conflict, and processes the resulting patches
+// in background to only sync the conflicting path. It is called outside of dispatchBus.
+func (s *Syncer) resolveConflict(ctx context.Context, request *ConflictResolveRequest) error {
+	if s.task == nil || s.conflictStore == nil {
+		return fmt.Errorf("task is not ready")
+	}
+	policy, ok := conflictActions[request.Action]
+	if !ok {
+		return fmt.Errorf("unsupported action %s, please use one of keep-left, keep-right, keep-both", request.Action)
+	}
+	conflict, e := s.conflictStore.Get(request.ID)
+	if e != nil {
+		return e
+	}
+	resolutions, msg, e := NewConflictResolver(policy, s.task.Source, s.task.Target).ResolvePath(ctx, conflict.Path)
+	if e != nil {
+		return e
+	}
+	log.Logger(ctx).Info("Conflict on " + conflict.Path + " manually resolved: " + msg)
+	if e := s.conflictStore.Delete(conflict); e != nil {
+		return e
+	}
+	if remaining, e := s.conflictStore.List(); e == nil && len(remaining) == 0 {
+		// Do not re-apply the patch that registered the conflicts
+		s.lastPatch = nil
+	}
+	s.stateStore.UpdateProcessStatus(model.NewProcessingStatus("Applying conflict resolution on "+conflict.Path), model.TaskStatusProcessing)
+	go func() {
+		for _, r := range resolutions {
+			s.task.ReApplyPatch(ctx, r)
+		}
+	}()
+	return nil
+}
+
 func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 
 	bus := GetBus()
@@ -321,10 +589,16 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 				close(s.patchStatus)
 				s.cmd.Stop()
 			}
+			for _, ep := range s.endpoints {
+				endpoint.CloseEndpoint(ep)
+			}
 			if s.patchStore != nil {
 				log.Logger(ctx).Info("-- Stopping PatchStore")
 				s.patchStore.Stop()
 			}
+			if s.conflictStore != nil {
+				s.conflictStore.Stop()
+			}
 			if s.snapFactory != nil {
 				if s.cleanAllAfterStop {
 					log.Logger(ctx).Info("-- Cleaning Snapshots")
@@ -401,28 +675,30 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 			case MessageInterrupt:
 				s.cmd.Publish(model.Interrupt)
 			case MessagePause:
-				// Stop watching for events
-				s.task.Pause(ctx)
-				s.taskPaused = true
-				state := s.stateStore.UpdateSyncStatus(model.TaskStatusPaused)
-				config.Default().UpdateTaskPaused(s.uuid, true)
-				bus.Pub(state, TopicState)
+				s.pause(ctx)
 			case MessageResume:
-				// Start watching for events
-				if s.watches {
-					s.task.Resume(ctx)
-				}
-				s.taskPaused = false
-				state := s.stateStore.UpdateSyncStatus(model.TaskStatusIdle)
-				config.Default().UpdateTaskPaused(s.uuid, false)
-				bus.Pub(state, TopicState)
-				s.task.Run(ctx, false, false)
+				s.resume(ctx)
 			case MessageDisable:
 				// Disable Task
 				s.task.Shutdown()
 				state := s.stateStore.UpdateSyncStatus(model.TaskStatusDisabled)
 				bus.Pub(state, TopicState)
 			default:
+				if request, ok := message.(*DryRunRequest); ok {
+					go s.dryRun(ctx, request)
+					break
+				}
+				if request, ok := message.(*ConflictResolveRequest); ok {
+					// Resolution loads, moves and walks nodes on the endpoints, do not block the bus
+					go func() {
+						request.Done <- s.resolveConflict(ctx, request)
+					}()
+					break
+				}
+				if request, ok := message.(*TaskUpdateRequest); ok {
+					s.applyUpdate(ctx, request)
+					break
+				}
 				// Received info about an Endpoint - TODO : move this inside StateStore
 				if status, ok := message.(*model.EndpointStatus); ok {
 					initialConnState := s.stateStore.BothConnected()
@@ -476,19 +752,69 @@ func (s *Syncer) dispatchBus(ctx context.Context, done chan bool) {
 
 }
 
+// pause stops watching for events.
+func (s *Syncer) pause(ctx context.Context) {
+	s.task.Pause(ctx)
+	s.taskPaused = true
+	state := s.stateStore.UpdateSyncStatus(model.TaskStatusPaused)
+	config.Default().UpdateTaskPaused(s.uuid, true)
+	GetBus().Pub(state, TopicState)
+}
+
+// resume starts watching for events again and triggers a sync loop.
+func (s *Syncer) resume(ctx context.Context) {
+	if s.watches {
+		s.task.Resume(ctx)
+	}
+	s.taskPaused = false
+	state := s.stateStore.UpdateSyncStatus(model.TaskStatusIdle)
+	config.Default().UpdateTaskPaused(s.uuid, false)
+	GetBus().Pub(state, TopicState)
+	s.task.Run(ctx, false, false)
+}
+
+// getConf returns the current task configuration.
+func (s *Syncer) getConf() *config.Task {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
+}
+
+// applyUpdate switches to the new task configuration in place, and pauses or resumes the task if required.
+func (s *Syncer) applyUpdate(ctx context.Context, request *TaskUpdateRequest) {
+	s.confLock.Lock()
+	s.conf = request.Task
+	s.confLock.Unlock()
+	GetBus().Pub(s.stateStore.UpdateConfig(request.Task), TopicState)
+	if s.task == nil || request.Task.RealtimePaused == s.taskPaused {
+		return
+	}
+	if request.Task.RealtimePaused {
+		s.pause(ctx)
+	} else {
+		s.resume(ctx)
+	}
+}
+
 // Serve implements supervisor interface.
 func (s *Syncer) Serve() {
 
 	ctx := s.serviceCtx
 	done := make(chan bool, 1)
 	done2 := make(chan bool, 1)
+	// busDone is closed once resources are released, so that supervisor can wait for the
+	// task to be fully stopped before starting it again
+	busDone := make(chan struct{})
 
 	if s.task != nil {
 
 		log.Logger(ctx).Info("Starting Sync Service")
 
 		go s.dispatchStatus(ctx)
-		go s.dispatchBus(ctx, done)
+		go func() {
+			s.dispatchBus(ctx, done)
+			close(busDone)
+		}()
 		go s.dispatchPublishBus(ctx, done2)
 
 		s.task.SetupCmd(s.cmd)
@@ -516,8 +842,11 @@ func (s *Syncer) Serve() {
 
 		log.Logger(ctx).Info("Syncer did not setup Task properly, do nothing")
 
-		go s.dispatchBus(ctx, done)
-		go s.dispatchPublishBus(ctx, done)
+		go func() {
+			s.dispatchBus(ctx, done)
+			close(busDone)
+		}()
+		go s.dispatchPublishBus(ctx, done2)
 
 	}
 
@@ -526,6 +855,7 @@ func (s *Syncer) Serve() {
 		case <-s.stop:
 			done2 <- true
 			done <- true
+			<-busDone
 			return
 		}
 	}
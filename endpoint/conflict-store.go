@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"go.etcd.io/bbolt"
+
+	"github.com/pydio/cells/v4/common/sync/merger"
+)
+
+var (
+	conflictBucket = []byte("conflicts")
+)
+
+// Conflict is an open conflict detected during a sync, waiting for a resolution.
+type Conflict struct {
+	ID           string
+	Path         string
+	ConflictType merger.ConflictType
+	PatchUUID    string
+	Detected     time.Time
+	LeftOp       json.RawMessage `json:",omitempty"`
+	RightOp      json.RawMessage `json:",omitempty"`
+}
+
+type conflictSorter []*Conflict
+
+func (c conflictSorter) Len() int {
+	return len(c)
+}
+func (c conflictSorter) Less(i, j int) bool {
+	return c[i].Detected.Before(c[j].Detected)
+}
+func (c conflictSorter) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// ConflictStore keeps the list of open conflicts of a sync task. It is based on BoltDB and
+// conflicts are indexed by path, so that a conflict detected twice is only listed once.
+type ConflictStore struct {
+	db *bbolt.DB
+}
+
+// NewConflictStore opens a new ConflictStore
+func NewConflictStore(folderPath string) (*ConflictStore, error) {
+	options := *bbolt.DefaultOptions
+	options.Timeout = 5 * time.Second
+	db, err := bbolt.Open(filepath.Join(folderPath, "conflicts"), 0644, &options)
+	if err != nil {
+		return nil, err
+	}
+	return &ConflictStore{db: db}, nil
+}
+
+// Record registers the conflict operations of the patch that are not resolved yet. Open conflicts are removed
+// when the patch resolved them with a policy or successfully processed their path.
+func (c *ConflictStore) Record(patch merger.Patch) error {
+	var conflicts []*Conflict
+	cleared := make(map[string]bool)
+	patch.WalkOperations(nil, func(op merger.Operation) {
+		if op.Type() != merger.OpConflict && op.IsProcessed() && op.Error() == nil {
+			cleared[strings.Trim(op.GetRefPath(), "/")] = true
+		}
+	})
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		if st := op.GetStatus(); st != nil && !st.IsError() {
+			cleared[strings.Trim(op.GetNode().GetPath(), "/")] = true
+			continue
+		}
+		conflict := &Conflict{
+			ID:        uuid.New(),
+			Path:      op.GetNode().GetPath(),
+			PatchUUID: patch.GetUUID(),
+			Detected:  time.Now(),
+		}
+		if co, ok := op.(merger.ConflictOperation); ok {
+			var left, right merger.Operation
+			conflict.ConflictType, left, right = co.ConflictInfo()
+			if left != nil {
+				conflict.LeftOp, _ = json.Marshal(left)
+			}
+			if right != nil {
+				conflict.RightOp, _ = json.Marshal(right)
+			}
+		}
+		delete(cleared, strings.Trim(conflict.Path, "/"))
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) == 0 && len(cleared) == 0 {
+		return nil
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(conflictBucket)
+		if err != nil {
+			return err
+		}
+		var resolved [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if cleared[strings.Trim(string(k), "/")] {
+				resolved = append(resolved, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range resolved {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, conflict := range conflicts {
+			if existing := bucket.Get([]byte(conflict.Path)); existing != nil {
+				// Keep original ID and detection time
+				var old Conflict
+				if e := json.Unmarshal(existing, &old); e == nil {
+					conflict.ID = old.ID
+					conflict.Detected = old.Detected
+				}
+			}
+			data, err := json.Marshal(conflict)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(conflict.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Prune removes the open conflicts that are not listed in the patch and for which isCleared returns true.
+// It is used to find conflicts that cleared themselves, e.g. when both sides were made identical.
+func (c *ConflictStore) Prune(patch merger.Patch, isCleared func(conflict *Conflict) bool) (int, error) {
+	conflicting := make(map[string]bool)
+	for _, op := range patch.OperationsByType([]merger.OperationType{merger.OpConflict}) {
+		conflicting[strings.Trim(op.GetNode().GetPath(), "/")] = true
+	}
+	conflicts, e := c.List()
+	if e != nil {
+		return 0, e
+	}
+	var count int
+	for _, conflict := range conflicts {
+		if conflicting[strings.Trim(conflict.Path, "/")] || !isCleared(conflict) {
+			continue
+		}
+		if e := c.Delete(conflict); e != nil {
+			return count, e
+		}
+		count++
+	}
+	return count, nil
+}
+
+// List returns all open conflicts, oldest first.
+func (c *ConflictStore) List() (conflicts []*Conflict, e error) {
+	e = c.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(conflictBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var conflict Conflict
+			if err := json.Unmarshal(v, &conflict); err != nil {
+				return err
+			}
+			conflicts = append(conflicts, &conflict)
+			return nil
+		})
+	})
+	sort.Sort(conflictSorter(conflicts))
+	return
+}
+
+// Get finds an open conflict by its ID.
+func (c *ConflictStore) Get(id string) (*Conflict, error) {
+	conflicts, e := c.List()
+	if e != nil {
+		return nil, e
+	}
+	for _, conflict := range conflicts {
+		if conflict.ID == id {
+			return conflict, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find conflict %s", id)
+}
+
+// Delete removes a conflict from the list, once it is resolved.
+func (c *ConflictStore) Delete(conflict *Conflict) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(conflictBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(conflict.Path))
+	})
+}
+
+// Stop closes the DB.
+func (c *ConflictStore) Stop() {
+	c.db.Close()
+}
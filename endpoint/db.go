@@ -0,0 +1,516 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pydio/cells/v4/common/proto/tree"
+	errors2 "github.com/pydio/cells/v4/common/service/errors"
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/utils/hasher"
+	"github.com/pydio/cells/v4/common/utils/hasher/simd"
+	"github.com/pydio/cells/v4/common/utils/uuid"
+)
+
+var (
+	dbNodesBucket = []byte("nodes")
+	dbRefsBucket  = []byte("refs")
+	dbMetaBucket  = []byte("meta")
+	dbRootKey     = []byte("root")
+
+	dbStores     = map[string]*dbStore{}
+	dbStoresLock sync.Mutex
+)
+
+// DBClient is a sync endpoint persisting the tree in a local store, for long-lived staging syncs and integration
+// tests that do not require a server. Nodes are indexed by path in a bolt database and files contents are stored in
+// a content-addressed blobs directory, where each blob is named after the content hash, which is also the node etag.
+// Blobs are shared by identical files and removed when no node references them anymore.
+// The store is only modified through this endpoint, so Watch never emits events.
+type DBClient struct {
+	store   *dbStore
+	options model.EndpointOptions
+	closed  sync.Once
+}
+
+// dbStore is shared by all the clients opened on the same folder, as the bolt database cannot be opened twice.
+type dbStore struct {
+	folderPath string
+	db         *bbolt.DB
+	clients    int
+	// blobsLock prevents removing a blob that is being referenced again by a concurrent write.
+	blobsLock sync.Mutex
+}
+
+// NewDBClient opens the store located in folderPath, creating it if necessary.
+func NewDBClient(folderPath string, options model.EndpointOptions) (*DBClient, error) {
+	if folderPath == "" {
+		return nil, fmt.Errorf("please provide a path for the store")
+	}
+	folderPath = filepath.Clean(folderPath)
+	dbStoresLock.Lock()
+	defer dbStoresLock.Unlock()
+	store, ok := dbStores[folderPath]
+	if !ok {
+		var e error
+		if store, e = openDBStore(folderPath); e != nil {
+			return nil, e
+		}
+		dbStores[folderPath] = store
+	}
+	store.clients++
+	return &DBClient{store: store, options: options}, nil
+}
+
+func openDBStore(folderPath string) (*dbStore, error) {
+	if e := os.MkdirAll(filepath.Join(folderPath, "blobs"), 0755); e != nil {
+		return nil, e
+	}
+	// Remove the temporary files of interrupted writes
+	if tmps, e := filepath.Glob(filepath.Join(folderPath, "blobs", "tmp-*")); e == nil {
+		for _, tmp := range tmps {
+			_ = os.Remove(tmp)
+		}
+	}
+	options := *bbolt.DefaultOptions
+	options.Timeout = 5 * time.Second
+	db, e := bbolt.Open(filepath.Join(folderPath, "index"), 0644, &options)
+	if e != nil {
+		return nil, e
+	}
+	e = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{dbNodesBucket, dbRefsBucket, dbMetaBucket} {
+			if _, er := tx.CreateBucketIfNotExists(name); er != nil {
+				return er
+			}
+		}
+		meta := tx.Bucket(dbMetaBucket)
+		if meta.Get(dbRootKey) == nil {
+			return meta.Put(dbRootKey, []byte(uuid.New()))
+		}
+		return nil
+	})
+	if e != nil {
+		db.Close()
+		return nil, e
+	}
+	return &dbStore{folderPath: folderPath, db: db}, nil
+}
+
+// Close releases the store, that is closed when no client uses it anymore.
+func (c *DBClient) Close() error {
+	var e error
+	c.closed.Do(func() {
+		dbStoresLock.Lock()
+		defer dbStoresLock.Unlock()
+		c.store.clients--
+		if c.store.clients == 0 {
+			delete(dbStores, c.store.folderPath)
+			e = c.store.db.Close()
+		}
+	})
+	return e
+}
+
+// GetEndpointInfo returns info about this endpoint.
+func (c *DBClient) GetEndpointInfo() model.EndpointInfo {
+	return model.EndpointInfo{
+		URI:                   "db://" + filepath.ToSlash(c.store.folderPath),
+		RequiresFoldersRescan: true,
+	}
+}
+
+// LoadNode loads a node from the index.
+func (c *DBClient) LoadNode(ctx context.Context, p string, extendedStats ...bool) (node tree.N, err error) {
+	p = strings.Trim(p, "/")
+	err = c.store.db.View(func(tx *bbolt.Tx) error {
+		if p == "" {
+			node = tree.LightNode(tree.NodeType_COLLECTION, string(tx.Bucket(dbMetaBucket).Get(dbRootKey)), "", "", 0, 0, 0777)
+			return nil
+		}
+		var e error
+		node, e = dbGetNode(tx, p)
+		return e
+	})
+	return
+}
+
+// Walk lists the nodes sorted by path.
+func (c *DBClient) Walk(ctx context.Context, walkFunc model.WalkNodesFunc, root string, recursive bool) error {
+	root = strings.Trim(root, "/")
+	var prefix []byte
+	if root != "" {
+		prefix = []byte(root + "/")
+	}
+	var nodes []tree.N
+	e := c.store.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(dbNodesBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			if !recursive && bytes.Contains(k[len(prefix):], []byte("/")) {
+				continue
+			}
+			node, er := dbUnmarshal(v)
+			if er != nil {
+				return er
+			}
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	if e != nil {
+		return walkFunc("", nil, e)
+	}
+	for _, node := range nodes {
+		if e := walkFunc(node.GetPath(), node, nil); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Watch returns a watcher that never emits events, as the store is only modified through this endpoint.
+func (c *DBClient) Watch(recursivePath string) (*model.WatchObject, error) {
+	eventChan := make(chan model.EventInfo)
+	errorChan := make(chan error)
+	doneChan := make(chan bool)
+	go func() {
+		<-doneChan
+		close(eventChan)
+		close(errorChan)
+	}()
+	return &model.WatchObject{
+		EventInfoChan: eventChan,
+		ErrorChan:     errorChan,
+		DoneChan:      doneChan,
+	}, nil
+}
+
+// CreateNode indexes a node and its missing parents. Folders without uuid receive a new one.
+func (c *DBClient) CreateNode(ctx context.Context, node tree.N, updateIfExists bool) error {
+	c.store.blobsLock.Lock()
+	defer c.store.blobsLock.Unlock()
+	return c.indexNode(node, updateIfExists)
+}
+
+// indexNode stores a node and updates the blobs references. It must be called with blobsLock held.
+func (c *DBClient) indexNode(node tree.N, updateIfExists bool) error {
+	p := strings.Trim(node.GetPath(), "/")
+	if p == "" {
+		return nil
+	}
+	var released []string
+	e := c.store.db.Update(func(tx *bbolt.Tx) error {
+		existing, er := dbGetNode(tx, p)
+		if er == nil && !updateIfExists {
+			return nil
+		}
+		if node.IsLeaf() && node.GetEtag() != "" {
+			if e := dbAddRef(tx, node.GetEtag()); e != nil {
+				return e
+			}
+		}
+		if existing != nil && existing.IsLeaf() && dbReleaseRef(tx, existing.GetEtag()) {
+			released = append(released, existing.GetEtag())
+		}
+		uid := node.GetUuid()
+		if uid == "" && existing != nil {
+			uid = existing.GetUuid()
+		} else if uid == "" && !node.IsLeaf() {
+			uid = uuid.New()
+		}
+		if e := dbCreateParents(tx, p); e != nil {
+			return e
+		}
+		return dbPutNode(tx, tree.LightNode(node.GetType(), uid, p, node.GetEtag(), node.GetSize(), node.GetMTime(), node.GetMode()))
+	})
+	if e == nil {
+		c.store.removeBlobs(released)
+	}
+	return e
+}
+
+// DeleteNode removes a node and its children from the index, and the blobs that are not referenced anymore.
+func (c *DBClient) DeleteNode(ctx context.Context, p string) error {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return fmt.Errorf("cannot delete the store root")
+	}
+	var released []string
+	c.store.blobsLock.Lock()
+	defer c.store.blobsLock.Unlock()
+	e := c.store.db.Update(func(tx *bbolt.Tx) error {
+		var er error
+		released, er = dbDeleteBranch(tx, p)
+		return er
+	})
+	if e == nil {
+		c.store.removeBlobs(released)
+	}
+	return e
+}
+
+// MoveNode moves a node and its children in the index. An existing node at newPath is replaced, and the blobs
+// that are not referenced anymore are removed.
+func (c *DBClient) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	oldPath, newPath = strings.Trim(oldPath, "/"), strings.Trim(newPath, "/")
+	if oldPath == newPath {
+		return nil
+	}
+	if newPath == "" || strings.HasPrefix(newPath, oldPath+"/") || strings.HasPrefix(oldPath, newPath+"/") {
+		return fmt.Errorf("cannot move %s to %s", oldPath, newPath)
+	}
+	var released []string
+	c.store.blobsLock.Lock()
+	defer c.store.blobsLock.Unlock()
+	e := c.store.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dbNodesBucket)
+		keys := dbBranchKeys(tx, oldPath)
+		if len(keys) == 0 {
+			return errors2.NotFound("not.found", "node not found in store %s", oldPath)
+		}
+		var er error
+		if released, er = dbDeleteBranch(tx, newPath); er != nil {
+			return er
+		}
+		if e := dbCreateParents(tx, newPath); e != nil {
+			return e
+		}
+		for _, k := range keys {
+			node, er := dbUnmarshal(b.Get(k))
+			if er != nil {
+				return er
+			}
+			node.UpdatePath(newPath + strings.TrimPrefix(string(k), oldPath))
+			if er := b.Delete(k); er != nil {
+				return er
+			}
+			if er := dbPutNode(tx, node); er != nil {
+				return er
+			}
+		}
+		return nil
+	})
+	if e == nil {
+		c.store.removeBlobs(released)
+	}
+	return e
+}
+
+// GetReaderOn opens the blob of a file.
+func (c *DBClient) GetReaderOn(ctx context.Context, p string) (io.ReadCloser, error) {
+	node, e := c.LoadNode(ctx, p)
+	if e != nil {
+		return nil, e
+	}
+	if !node.IsLeaf() {
+		return nil, fmt.Errorf("%s is not a file", p)
+	}
+	return os.Open(c.store.blobPath(node.GetEtag()))
+}
+
+// GetWriterOn returns a writer storing the content in a temporary file, that is moved to the blobs directory and
+// indexed once the writer is closed.
+func (c *DBClient) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	tmp, e := os.CreateTemp(filepath.Join(c.store.folderPath, "blobs"), "tmp-")
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	h := hasher.NewBlockHash(simd.MD5(), hasher.DefaultBlockSize)
+	return &dbWriter{client: c, cancel: cancel, path: strings.Trim(p, "/"), tmp: tmp, hash: h, out: io.MultiWriter(tmp, h)}, nil, nil, nil
+}
+
+// dbWriter hashes the content while it is written.
+type dbWriter struct {
+	client *DBClient
+	cancel context.Context
+	path   string
+	tmp    *os.File
+	hash   *hasher.BlockHash
+	out    io.Writer
+	size   int64
+}
+
+// Write writes to the temporary file.
+func (w *dbWriter) Write(p []byte) (int, error) {
+	n, e := w.out.Write(p)
+	w.size += int64(n)
+	return n, e
+}
+
+// Close stores the blob and indexes the file, unless the transfer was cancelled.
+func (w *dbWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	if e := w.tmp.Close(); e != nil {
+		return e
+	}
+	if e := w.cancel.Err(); e != nil {
+		return e
+	}
+	etag := hex.EncodeToString(w.hash.Sum(nil))
+	store := w.client.store
+	store.blobsLock.Lock()
+	defer store.blobsLock.Unlock()
+	target := store.blobPath(etag)
+	if _, e := os.Stat(target); e != nil {
+		if e := os.MkdirAll(filepath.Dir(target), 0755); e != nil {
+			return e
+		}
+		if e := os.Rename(w.tmp.Name(), target); e != nil {
+			return e
+		}
+	}
+	return w.client.indexNode(tree.LightNode(tree.NodeType_LEAF, "", w.path, etag, w.size, time.Now().Unix(), 0666), true)
+}
+
+func (s *dbStore) blobPath(etag string) string {
+	if len(etag) < 2 {
+		return filepath.Join(s.folderPath, "blobs", etag)
+	}
+	return filepath.Join(s.folderPath, "blobs", etag[:2], etag)
+}
+
+// removeBlobs deletes the blobs that are not referenced anymore. It must be called with blobsLock held.
+func (s *dbStore) removeBlobs(etags []string) {
+	for _, etag := range etags {
+		_ = os.Remove(s.blobPath(etag))
+	}
+}
+
+func dbMarshal(node tree.N) ([]byte, error) {
+	store := node.AsProto()
+	store.MetaStore = nil
+	return proto.Marshal(store)
+}
+
+func dbUnmarshal(value []byte) (tree.N, error) {
+	var n tree.Node
+	if e := proto.Unmarshal(value, &n); e != nil {
+		return nil, e
+	}
+	return &n, nil
+}
+
+func dbGetNode(tx *bbolt.Tx, p string) (tree.N, error) {
+	value := tx.Bucket(dbNodesBucket).Get([]byte(p))
+	if value == nil {
+		return nil, errors2.NotFound("not.found", "node not found in store %s", p)
+	}
+	return dbUnmarshal(value)
+}
+
+func dbPutNode(tx *bbolt.Tx, node tree.N) error {
+	data, e := dbMarshal(node)
+	if e != nil {
+		return e
+	}
+	return tx.Bucket(dbNodesBucket).Put([]byte(node.GetPath()), data)
+}
+
+// dbCreateParents indexes the missing parent folders of a path.
+func dbCreateParents(tx *bbolt.Tx, p string) error {
+	b := tx.Bucket(dbNodesBucket)
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if b.Get([]byte(dir)) != nil {
+			return nil
+		}
+		if e := dbPutNode(tx, tree.LightNode(tree.NodeType_COLLECTION, uuid.New(), dir, "", 0, time.Now().Unix(), 0777)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// dbDeleteBranch removes a node and its children from the index, and returns the etags of the blobs
+// that are not referenced anymore.
+func dbDeleteBranch(tx *bbolt.Tx, p string) (released []string, e error) {
+	b := tx.Bucket(dbNodesBucket)
+	for _, k := range dbBranchKeys(tx, p) {
+		node, er := dbUnmarshal(b.Get(k))
+		if er != nil {
+			return nil, er
+		}
+		if node.IsLeaf() && dbReleaseRef(tx, node.GetEtag()) {
+			released = append(released, node.GetEtag())
+		}
+		if er := b.Delete(k); er != nil {
+			return nil, er
+		}
+	}
+	return
+}
+
+// dbBranchKeys lists the keys of a node and its children.
+func dbBranchKeys(tx *bbolt.Tx, p string) (keys [][]byte) {
+	b := tx.Bucket(dbNodesBucket)
+	if b.Get([]byte(p)) == nil {
+		return
+	}
+	keys = append(keys, []byte(p))
+	prefix := []byte(p + "/")
+	cursor := b.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	return
+}
+
+func dbAddRef(tx *bbolt.Tx, etag string) error {
+	b := tx.Bucket(dbRefsBucket)
+	var count uint64
+	if v := b.Get([]byte(etag)); v != nil {
+		count = binary.BigEndian.Uint64(v)
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count+1)
+	return b.Put([]byte(etag), value)
+}
+
+// dbReleaseRef decrements the references count of a blob, and returns true if it is not referenced anymore.
+func dbReleaseRef(tx *bbolt.Tx, etag string) bool {
+	b := tx.Bucket(dbRefsBucket)
+	v := b.Get([]byte(etag))
+	if v == nil {
+		return false
+	}
+	count := binary.BigEndian.Uint64(v)
+	if count <= 1 {
+		_ = b.Delete([]byte(etag))
+		return true
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count-1)
+	_ = b.Put([]byte(etag), value)
+	return false
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// EncryptedScheme is the prefix added to the scheme of any endpoint URI to encrypt its content, e.g. enc+s3://...
+// The name of the key stored in the keyring is passed with the "key" query parameter and defaults to DefaultEncryptionKey.
+const (
+	EncryptedScheme      = "enc+"
+	DefaultEncryptionKey = "default"
+)
+
+// EncryptedEndpoint decorates another endpoint to encrypt files contents and names before they are stored. The
+// wrapped endpoint only sees encrypted paths, while this endpoint exposes the decrypted tree, with plaintext sizes
+// and hashes so that it can be compared to any other endpoint.
+// As encrypted names are longer than the original ones, names are limited to about 130 bytes on most filesystems.
+type EncryptedEndpoint struct {
+	inner        model.Endpoint
+	encryption   *Encryption
+	options      model.EndpointOptions
+	refHashStore model.PathSyncSource
+}
+
+// NewEncryptedEndpoint wraps an endpoint with the encryption derived from masterKey. The wrapped endpoint must be able
+// to read and write contents.
+func NewEncryptedEndpoint(inner model.Endpoint, masterKey []byte, options model.EndpointOptions) (*EncryptedEndpoint, error) {
+	if _, ok := inner.(model.DataSyncSource); !ok {
+		return nil, fmt.Errorf("endpoint %s cannot be encrypted", inner.GetEndpointInfo().URI)
+	}
+	if _, ok := inner.(model.DataSyncTarget); !ok {
+		return nil, fmt.Errorf("endpoint %s cannot be encrypted", inner.GetEndpointInfo().URI)
+	}
+	enc, e := NewEncryption(masterKey)
+	if e != nil {
+		return nil, e
+	}
+	return &EncryptedEndpoint{
+		inner:      inner,
+		encryption: enc,
+		options:    options,
+	}, nil
+}
+
+func (c *EncryptedEndpoint) source() model.DataSyncSource {
+	return c.inner.(model.DataSyncSource)
+}
+
+func (c *EncryptedEndpoint) target() model.DataSyncTarget {
+	return c.inner.(model.DataSyncTarget)
+}
+
+// GetEndpointInfo returns info about the wrapped endpoint, with the encrypted scheme.
+func (c *EncryptedEndpoint) GetEndpointInfo() model.EndpointInfo {
+	info := c.inner.GetEndpointInfo()
+	info.URI = EncryptedScheme + info.URI
+	return info
+}
+
+// SetRefHashStore passes a reference to a loaded snapshot, used to find the hash of unmodified files. The wrapped
+// endpoint receives a view of the snapshot with encrypted paths and sizes, so that it does not hash unmodified files.
+func (c *EncryptedEndpoint) SetRefHashStore(source model.PathSyncSource) {
+	c.refHashStore = source
+	if reader, ok := c.inner.(model.HashStoreReader); ok {
+		reader.SetRefHashStore(&encryptedRefStore{ref: source, encryption: c.encryption})
+	}
+}
+
+// LoadNode loads a node from the wrapped endpoint. The hash of files is computed if it cannot be found in the
+// reference snapshot, except in browse-only mode.
+func (c *EncryptedEndpoint) LoadNode(ctx context.Context, p string, extendedStats ...bool) (tree.N, error) {
+	p = strings.Trim(p, "/")
+	node, e := c.inner.LoadNode(ctx, c.encryption.EncryptPath(p), extendedStats...)
+	if e != nil {
+		return nil, e
+	}
+	return c.decryptNode(ctx, node, p, !c.options.BrowseOnly)
+}
+
+// ComputeChecksum decrypts the file to compute the hash of its plaintext.
+func (c *EncryptedEndpoint) ComputeChecksum(ctx context.Context, node tree.N) error {
+	hash, e := c.getFileHash(ctx, node.GetPath())
+	if e != nil {
+		return e
+	}
+	node.UpdateEtag(hash)
+	return nil
+}
+
+// Walk walks the wrapped endpoint and decrypts the paths. Names that cannot be decrypted were not created by this
+// endpoint and are ignored. The hash of modified files is left empty and is computed with ComputeChecksum.
+func (c *EncryptedEndpoint) Walk(ctx context.Context, walkFunc model.WalkNodesFunc, root string, recursive bool) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.source().Walk(ctx, func(p string, node tree.N, err error) error {
+		if err != nil {
+			return walkFunc(p, node, err)
+		}
+		plain, ok := c.decryptPath(p)
+		if !ok {
+			return nil
+		}
+		decrypted, er := c.decryptNode(ctx, node, plain, false)
+		if er != nil {
+			return walkFunc("", nil, er)
+		}
+		return walkFunc(plain, decrypted, nil)
+	}, c.encryption.EncryptPath(root), recursive)
+}
+
+// Watch forwards the events of the wrapped endpoint with decrypted paths and sizes.
+func (c *EncryptedEndpoint) Watch(recursivePath string) (*model.WatchObject, error) {
+	watch, e := c.source().Watch(c.encryption.EncryptPath(recursivePath))
+	if e != nil {
+		return nil, e
+	}
+	eventChan := make(chan model.EventInfo)
+	go func() {
+		defer close(eventChan)
+		for {
+			select {
+			case <-watch.DoneChan:
+				return
+			case event, ok := <-watch.EventInfoChan:
+				if !ok {
+					return
+				}
+				if !c.decryptEvent(&event) {
+					continue
+				}
+				select {
+				case eventChan <- event:
+				case <-watch.DoneChan:
+					return
+				}
+			}
+		}
+	}()
+	return &model.WatchObject{
+		EventInfoChan:  eventChan,
+		ErrorChan:      watch.ErrorChan,
+		DoneChan:       watch.DoneChan,
+		ConnectionInfo: watch.ConnectionInfo,
+	}, nil
+}
+
+// CreateNode creates the node at its encrypted path.
+func (c *EncryptedEndpoint) CreateNode(ctx context.Context, node tree.N, updateIfExists bool) error {
+	encrypted := tree.LightNode(node.GetType(), node.GetUuid(), c.encryption.EncryptPath(node.GetPath()), node.GetEtag(), node.GetSize(), node.GetMTime(), node.GetMode())
+	return c.target().CreateNode(ctx, encrypted, updateIfExists)
+}
+
+// DeleteNode deletes the node at its encrypted path.
+func (c *EncryptedEndpoint) DeleteNode(ctx context.Context, p string) error {
+	return c.target().DeleteNode(ctx, c.encryption.EncryptPath(p))
+}
+
+// MoveNode moves the node between encrypted paths. As names are encrypted deterministically, the content is not
+// re-encrypted.
+func (c *EncryptedEndpoint) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	return c.target().MoveNode(ctx, c.encryption.EncryptPath(oldPath), c.encryption.EncryptPath(newPath))
+}
+
+// GetReaderOn returns a reader decrypting the content of the file.
+func (c *EncryptedEndpoint) GetReaderOn(ctx context.Context, p string) (io.ReadCloser, error) {
+	r, e := c.source().GetReaderOn(ctx, c.encryption.EncryptPath(p))
+	if e != nil || isHiddenFile(p) {
+		return r, e
+	}
+	return c.encryption.DecryptReader(r), nil
+}
+
+// GetWriterOn returns a writer encrypting the content to the wrapped endpoint.
+func (c *EncryptedEndpoint) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	if isHiddenFile(p) {
+		return c.target().GetWriterOn(cancel, c.encryption.EncryptPath(p), targetSize)
+	}
+	w, writeDone, writeErr, e := c.target().GetWriterOn(cancel, c.encryption.EncryptPath(p), c.encryption.EncryptedSize(targetSize))
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	return c.encryption.EncryptWriter(w), writeDone, writeErr, nil
+}
+
+// Close releases the wrapped endpoint.
+func (c *EncryptedEndpoint) Close() error {
+	CloseEndpoint(c.inner)
+	return nil
+}
+
+// decryptPath decrypts a path of the wrapped endpoint, ignoring the temporary files and the names that cannot be decrypted.
+func (c *EncryptedEndpoint) decryptPath(p string) (string, bool) {
+	if strings.HasPrefix(path.Base(p), filesystem.SyncTmpPrefix) {
+		return "", false
+	}
+	plain, e := c.encryption.DecryptPath(p)
+	if e != nil {
+		log.Logger(context.Background()).Warn(fmt.Sprintf("Ignoring %s in encrypted endpoint: %s", p, e.Error()))
+		return "", false
+	}
+	return plain, true
+}
+
+// decryptNode builds the node exposed for a node of the wrapped endpoint, with the plaintext path, size and hash.
+func (c *EncryptedEndpoint) decryptNode(ctx context.Context, node tree.N, p string, computeHash bool) (tree.N, error) {
+	if !node.IsLeaf() || isHiddenFile(p) {
+		return tree.LightNode(node.GetType(), node.GetUuid(), p, node.GetEtag(), node.GetSize(), node.GetMTime(), node.GetMode()), nil
+	}
+	size := c.encryption.PlainSize(node.GetSize())
+	hash := refHash(ctx, c.refHashStore, p, size, time.Unix(node.GetMTime(), 0))
+	if hash == "" && computeHash {
+		var e error
+		if hash, e = c.getFileHash(ctx, p); e != nil {
+			return nil, e
+		}
+	}
+	return tree.LightNode(tree.NodeType_LEAF, node.GetUuid(), p, hash, size, node.GetMTime(), node.GetMode()), nil
+}
+
+// decryptEvent updates an event of the wrapped endpoint in place. It returns false if the event must be ignored.
+func (c *EncryptedEndpoint) decryptEvent(event *model.EventInfo) bool {
+	plain, ok := c.decryptPath(event.Path)
+	if !ok {
+		return false
+	}
+	event.Path = plain
+	event.Source = c
+	event.Etag = ""
+	if !event.Folder && !isHiddenFile(plain) {
+		event.Size = c.encryption.PlainSize(event.Size)
+	}
+	for _, n := range []*tree.N{&event.ScanSourceNode, &event.MoveSource, &event.MoveTarget} {
+		if *n == nil {
+			continue
+		}
+		if p, ok := c.decryptPath((*n).GetPath()); ok {
+			*n, _ = c.decryptNode(context.Background(), *n, p, false)
+		} else {
+			*n = nil
+		}
+	}
+	return true
+}
+
+func (c *EncryptedEndpoint) getFileHash(ctx context.Context, p string) (string, error) {
+	r, e := c.GetReaderOn(ctx, p)
+	if e != nil {
+		return "", e
+	}
+	defer r.Close()
+	return contentHash(r)
+}
+
+func isHiddenFile(p string) bool {
+	return path.Base(p) == common.PydioSyncHiddenFile
+}
+
+// encryptedRefStore exposes a reference snapshot with encrypted paths and sizes to the wrapped endpoint, so that it
+// can find that a file is unmodified. Only LoadNode is supported.
+type encryptedRefStore struct {
+	ref        model.PathSyncSource
+	encryption *Encryption
+}
+
+// LoadNode loads the snapshot node of an encrypted path.
+func (s *encryptedRefStore) LoadNode(ctx context.Context, p string, extendedStats ...bool) (tree.N, error) {
+	plain, e := s.encryption.DecryptPath(p)
+	if e != nil {
+		return nil, e
+	}
+	node, e := s.ref.LoadNode(ctx, plain)
+	if e != nil || !node.IsLeaf() || isHiddenFile(plain) {
+		return node, e
+	}
+	return tree.LightNode(tree.NodeType_LEAF, node.GetUuid(), p, node.GetEtag(), s.encryption.EncryptedSize(node.GetSize()), node.GetMTime(), node.GetMode()), nil
+}
+
+// GetEndpointInfo returns info about the snapshot.
+func (s *encryptedRefStore) GetEndpointInfo() model.EndpointInfo {
+	return s.ref.GetEndpointInfo()
+}
+
+// Walk is not supported.
+func (s *encryptedRefStore) Walk(context.Context, model.WalkNodesFunc, string, bool) error {
+	return fmt.Errorf("walk is not supported on encrypted reference store")
+}
+
+// Watch is not supported.
+func (s *encryptedRefStore) Watch(string) (*model.WatchObject, error) {
+	return nil, fmt.Errorf("watch is not supported on encrypted reference store")
+}
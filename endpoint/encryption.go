@@ -0,0 +1,324 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/pydio/cells/v4/common"
+)
+
+const (
+	// EncryptionKeySize is the size of the master keys used by encrypted endpoints.
+	EncryptionKeySize = 32
+	// encryptedChunkSize is the size of the plaintext chunks that are sealed independently.
+	encryptedChunkSize = 64 * 1024
+	encryptedMagic     = "CSE1"
+	noncePrefixSize    = 8
+	encryptedHeader    = len(encryptedMagic) + noncePrefixSize
+)
+
+var (
+	nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+	// ErrEncryptedContent is returned when a file cannot be decrypted, because it was modified or the key is wrong.
+	ErrEncryptedContent = errors.New("cannot decrypt content: wrong key or corrupted file")
+)
+
+// Encryption encrypts file contents with AES-256-GCM, in chunks so that files are streamed, and encrypts names
+// deterministically so that a given path is always stored under the same encrypted path. Keys for contents and names
+// are derived from a single master key.
+type Encryption struct {
+	content cipher.AEAD
+	names   cipher.AEAD
+	nameMac []byte
+}
+
+// NewEncryptionKey generates a random master key.
+func NewEncryptionKey() ([]byte, error) {
+	key := make([]byte, EncryptionKeySize)
+	if _, e := rand.Read(key); e != nil {
+		return nil, e
+	}
+	return key, nil
+}
+
+// NewEncryption derives the contents and names keys from a master key.
+func NewEncryption(masterKey []byte) (*Encryption, error) {
+	if len(masterKey) != EncryptionKeySize {
+		return nil, fmt.Errorf("invalid encryption key size %d, expected %d", len(masterKey), EncryptionKeySize)
+	}
+	derive := func(info string) ([]byte, error) {
+		k := make([]byte, EncryptionKeySize)
+		_, e := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte("cells-sync "+info)), k)
+		return k, e
+	}
+	newAEAD := func(info string) (cipher.AEAD, error) {
+		k, e := derive(info)
+		if e != nil {
+			return nil, e
+		}
+		block, e := aes.NewCipher(k)
+		if e != nil {
+			return nil, e
+		}
+		return cipher.NewGCM(block)
+	}
+	enc := &Encryption{}
+	var e error
+	if enc.content, e = newAEAD("contents"); e != nil {
+		return nil, e
+	}
+	if enc.names, e = newAEAD("names"); e != nil {
+		return nil, e
+	}
+	if enc.nameMac, e = derive("names mac"); e != nil {
+		return nil, e
+	}
+	return enc, nil
+}
+
+// EncryptName encrypts a file name. The nonce is derived from the name itself, so the result is deterministic.
+// The folders hidden files are left as is, as they are managed by the endpoints themselves.
+func (enc *Encryption) EncryptName(name string) string {
+	if name == "" || name == common.PydioSyncHiddenFile {
+		return name
+	}
+	mac := hmac.New(sha256.New, enc.nameMac)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:enc.names.NonceSize()]
+	sealed := enc.names.Seal(nonce, nonce, []byte(name), nil)
+	return strings.ToLower(nameEncoding.EncodeToString(sealed))
+}
+
+// DecryptName decrypts a name produced by EncryptName.
+func (enc *Encryption) DecryptName(name string) (string, error) {
+	if name == "" || name == common.PydioSyncHiddenFile {
+		return name, nil
+	}
+	sealed, e := nameEncoding.DecodeString(strings.ToUpper(name))
+	if e != nil || len(sealed) < enc.names.NonceSize()+enc.names.Overhead() {
+		return "", fmt.Errorf("%s is not an encrypted name", name)
+	}
+	nonceSize := enc.names.NonceSize()
+	plain, e := enc.names.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if e != nil {
+		return "", fmt.Errorf("cannot decrypt name %s", name)
+	}
+	return string(plain), nil
+}
+
+// EncryptPath encrypts each segment of a path.
+func (enc *Encryption) EncryptPath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = enc.EncryptName(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// DecryptPath decrypts each segment of a path.
+func (enc *Encryption) DecryptPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return p, nil
+	}
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		plain, e := enc.DecryptName(s)
+		if e != nil {
+			return "", e
+		}
+		segments[i] = plain
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// EncryptedSize returns the size of the encrypted content for a given plaintext size.
+func (enc *Encryption) EncryptedSize(size int64) int64 {
+	if size < 0 {
+		return size
+	}
+	chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptedHeader) + size + chunks*int64(enc.content.Overhead())
+}
+
+// PlainSize returns the size of the plaintext for a given encrypted content size.
+func (enc *Encryption) PlainSize(size int64) int64 {
+	body := size - int64(encryptedHeader)
+	if body <= 0 {
+		return 0
+	}
+	sealedChunk := int64(encryptedChunkSize + enc.content.Overhead())
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	return body - chunks*int64(enc.content.Overhead())
+}
+
+func (enc *Encryption) nonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, enc.content.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	return nonce
+}
+
+// EncryptWriter returns a writer encrypting to out. It must be closed to write the last chunk, and closes out.
+func (enc *Encryption) EncryptWriter(out io.WriteCloser) io.WriteCloser {
+	return &encryptWriter{enc: enc, out: out}
+}
+
+// DecryptReader returns a reader decrypting in. Read returns ErrEncryptedContent if the content was modified or truncated.
+func (enc *Encryption) DecryptReader(in io.ReadCloser) io.ReadCloser {
+	return &decryptReader{enc: enc, in: in, buffered: bufio.NewReaderSize(in, encryptedChunkSize+enc.content.Overhead())}
+}
+
+// encryptWriter seals the content by chunks. Each chunk nonce is made of a random prefix and a counter, and the last
+// chunk is authenticated as such, so that chunks cannot be reordered and the content cannot be truncated.
+type encryptWriter struct {
+	enc     *Encryption
+	out     io.WriteCloser
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (w *encryptWriter) seal(chunk []byte, final bool) error {
+	if w.prefix == nil {
+		w.prefix = make([]byte, noncePrefixSize)
+		if _, e := rand.Read(w.prefix); e != nil {
+			return e
+		}
+		if _, e := w.out.Write(append([]byte(encryptedMagic), w.prefix...)); e != nil {
+			return e
+		}
+	}
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	sealed := w.enc.content.Seal(nil, w.enc.nonce(w.prefix, w.counter), chunk, ad)
+	w.counter++
+	_, e := w.out.Write(sealed)
+	return e
+}
+
+// Write buffers data and seals all complete chunks but the last one, which may be the final chunk.
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > encryptedChunkSize {
+		if e := w.seal(w.buf[:encryptedChunkSize], false); e != nil {
+			return 0, e
+		}
+		w.buf = w.buf[encryptedChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close seals the final chunk and closes the underlying writer.
+func (w *encryptWriter) Close() error {
+	if e := w.seal(w.buf, true); e != nil {
+		w.out.Close()
+		return e
+	}
+	w.buf = nil
+	return w.out.Close()
+}
+
+type decryptReader struct {
+	enc      *Encryption
+	in       io.ReadCloser
+	buffered *bufio.Reader
+	prefix   []byte
+	counter  uint32
+	plain    []byte
+	final    bool
+}
+
+func (r *decryptReader) next() error {
+	if r.prefix == nil {
+		header := make([]byte, encryptedHeader)
+		if _, e := io.ReadFull(r.buffered, header); e != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+			return ErrEncryptedContent
+		}
+		r.prefix = header[len(encryptedMagic):]
+	}
+	sealed := make([]byte, encryptedChunkSize+r.enc.content.Overhead())
+	n, e := io.ReadFull(r.buffered, sealed)
+	final := false
+	if e == io.ErrUnexpectedEOF {
+		final = true
+	} else if e == io.EOF {
+		return ErrEncryptedContent
+	} else if e != nil {
+		return e
+	} else if _, pe := r.buffered.Peek(1); pe == io.EOF {
+		final = true
+	}
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	plain, e := r.enc.content.Open(nil, r.enc.nonce(r.prefix, r.counter), sealed[:n], ad)
+	if e != nil {
+		return ErrEncryptedContent
+	}
+	r.counter++
+	r.plain = plain
+	r.final = final
+	return nil
+}
+
+// Read decrypts the content chunk by chunk.
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if e := r.next(); e != nil {
+			return 0, e
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// Close closes the underlying reader.
+func (r *decryptReader) Close() error {
+	return r.in.Close()
+}
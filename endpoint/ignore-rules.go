@@ -0,0 +1,296 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+
+	cells "github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// IgnoreFileName is the name of the optional per-folder file containing additional ignore rules.
+const IgnoreFileName = ".cellsignore"
+
+// ignoreFileCheckInterval limits how often a cached .cellsignore file is stat'ed again.
+const ignoreFileCheckInterval = 2 * time.Second
+
+// ignoreLoadTimeout limits the time spent loading a node to find its type.
+const ignoreLoadTimeout = 10 * time.Second
+
+type ignoreRule struct {
+	negate   bool
+	dirOnly  bool
+	matchers []glob.Glob
+}
+
+func (r *ignoreRule) match(p string) bool {
+	for _, m := range r.matchers {
+		if m.Match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+type ignoreFile struct {
+	rules     []*ignoreRule
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// IgnoreMatcher evaluates a list of gitignore-style rules against sync paths. Rules declared in the task
+// are applied first, then rules read from the .cellsignore files found in the local roots, from the top folder
+// down to the deepest one: as in git, the last matching rule wins and a path cannot be re-included if one of its
+// parents is excluded. It implements the glob.Glob interface so that it can be passed directly to the sync task.
+type IgnoreMatcher struct {
+	sync.Mutex
+	rules      []*ignoreRule
+	localRoots []string
+	files      map[string]*ignoreFile
+	sources    []model.PathSyncSource
+}
+
+// NewIgnoreMatcher compiles the rules and prepares a matcher. Optional localRoots are filesystem folders
+// where .cellsignore files are looked up.
+func NewIgnoreMatcher(rules []string, localRoots ...string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{
+		localRoots: localRoots,
+		files:      make(map[string]*ignoreFile),
+	}
+	for i, line := range rules {
+		r, e := parseIgnoreRule("", line)
+		if e != nil {
+			return nil, fmt.Errorf("invalid ignore rule #%d (%s): %s", i+1, line, e.Error())
+		}
+		if r != nil {
+			m.rules = append(m.rules, r)
+		}
+	}
+	return m, nil
+}
+
+// LocalRootsFromURIs extracts the folders of the "fs" URIs, where .cellsignore files can be found.
+func LocalRootsFromURIs(uris ...string) (roots []string) {
+	for _, uri := range uris {
+		if u, e := url.Parse(uri); e == nil && u.Scheme == "fs" && u.Path != "" {
+			roots = append(roots, u.Path)
+		}
+	}
+	return
+}
+
+// SetNodeSources registers endpoints used to find the type of the paths that are not found in the local roots,
+// when Match is called without a node. They are only queried when a folder-only rule matches the path.
+func (m *IgnoreMatcher) SetNodeSources(endpoints ...model.Endpoint) {
+	m.Lock()
+	defer m.Unlock()
+	m.sources = nil
+	for _, ep := range endpoints {
+		if source, ok := model.AsPathSyncSource(ep); ok {
+			m.sources = append(m.sources, source)
+		}
+	}
+}
+
+// Match implements glob.Glob interface. It returns true if the path must be ignored. As the node type is not
+// known, it is looked up in the local roots and in the node sources when a folder-only rule applies.
+func (m *IgnoreMatcher) Match(p string) bool {
+	return m.match(p, m.isDir)
+}
+
+// MatchNode returns true if the path of this node must be ignored, using the node type.
+func (m *IgnoreMatcher) MatchNode(p string, node tree.N) bool {
+	return m.match(p, func(string) bool {
+		return !node.IsLeaf()
+	})
+}
+
+func (m *IgnoreMatcher) match(p string, isDirFunc func(string) bool) bool {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return false
+	}
+	segments := strings.Split(p, "/")
+	rules := m.rules
+	dir := ""
+	for i, segment := range segments {
+		if segment == cells.PydioSyncHiddenFile {
+			return true
+		}
+		if folderRules := m.folderRules(dir); len(folderRules) > 0 {
+			rules = append(append([]*ignoreRule{}, rules...), folderRules...)
+		}
+		current := dir + "/" + segment
+		last := i == len(segments)-1
+		var ignored, typeChecked, isDir bool
+		for _, r := range rules {
+			if !r.match(current) {
+				continue
+			}
+			if r.dirOnly && last {
+				if !typeChecked {
+					isDir, typeChecked = isDirFunc(current), true
+				}
+				if !isDir {
+					continue
+				}
+			}
+			ignored = !r.negate
+		}
+		if ignored {
+			return true
+		}
+		dir = current
+	}
+	return false
+}
+
+// isDir checks the type of the path in the local roots, then in the node sources. When it cannot be found,
+// it is considered a file.
+func (m *IgnoreMatcher) isDir(p string) bool {
+	for _, root := range m.localRoots {
+		if st, e := os.Stat(filepath.Join(root, filepath.FromSlash(p))); e == nil {
+			return st.IsDir()
+		}
+	}
+	m.Lock()
+	sources := m.sources
+	m.Unlock()
+	for _, source := range sources {
+		ctx, cancel := context.WithTimeout(context.Background(), ignoreLoadTimeout)
+		node, e := source.LoadNode(ctx, p)
+		cancel()
+		if e == nil && node != nil {
+			return !node.IsLeaf()
+		}
+	}
+	return false
+}
+
+// folderRules loads (and caches) the rules of the .cellsignore files found in the dir folder of the local roots.
+func (m *IgnoreMatcher) folderRules(dir string) (rules []*ignoreRule) {
+	if len(m.localRoots) == 0 {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, root := range m.localRoots {
+		filePath := filepath.Join(root, filepath.FromSlash(dir), IgnoreFileName)
+		cached, ok := m.files[filePath]
+		if ok && time.Since(cached.lastCheck) < ignoreFileCheckInterval {
+			rules = append(rules, cached.rules...)
+			continue
+		}
+		st, e := os.Stat(filePath)
+		if e != nil {
+			m.files[filePath] = &ignoreFile{lastCheck: time.Now()}
+			continue
+		}
+		if ok && st.ModTime().Equal(cached.modTime) {
+			cached.lastCheck = time.Now()
+			rules = append(rules, cached.rules...)
+			continue
+		}
+		f := &ignoreFile{modTime: st.ModTime(), lastCheck: time.Now()}
+		if file, er := os.Open(filePath); er == nil {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				if r, er := parseIgnoreRule(dir, scanner.Text()); er == nil && r != nil {
+					f.rules = append(f.rules, r)
+				} else if er != nil {
+					log.Logger(context.Background()).Warn("Ignoring invalid rule in " + filePath + ": " + er.Error())
+				}
+			}
+			file.Close()
+		}
+		m.files[filePath] = f
+		rules = append(rules, f.rules...)
+	}
+	return
+}
+
+// parseIgnoreRule transforms a gitignore-style line into a glob rule, relative to the base folder.
+// It returns nil for empty lines and comments.
+func parseIgnoreRule(base, line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	r := &ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+	// A pattern containing a separator is relative to the base folder, otherwise it matches at any level
+	anchored := strings.Contains(line, "/")
+	if strings.HasPrefix(line, "**/") {
+		anchored = false
+		line = strings.TrimPrefix(line, "**/")
+	}
+	line = strings.TrimPrefix(line, "/")
+	// Braces are not part of the gitignore syntax
+	line = strings.NewReplacer("{", `\{`, "}", `\}`, ",", `\,`).Replace(line)
+
+	// Each "/**/" matches one or more levels but "a/**/b" must also match "a/b": expand both forms.
+	// A non-anchored pattern is handled the same way, starting right after the base folder.
+	base = glob.QuoteMeta(base)
+	parts := strings.Split(line, "/**/")
+	exprs := []string{base + "/" + parts[0]}
+	if !anchored {
+		exprs = append(exprs, base+"/**/"+parts[0])
+	}
+	for _, part := range parts[1:] {
+		var next []string
+		for _, expr := range exprs {
+			next = append(next, expr+"/"+part, expr+"/**/"+part)
+		}
+		exprs = next
+	}
+	for _, expr := range exprs {
+		g, e := glob.Compile(expr, '/')
+		if e != nil {
+			return nil, e
+		}
+		r.matchers = append(r.matchers, g)
+	}
+	return r, nil
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+	"go.etcd.io/bbolt"
+
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// DefaultPatchSearchLimit is the maximum number of results of a PatchSearchQuery if it does not set a Limit.
+const DefaultPatchSearchLimit = 100
+
+// PatchSearchQuery filters the operations stored in a PatchStore. Empty fields are ignored.
+type PatchSearchQuery struct {
+	// Path is a path prefix, or a glob pattern if it contains one of the *?[{ characters.
+	Path string
+	// Types restricts the operations types.
+	Types []merger.OperationType
+	// ErrorsOnly keeps operations that failed or were not processed because their patch failed.
+	ErrorsOnly bool
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+// PatchSearchResult is an operation matching a PatchSearchQuery, along with its patch information.
+type PatchSearchResult struct {
+	PatchUUID  string
+	PatchStamp time.Time
+	Type       string
+	Path       string
+	// MoveFrom is the original path of a move
+	MoveFrom string `json:",omitempty"`
+	// Source is the side where the change was detected, Target the side that was modified: left, right,
+	// or both for conflicts
+	Source    string
+	Target    string
+	Processed bool
+	// Size and Etag are set for data operations (file creations and updates)
+	Size  int64  `json:",omitempty"`
+	Etag  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// ParseOperationType finds an operation type by its name (e.g. "Delete" or "CreateFile"), case is ignored.
+func ParseOperationType(name string) (merger.OperationType, error) {
+	for t := merger.OpCreateFile; t <= merger.OpUpdateMeta; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	if strings.EqualFold(name, "Conflict") {
+		return merger.OpConflict, nil
+	}
+	return merger.OpUnknown, fmt.Errorf("unknown operation type %s", name)
+}
+
+// pathMatcher returns a function matching paths against a prefix or a glob pattern.
+func pathMatcher(pattern string) (func(string) bool, error) {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return func(string) bool { return true }, nil
+	}
+	if strings.ContainsAny(pattern, "*?[{") {
+		g, e := glob.Compile(pattern, '/')
+		if e != nil {
+			return nil, e
+		}
+		return func(p string) bool {
+			return g.Match(strings.Trim(p, "/"))
+		}, nil
+	}
+	return func(p string) bool {
+		p = strings.Trim(p, "/")
+		return p == pattern || strings.HasPrefix(p, pattern+"/")
+	}, nil
+}
+
+// Search browses patches from the most recent one and returns the operations matching the query.
+// Only the patches in the query date range are loaded.
+func (p *PatchStore) Search(query PatchSearchQuery) ([]*PatchSearchResult, error) {
+	match, e := pathMatcher(query.Path)
+	if e != nil {
+		return nil, e
+	}
+	types := make(map[string]bool, len(query.Types))
+	for _, t := range query.Types {
+		types[t.String()] = true
+	}
+	return p.searchOperations(query.From, query.To, query.Limit, func(r *PatchSearchResult) bool {
+		if len(types) > 0 && !types[r.Type] {
+			return false
+		}
+		if query.ErrorsOnly && r.Error == "" {
+			return false
+		}
+		return match(r.Path) || (r.MoveFrom != "" && match(r.MoveFrom))
+	})
+}
+
+// History returns the operations that touched a path, in chronological order: operations on the path itself,
+// moves from or to it, and moves or deletions of its parent folders. Up to limit most recent operations are returned.
+func (p *PatchStore) History(path string, limit int) ([]*PatchSearchResult, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("please provide a path")
+	}
+	isParent := func(folder string) bool {
+		folder = strings.Trim(folder, "/")
+		return folder != "" && strings.HasPrefix(path, folder+"/")
+	}
+	results, e := p.searchOperations(time.Time{}, time.Time{}, limit, func(r *PatchSearchResult) bool {
+		if strings.Trim(r.Path, "/") == path || (r.MoveFrom != "" && strings.Trim(r.MoveFrom, "/") == path) {
+			return true
+		}
+		if r.Type == merger.OpMoveFolder.String() || r.Type == merger.OpDelete.String() {
+			return isParent(r.Path) || (r.MoveFrom != "" && isParent(r.MoveFrom))
+		}
+		return false
+	})
+	if e != nil {
+		return nil, e
+	}
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results, nil
+}
+
+// searchOperations loads the patches between from and to (zero values are ignored), most recent first, and
+// returns up to limit operations accepted by the filter.
+func (p *PatchStore) searchOperations(from, to time.Time, limit int, filter func(r *PatchSearchResult) bool) (results []*PatchSearchResult, e error) {
+	if limit <= 0 {
+		limit = DefaultPatchSearchLimit
+	}
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	e = p.db.View(func(tx *bbolt.Tx) error {
+		return p.walkSummaries(tx, 0, -1, func(s *PatchSummary) error {
+			if len(results) >= limit || (!from.IsZero() && s.Stamp.Before(from)) {
+				return errStopWalk
+			}
+			if !to.IsZero() && s.Stamp.After(to) {
+				return nil
+			}
+			patch := p.loadPatch(tx, s)
+			patch.WalkOperations([]merger.OperationType{}, func(op merger.Operation) {
+				if len(results) >= limit {
+					return
+				}
+				if r := p.newSearchResult(s, op); filter(r) {
+					results = append(results, r)
+				}
+			})
+			return nil
+		})
+	})
+	if e == errStopWalk {
+		e = nil
+	}
+	return
+}
+
+func (p *PatchStore) newSearchResult(s *PatchSummary, op merger.Operation) *PatchSearchResult {
+	r := &PatchSearchResult{
+		PatchUUID:  s.UUID,
+		PatchStamp: s.Stamp,
+		Type:       op.Type().String(),
+		Path:       op.GetRefPath(),
+		Target:     p.operationTarget(op),
+		Processed:  op.IsProcessed(),
+	}
+	switch r.Target {
+	case "left":
+		r.Source = "right"
+	case "right":
+		r.Source = "left"
+	default:
+		r.Source = r.Target
+	}
+	if op.IsTypeMove() {
+		r.MoveFrom = op.GetMoveOriginPath()
+	}
+	if n := op.GetNode(); n != nil && op.IsTypeData() {
+		r.Size = n.GetSize()
+		r.Etag = n.GetEtag()
+	}
+	if op.Error() != nil {
+		r.Error = op.Error().Error()
+	} else if s.Error != "" && !op.IsProcessed() {
+		r.Error = s.Error
+	}
+	return r
+}
+
+// operationTarget finds the side modified by an operation.
+func (p *PatchStore) operationTarget(op merger.Operation) string {
+	if op.Type() == merger.OpConflict {
+		return "both"
+	}
+	switch model.Endpoint(op.Target()) {
+	case p.source:
+		return "left"
+	case p.target:
+		return "right"
+	}
+	return ""
+}
@@ -24,19 +24,30 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
-	"sort"
+	"sync"
 	"time"
 
 	"go.etcd.io/bbolt"
 
+	"github.com/pydio/cells-sync/config"
 	"github.com/pydio/cells/v4/common/log"
 	"github.com/pydio/cells/v4/common/sync/merger"
 	"github.com/pydio/cells/v4/common/sync/model"
 )
 
 var (
+	// patchIndexBucket lists patches UUIDs by time, keys are built with patchIndexKey.
+	patchIndexBucket = []byte("patches-index")
+	// patchSummaryBucket stores a PatchSummary for each patch UUID.
+	patchSummaryBucket = []byte("patches-summary")
+	// patchOpsBucket stores a sub-bucket of operations for each patch UUID.
+	patchOpsBucket = []byte("patches-operations")
+
+	// Legacy layout: one bucket per patch inside the patches bucket, migrated at startup.
 	patchBucket    = []byte("patches")
 	timeKey        = []byte("stamp")
 	opsKey         = []byte("operations")
@@ -44,16 +55,35 @@ var (
 	patchSourceKey = []byte("source")
 )
 
-type patchSorter []merger.Patch
+// errStopWalk interrupts walkSummaries without error.
+var errStopWalk = errors.New("stop walking")
+
+// PatchStoreMaintenanceInterval is the delay between two pruning and compaction passes on a PatchStore.
+var PatchStoreMaintenanceInterval = time.Hour
 
-func (p patchSorter) Len() int {
-	return len(p)
+// PatchRetention defines which patches are kept by a PatchStore. Zero values disable the corresponding limit,
+// the most recent patch is always kept.
+type PatchRetention struct {
+	MaxCount int
+	MaxAge   time.Duration
+	// MaxSize is the maximum size of the stored patches, in bytes.
+	MaxSize int64
 }
-func (p patchSorter) Less(i, j int) bool {
-	return p[i].GetStamp().After(p[j].GetStamp())
+
+// NewPatchRetention converts a task PatchRetention configuration.
+func NewPatchRetention(r config.PatchRetention) PatchRetention {
+	return PatchRetention{MaxCount: r.MaxCount, MaxAge: r.GetMaxAge(), MaxSize: int64(r.MaxSize) << 20}
 }
-func (p patchSorter) Swap(i, j int) {
-	p[i], p[j] = p[j], p[i]
+
+// PatchSummary is stored along with each patch, so that patches can be listed without loading their operations.
+type PatchSummary struct {
+	UUID   string
+	Stamp  time.Time
+	Source string
+	Error  string `json:",omitempty"`
+	Stats  map[string]interface{}
+	// Size is the size of the stored operations, in bytes.
+	Size int64
 }
 
 // PatchStore is a persistence layer for storing patches. It is based on BoltDB
@@ -65,18 +95,22 @@ type PatchStore struct {
 	source model.Endpoint
 	target model.Endpoint
 
+	// dbLock protects db, that is replaced during compaction
+	dbLock        sync.RWMutex
 	db            *bbolt.DB
 	folderPath    string
 	lastHasErrors bool
+	retention     PatchRetention
 }
 
-// NewPatchStore opens a new PatchStore
-func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoint) (*PatchStore, error) {
+// NewPatchStore opens a new PatchStore, old patches are regularly pruned according to the retention.
+func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoint, retention PatchRetention) (*PatchStore, error) {
 	p := &PatchStore{
-		patches: make(chan merger.Patch),
-		done:    make(chan bool, 1),
-		source:  source,
-		target:  target,
+		patches:   make(chan merger.Patch),
+		done:      make(chan bool, 1),
+		source:    source,
+		target:    target,
+		retention: retention,
 	}
 
 	options := bbolt.DefaultOptions
@@ -88,10 +122,14 @@ func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoi
 		return nil, err
 	}
 	p.db = db
+	if err := p.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Load last known patch status (error or not)
-	if last, e := p.Load(0, 1); e == nil && len(last) > 0 {
-		_, p.lastHasErrors = last[0].HasErrors()
+	if last, e := p.LoadSummaries(0, 1); e == nil && len(last) > 0 {
+		p.lastHasErrors = last[0].Error != ""
 	}
 
 	go func() {
@@ -99,6 +137,37 @@ func NewPatchStore(folderPath string, source model.Endpoint, target model.Endpoi
 			p.persist(patch)
 		}
 	}()
+	go p.maintenance()
+	return p, nil
+}
+
+// OpenPatchStoreReadOnly opens an existing PatchStore for reading, e.g. when the application is not running.
+// The DB is neither migrated, pruned nor compacted, and patches cannot be stored.
+func OpenPatchStoreReadOnly(folderPath string, source model.Endpoint, target model.Endpoint) (*PatchStore, error) {
+	p := &PatchStore{
+		done:       make(chan bool, 1),
+		source:     source,
+		target:     target,
+		folderPath: folderPath,
+	}
+	// Copy the default options, as they are shared
+	options := *bbolt.DefaultOptions
+	options.Timeout = 5 * time.Second
+	options.ReadOnly = true
+	db, err := bbolt.Open(filepath.Join(folderPath, "patches"), 0644, &options)
+	if err != nil {
+		return nil, err
+	}
+	p.db = db
+	var legacy bool
+	_ = db.View(func(tx *bbolt.Tx) error {
+		legacy = tx.Bucket(patchBucket) != nil
+		return nil
+	})
+	if legacy {
+		db.Close()
+		return nil, fmt.Errorf("patch store is not migrated yet, please start the application once")
+	}
 	return p, nil
 }
 
@@ -146,93 +215,166 @@ func (p *PatchStore) unmarshalConflict(data []byte, op merger.Operation) (merger
 	return conflict, nil
 }
 
-// Load list all patches
-func (p *PatchStore) Load(offset, limit int) (patches []merger.Patch, e error) {
-	var stamps patchSorter
+// LoadSummaries lists the summaries of the patches, most recent first. Only the requested summaries are read.
+func (p *PatchStore) LoadSummaries(offset, limit int) (summaries []*PatchSummary, e error) {
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	e = p.db.View(func(tx *bbolt.Tx) error {
+		return p.walkSummaries(tx, offset, limit, func(s *PatchSummary) error {
+			summaries = append(summaries, s)
+			return nil
+		})
+	})
+	return
+}
 
+// Load lists patches with their operations, most recent first. Only the requested patches are read.
+func (p *PatchStore) Load(offset, limit int) (patches []merger.Patch, e error) {
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
 	e = p.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket(patchBucket)
-		if bucket == nil {
+		return p.walkSummaries(tx, offset, limit, func(s *PatchSummary) error {
+			patches = append(patches, p.loadPatch(tx, s))
 			return nil
+		})
+	})
+	return
+}
+
+// LoadPatch loads a patch and its operations by UUID.
+func (p *PatchStore) LoadPatch(uuid string) (patch merger.Patch, e error) {
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	e = p.db.View(func(tx *bbolt.Tx) error {
+		summaries := tx.Bucket(patchSummaryBucket)
+		if summaries == nil {
+			return fmt.Errorf("cannot find patch %s", uuid)
 		}
-		c := bucket.Cursor()
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			patch := merger.NewPatch(p.source.(model.PathSyncSource), p.target.(model.PathSyncTarget), merger.PatchOptions{})
-			// Set the UUID of the patch
-			patch.SetUUID(string(k))
-			// v is a bucket containing all operations
-			patchBucket := bucket.Bucket(k)
-			if errValue := patchBucket.Get(patchErrKey); errValue != nil {
-				// Do this before unmarshalling tStamp otherwise it overwrites internal mtime
-				patch.SetPatchError(fmt.Errorf(string(errValue)))
-			}
-			if src := patchBucket.Get(patchSourceKey); src != nil && string(src) != p.source.GetEndpointInfo().URI {
-				// Invert target and source
-				patch.Source(p.target.(model.PathSyncSource))
-				patch.Target(p.source.(model.PathSyncTarget))
-			}
-			stamp := patchBucket.Get(timeKey)
-			t := time.Now()
-			if err := t.UnmarshalJSON(stamp); err == nil {
-				patch.Stamp(t)
-			}
-			opsBucket := patchBucket.Bucket(opsKey)
-			oc := opsBucket.Cursor()
-			for _, v := oc.First(); v != nil; _, v = oc.Next() {
-				operation := merger.NewOpForUnmarshall()
-				if err := json.Unmarshal(v, &operation); err == nil {
-					if operation, err = p.unmarshalConflict(v, operation); err != nil {
-						log.Logger(context.Background()).Error("Cannot unmarshall conflict operation:" + err.Error())
-					}
-					patch.Enqueue(operation)
-				} else {
-					log.Logger(context.Background()).Error("Cannot unmarshall operation:" + err.Error())
-				}
-			}
-			stamps = append(stamps, patch)
+		data := summaries.Get([]byte(uuid))
+		if data == nil {
+			return fmt.Errorf("cannot find patch %s", uuid)
 		}
+		var s PatchSummary
+		if er := json.Unmarshal(data, &s); er != nil {
+			return er
+		}
+		patch = p.loadPatch(tx, &s)
 		return nil
 	})
-	if e != nil {
-		return patches, e
-	}
-	// Order patches by timestamp
-	sort.Sort(stamps)
-	var prunes []string
-	if len(stamps) > 100 {
-		for _, pr := range stamps[100:] {
-			prunes = append(prunes, pr.GetUUID())
-		}
+	return
+}
+
+// walkSummaries browses the time index backward and calls the callback on the summaries in the offset/limit range.
+// A negative limit browses all summaries.
+func (p *PatchStore) walkSummaries(tx *bbolt.Tx, offset, limit int, callback func(s *PatchSummary) error) error {
+	index := tx.Bucket(patchIndexBucket)
+	summaries := tx.Bucket(patchSummaryBucket)
+	if index == nil || summaries == nil || limit == 0 {
+		return nil
 	}
-	for i, patch := range stamps {
+	var i, count int
+	c := index.Cursor()
+	for k, v := c.Last(); k != nil && (limit < 0 || count < limit); k, v = c.Prev() {
 		if i < offset {
+			i++
+			continue
+		}
+		data := summaries.Get(v)
+		if data == nil {
+			continue
+		}
+		s := &PatchSummary{}
+		if er := json.Unmarshal(data, s); er != nil {
+			log.Logger(context.Background()).Error("Cannot unmarshall patch summary: " + er.Error())
 			continue
 		}
-		patches = append(patches, patch)
-		if i >= offset+limit-1 {
-			break
+		if er := callback(s); er != nil {
+			return er
 		}
+		count++
 	}
+	return nil
+}
 
-	if len(prunes) > 0 {
-		go func() {
-			log.Logger(context.Background()).Info("Pruning patch store")
-			p.db.Update(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket(patchBucket)
-				if bucket == nil {
-					return nil
-				}
-				for _, uuid := range prunes {
-					if e := bucket.DeleteBucket([]byte(uuid)); e != nil {
-						log.Logger(context.Background()).Error("cannot delete bucket " + uuid + " - " + e.Error())
-					}
-				}
-				return nil
-			})
-		}()
+// loadPatch creates a patch from its summary and loads its operations.
+func (p *PatchStore) loadPatch(tx *bbolt.Tx, s *PatchSummary) merger.Patch {
+	patch := p.newPatch(s.UUID, s.Source, s.Error, s.Stamp)
+	if ops := tx.Bucket(patchOpsBucket); ops != nil {
+		p.loadOperations(ops.Bucket([]byte(s.UUID)), patch)
 	}
+	return patch
+}
 
-	return
+// newPatch creates an empty patch, inverting source and target if necessary.
+func (p *PatchStore) newPatch(uuid, source, patchError string, stamp time.Time) merger.Patch {
+	patch := merger.NewPatch(p.source.(model.PathSyncSource), p.target.(model.PathSyncTarget), merger.PatchOptions{})
+	patch.SetUUID(uuid)
+	if patchError != "" {
+		// Do this before setting stamp otherwise it overwrites internal mtime
+		patch.SetPatchError(fmt.Errorf("%s", patchError))
+	}
+	if source != "" && source != p.source.GetEndpointInfo().URI {
+		// Invert target and source
+		patch.Source(p.target.(model.PathSyncSource))
+		patch.Target(p.source.(model.PathSyncTarget))
+	}
+	patch.Stamp(stamp)
+	return patch
+}
+
+func (p *PatchStore) loadOperations(opsBucket *bbolt.Bucket, patch merger.Patch) {
+	if opsBucket == nil {
+		return
+	}
+	oc := opsBucket.Cursor()
+	for _, v := oc.First(); v != nil; _, v = oc.Next() {
+		operation := merger.NewOpForUnmarshall()
+		if err := json.Unmarshal(v, &operation); err == nil {
+			if operation, err = p.unmarshalConflict(v, operation); err != nil {
+				log.Logger(context.Background()).Error("Cannot unmarshall conflict operation:" + err.Error())
+			}
+			patch.Enqueue(operation)
+		} else {
+			log.Logger(context.Background()).Error("Cannot unmarshall operation:" + err.Error())
+		}
+	}
+}
+
+// migrate moves patches stored with the legacy layout (one bucket per patch, that had to be fully read
+// and sorted for listing) to the time-indexed layout.
+func (p *PatchStore) migrate() error {
+	var legacy bool
+	p.db.View(func(tx *bbolt.Tx) error {
+		legacy = tx.Bucket(patchBucket) != nil
+		return nil
+	})
+	if !legacy {
+		return nil
+	}
+	var count int
+	e := p.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(patchBucket)
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			pb := bucket.Bucket(k)
+			if pb == nil {
+				continue
+			}
+			stamp := time.Now()
+			_ = stamp.UnmarshalJSON(pb.Get(timeKey))
+			patch := p.newPatch(string(k), string(pb.Get(patchSourceKey)), string(pb.Get(patchErrKey)), stamp)
+			p.loadOperations(pb.Bucket(opsKey), patch)
+			if er := p.writePatch(tx, patch); er != nil {
+				return er
+			}
+			count++
+		}
+		return tx.DeleteBucket(patchBucket)
+	})
+	if e == nil {
+		log.Logger(context.Background()).Info(fmt.Sprintf("Migrated %d patch(es) to indexed patch store", count))
+	}
+	return e
 }
 
 // Stop closes the DB.
@@ -241,7 +383,127 @@ func (p *PatchStore) Stop() {
 	if p.pipeDone != nil {
 		close(p.pipeDone)
 	}
+	p.dbLock.Lock()
 	p.db.Close()
+	p.dbLock.Unlock()
+}
+
+// maintenance regularly prunes and compacts the DB until the store is stopped.
+func (p *PatchStore) maintenance() {
+	ctx := context.Background()
+	ticker := time.NewTicker(PatchStoreMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		if pruned, e := p.Prune(); e != nil {
+			log.Logger(ctx).Error("Cannot prune patch store: " + e.Error())
+		} else if pruned > 0 {
+			log.Logger(ctx).Info(fmt.Sprintf("Pruned %d patch(es) from patch store", pruned))
+		}
+		if e := p.Compact(false); e != nil {
+			log.Logger(ctx).Error("Cannot compact patch store: " + e.Error())
+		}
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Prune removes the patches exceeding the retention limits and returns the number of removed patches.
+func (p *PatchStore) Prune() (int, error) {
+	r := p.retention
+	if r.MaxCount <= 0 && r.MaxAge <= 0 && r.MaxSize <= 0 {
+		return 0, nil
+	}
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	var pruned int
+	e := p.db.Update(func(tx *bbolt.Tx) error {
+		var prunes []*PatchSummary
+		var i int
+		var total int64
+		er := p.walkSummaries(tx, 0, -1, func(s *PatchSummary) error {
+			total += s.Size
+			if i > 0 && ((r.MaxCount > 0 && i >= r.MaxCount) || (r.MaxAge > 0 && time.Since(s.Stamp) > r.MaxAge) || (r.MaxSize > 0 && total > r.MaxSize)) {
+				prunes = append(prunes, s)
+			}
+			i++
+			return nil
+		})
+		if er != nil {
+			return er
+		}
+		for _, s := range prunes {
+			if er := p.deletePatch(tx, s); er != nil {
+				return er
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, e
+}
+
+// Compact rewrites the DB file to reclaim the space freed by pruned patches. Unless force is true,
+// it is only done if at least half of the file is unused.
+func (p *PatchStore) Compact(force bool) error {
+	p.dbLock.Lock()
+	defer p.dbLock.Unlock()
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	if p.db.IsReadOnly() {
+		return bbolt.ErrDatabaseReadOnly
+	}
+	dbPath := p.db.Path()
+	info, e := os.Stat(dbPath)
+	if e != nil {
+		return e
+	}
+	if !force && int64(p.db.Stats().FreeAlloc)*2 < info.Size() {
+		return nil
+	}
+	tmpPath := dbPath + ".compact"
+	_ = os.Remove(tmpPath)
+	options := *bbolt.DefaultOptions
+	options.Timeout = 5 * time.Second
+	dst, e := bbolt.Open(tmpPath, 0644, &options)
+	if e != nil {
+		return e
+	}
+	if e := bbolt.Compact(dst, p.db, 65536); e != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return e
+	}
+	if e := dst.Close(); e != nil {
+		os.Remove(tmpPath)
+		return e
+	}
+	if e := p.db.Close(); e != nil {
+		os.Remove(tmpPath)
+		return e
+	}
+	renameErr := os.Rename(tmpPath, dbPath)
+	if renameErr != nil {
+		os.Remove(tmpPath)
+	}
+	// Reopen the DB in any case. On failure, the closed handle is kept so that other calls return
+	// bbolt.ErrDatabaseNotOpen instead of dereferencing a nil DB.
+	db, e := bbolt.Open(dbPath, 0644, &options)
+	if e != nil {
+		return e
+	}
+	p.db = db
+	return renameErr
 }
 
 // PublishPatch pushes patch to the persist queue
@@ -256,35 +518,90 @@ func (p *PatchStore) persist(patch merger.Patch) {
 		return
 	}
 	p.lastHasErrors = has
-	p.db.Update(func(tx *bbolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(patchBucket)
-		if err != nil {
-			return err
+	p.dbLock.RLock()
+	defer p.dbLock.RUnlock()
+	if e := p.db.Update(func(tx *bbolt.Tx) error {
+		return p.writePatch(tx, patch)
+	}); e != nil {
+		log.Logger(context.Background()).Error("Cannot store patch: " + e.Error())
+	}
+}
+
+// writePatch stores the patch operations, summary and index entry, fully replacing a previous version of the same patch.
+func (p *PatchStore) writePatch(tx *bbolt.Tx, patch merger.Patch) error {
+	summaries, err := tx.CreateBucketIfNotExists(patchSummaryBucket)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(patchIndexBucket); err != nil {
+		return err
+	}
+	ops, err := tx.CreateBucketIfNotExists(patchOpsBucket)
+	if err != nil {
+		return err
+	}
+	uuid := patch.GetUUID()
+	if data := summaries.Get([]byte(uuid)); data != nil {
+		previous := &PatchSummary{}
+		if json.Unmarshal(data, previous) == nil {
+			if err := p.deletePatch(tx, previous); err != nil {
+				return err
+			}
 		}
-		// Fully replace bucket content
-		bName := []byte(patch.GetUUID())
-		if opsBucket := bucket.Bucket(bName); opsBucket != nil {
-			bucket.DeleteBucket(bName)
+	}
+	opsBucket, err := ops.CreateBucket([]byte(uuid))
+	if err != nil {
+		return err
+	}
+	summary := &PatchSummary{
+		UUID:   uuid,
+		Stamp:  patch.GetStamp(),
+		Source: patch.Source().GetEndpointInfo().URI,
+		Stats:  patch.Stats(),
+	}
+	if errs, ok := patch.HasErrors(); ok && len(errs) > 0 {
+		summary.Error = errs[0].Error()
+	}
+	patch.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
+		if data, err := json.Marshal(operation); err == nil {
+			id, _ := opsBucket.NextSequence()
+			opsBucket.Put(itob(id), data)
+			summary.Size += int64(len(data))
 		}
-		patchBucket, err := bucket.CreateBucketIfNotExists(bName)
-		if err != nil {
+	})
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err := summaries.Put([]byte(uuid), data); err != nil {
+		return err
+	}
+	return tx.Bucket(patchIndexBucket).Put(patchIndexKey(summary.Stamp, uuid), []byte(uuid))
+}
+
+// deletePatch removes the patch operations, summary and index entry.
+func (p *PatchStore) deletePatch(tx *bbolt.Tx, s *PatchSummary) error {
+	if index := tx.Bucket(patchIndexBucket); index != nil {
+		if err := index.Delete(patchIndexKey(s.Stamp, s.UUID)); err != nil {
 			return err
 		}
-		mTime, _ := patch.GetStamp().MarshalJSON()
-		patchBucket.Put(timeKey, mTime)
-		if errs, ok := patch.HasErrors(); ok && len(errs) > 0 {
-			patchBucket.Put(patchErrKey, []byte(errs[0].Error()))
+	}
+	if summaries := tx.Bucket(patchSummaryBucket); summaries != nil {
+		if err := summaries.Delete([]byte(s.UUID)); err != nil {
+			return err
 		}
-		patchBucket.Put(patchSourceKey, []byte(patch.Source().GetEndpointInfo().URI))
-		opsBucket, _ := patchBucket.CreateBucket(opsKey)
-		patch.WalkOperations([]merger.OperationType{}, func(operation merger.Operation) {
-			if data, err := json.Marshal(operation); err == nil {
-				id, _ := opsBucket.NextSequence()
-				opsBucket.Put(itob(id), data)
-			}
-		})
-		return nil
-	})
+	}
+	if ops := tx.Bucket(patchOpsBucket); ops != nil && ops.Bucket([]byte(s.UUID)) != nil {
+		return ops.DeleteBucket([]byte(s.UUID))
+	}
+	return nil
+}
+
+// patchIndexKey sorts patches by time, the UUID avoids collisions.
+func patchIndexKey(stamp time.Time, uuid string) []byte {
+	b := make([]byte, 8, 8+len(uuid))
+	binary.BigEndian.PutUint64(b, uint64(stamp.UnixNano()))
+	return append(b, uuid...)
 }
 
 // itob returns an 8-byte big endian representation of v.
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/utils/hasher"
+	"github.com/pydio/cells/v4/common/utils/hasher/simd"
+)
+
+// pollEntry is the state of a file or folder recorded by a polling watcher. For remote servers that do not
+// provide change notifications (sftp, webdav), changes are detected by comparing two scans of the tree.
+type pollEntry struct {
+	size   int64
+	mTime  time.Time
+	etag   string
+	folder bool
+}
+
+// pollScanFunc lists the state of all the files and folders under root.
+type pollScanFunc func(root string) (map[string]pollEntry, error)
+
+// pollInterval reads the "poll" query parameter of an endpoint URI, or returns the default interval.
+func pollInterval(u *url.URL, defaultInterval time.Duration) (time.Duration, error) {
+	poll := u.Query().Get("poll")
+	if poll == "" {
+		return defaultInterval, nil
+	}
+	d, e := time.ParseDuration(poll)
+	if e != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid poll interval %s", poll)
+	}
+	return d, nil
+}
+
+// newPollingWatch scans the tree every interval and emits events for the files and folders that were created,
+// modified or removed since the previous scan.
+func newPollingWatch(source model.PathSyncSource, root string, interval func() time.Duration, scan pollScanFunc) (*model.WatchObject, error) {
+	previous, e := scan(root)
+	if e != nil {
+		return nil, e
+	}
+	eventChan := make(chan model.EventInfo)
+	errorChan := make(chan error)
+	doneChan := make(chan bool)
+
+	go func() {
+		defer close(eventChan)
+		defer close(errorChan)
+		ticker := time.NewTicker(interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-doneChan:
+				return
+			case <-ticker.C:
+				current, er := scan(root)
+				if er != nil {
+					select {
+					case errorChan <- er:
+					case <-doneChan:
+						return
+					}
+					continue
+				}
+				for _, event := range diffPollScans(source, previous, current) {
+					select {
+					case eventChan <- event:
+					case <-doneChan:
+						return
+					}
+				}
+				previous = current
+			}
+		}
+	}()
+
+	return &model.WatchObject{
+		EventInfoChan: eventChan,
+		ErrorChan:     errorChan,
+		DoneChan:      doneChan,
+	}, nil
+}
+
+// diffPollScans compares two scans and builds the corresponding events. Folders modification times and etags
+// are ignored, as they change whenever their content changes.
+func diffPollScans(source model.PathSyncSource, previous, current map[string]pollEntry) (events []model.EventInfo) {
+	stamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	var removed, created []string
+	for p, prev := range previous {
+		if cur, ok := current[p]; !ok || cur.folder != prev.folder {
+			removed = append(removed, p)
+		}
+	}
+	for p, cur := range current {
+		prev, ok := previous[p]
+		if !ok || prev.folder != cur.folder {
+			created = append(created, p)
+		} else if !cur.folder && (prev.size != cur.size || !prev.mTime.Equal(cur.mTime) || prev.etag != cur.etag) {
+			created = append(created, p)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(created)
+	for _, p := range removed {
+		events = append(events, model.EventInfo{
+			Time:   stamp,
+			Path:   p,
+			Folder: previous[p].folder,
+			Type:   model.EventRemove,
+			Source: source,
+		})
+	}
+	for _, p := range created {
+		events = append(events, model.EventInfo{
+			Time:   stamp,
+			Path:   p,
+			Size:   current[p].size,
+			Folder: current[p].folder,
+			Type:   model.EventCreate,
+			Source: source,
+		})
+	}
+	return
+}
+
+// contentHash computes the same block hash as the filesystem endpoint, so that files can be compared across endpoints.
+func contentHash(r io.Reader) (string, error) {
+	h := hasher.NewBlockHash(simd.MD5(), hasher.DefaultBlockSize)
+	if _, e := io.Copy(h, r); e != nil {
+		return "", e
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// refHash returns the hash stored in the reference snapshot if the file size and modification time did not change.
+func refHash(ctx context.Context, ref model.PathSyncSource, p string, size int64, mTime time.Time) string {
+	if ref == nil {
+		return ""
+	}
+	if refNode, e := ref.LoadNode(ctx, p); e == nil && refNode.GetSize() == size && refNode.GetMTime() == mTime.Unix() {
+		return refNode.GetEtag()
+	}
+	return ""
+}
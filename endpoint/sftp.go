@@ -0,0 +1,513 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pydio/cells-sync/config"
+
+	"github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	errors2 "github.com/pydio/cells/v4/common/service/errors"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/utils/uuid"
+)
+
+// SFTPPollInterval is the default delay between two scans of an sftp:// endpoint when watching for changes.
+// It can be overridden with the "poll" query parameter of the URI, e.g. sftp://user@host/path?poll=5m
+const SFTPPollInterval = 30 * time.Second
+
+// SFTPClient is a sync endpoint storing files in a folder of a remote server accessed through SFTP.
+// Authentication is key-based, using the SSH agent or a key file referenced by a config.SSHIdentity.
+// As SFTP has no notification mechanism, changes are detected by regularly scanning the tree.
+type SFTPClient struct {
+	RootPath     string
+	PollInterval time.Duration
+
+	uri          string
+	addr         string
+	user         string
+	identity     *config.SSHIdentity
+	options      model.EndpointOptions
+	refHashStore model.PathSyncSource
+
+	connLock sync.Mutex
+	conn     *ssh.Client
+	client   *sftp.Client
+}
+
+// NewSFTPClient opens an SFTP connection to the server described by the URI and checks that the root folder exists.
+// If identity is nil, the SSH agent and the default known_hosts file are used.
+func NewSFTPClient(u *url.URL, identity *config.SSHIdentity, options model.EndpointOptions) (*SFTPClient, error) {
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("please provide a user name in URL")
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("passwords are not supported in sftp URLs, please use a key file or the SSH agent")
+	}
+	if identity == nil {
+		identity = &config.SSHIdentity{}
+	}
+	addr := u.Host
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		addr = net.JoinHostPort(addr, config.DefaultSSHPort)
+	}
+	c := &SFTPClient{
+		RootPath: path.Clean("/" + u.Path),
+		addr:     addr,
+		user:     u.User.Username(),
+		identity: identity,
+		options:  options,
+	}
+	c.uri = "sftp://" + c.user + "@" + addr + c.RootPath
+	var e error
+	if c.PollInterval, e = pollInterval(u, SFTPPollInterval); e != nil {
+		return nil, e
+	}
+	cl, e := c.sftp()
+	if e != nil {
+		return nil, e
+	}
+	if stat, e := cl.Stat(c.RootPath); e != nil || !stat.IsDir() {
+		c.Close()
+		return nil, errors.New("Cannot stat root folder " + c.RootPath + "!")
+	}
+	return c, nil
+}
+
+// sftp returns the current SFTP session, reconnecting if the previous connection was lost.
+func (c *SFTPClient) sftp() (*sftp.Client, error) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	hostKeyCallback, e := c.hostKeyCallback()
+	if e != nil {
+		return nil, e
+	}
+	auth, closeAgent, e := c.authMethods()
+	if e != nil {
+		return nil, e
+	}
+	defer closeAgent()
+	conn, e := ssh.Dial("tcp", c.addr, &ssh.ClientConfig{
+		User:            c.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if e != nil {
+		return nil, e
+	}
+	cl, e := sftp.NewClient(conn)
+	if e != nil {
+		conn.Close()
+		return nil, e
+	}
+	c.conn, c.client = conn, cl
+	go func() {
+		_ = conn.Wait()
+		c.connLock.Lock()
+		if c.conn == conn {
+			c.conn, c.client = nil, nil
+		}
+		c.connLock.Unlock()
+	}()
+	return cl, nil
+}
+
+// authMethods loads the identity key file, or connects to the SSH agent. The returned func must be called
+// once the handshake is done.
+func (c *SFTPClient) authMethods() ([]ssh.AuthMethod, func(), error) {
+	if c.identity.KeyFile != "" {
+		data, e := os.ReadFile(c.identity.KeyFile)
+		if e != nil {
+			return nil, nil, e
+		}
+		signer, e := ssh.ParsePrivateKey(data)
+		if e != nil {
+			var missing *ssh.PassphraseMissingError
+			if errors.As(e, &missing) {
+				return nil, nil, fmt.Errorf("key file %s is protected by a passphrase, please load it in the SSH agent instead", c.identity.KeyFile)
+			}
+			return nil, nil, e
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, func() {}, nil
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, fmt.Errorf("no key file configured for %s and no SSH agent available", config.SSHIdentityId(c.user, c.addr))
+	}
+	agentConn, e := net.Dial("unix", sock)
+	if e != nil {
+		return nil, nil, fmt.Errorf("cannot connect to SSH agent: %s", e.Error())
+	}
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)}, func() { agentConn.Close() }, nil
+}
+
+// hostKeyCallback verifies the server against the identity known_hosts file.
+func (c *SFTPClient) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.identity.InsecureSkipHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := c.identity.KnownHosts
+	if file == "" {
+		home, e := os.UserHomeDir()
+		if e != nil {
+			return nil, e
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(file)
+}
+
+// Close closes the underlying SSH connection.
+func (c *SFTPClient) Close() error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	c.client.Close()
+	e := c.conn.Close()
+	c.conn, c.client = nil, nil
+	return e
+}
+
+func (c *SFTPClient) fullPath(p string) string {
+	return path.Join(c.RootPath, strings.Trim(p, "/"))
+}
+
+// GetEndpointInfo returns info about this endpoint.
+func (c *SFTPClient) GetEndpointInfo() model.EndpointInfo {
+	return model.EndpointInfo{
+		URI:                   c.uri,
+		RequiresFoldersRescan: true,
+	}
+}
+
+// SetRefHashStore passes a reference to a loaded snapshot, used to find the hash of unmodified files.
+func (c *SFTPClient) SetRefHashStore(source model.PathSyncSource) {
+	c.refHashStore = source
+}
+
+// LoadNode stats a remote file or folder. The hash of files is computed if it cannot be found in the reference snapshot.
+func (c *SFTPClient) LoadNode(ctx context.Context, p string, extendedStats ...bool) (tree.N, error) {
+	cl, e := c.sftp()
+	if e != nil {
+		return nil, e
+	}
+	p = strings.Trim(p, "/")
+	stat, e := cl.Stat(c.fullPath(p))
+	if e != nil {
+		if errors.Is(e, fs.ErrNotExist) {
+			return nil, errors2.NotFound("not.found", p, e)
+		}
+		return nil, e
+	}
+	return c.loadNode(ctx, cl, p, stat, true)
+}
+
+// ComputeChecksum reads the remote file to compute its hash.
+func (c *SFTPClient) ComputeChecksum(_ context.Context, node tree.N) error {
+	cl, e := c.sftp()
+	if e != nil {
+		return e
+	}
+	hash, e := c.getFileHash(cl, c.fullPath(node.GetPath()))
+	if e != nil {
+		return e
+	}
+	node.UpdateEtag(hash)
+	return nil
+}
+
+// Walk lists the remote tree. The hash of modified files is left empty and is computed with ComputeChecksum.
+func (c *SFTPClient) Walk(ctx context.Context, walkFunc model.WalkNodesFunc, root string, recursive bool) error {
+	cl, e := c.sftp()
+	if e != nil {
+		return e
+	}
+	return c.walkInfos(ctx, cl, strings.Trim(root, "/"), recursive, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return walkFunc("", nil, err)
+		}
+		node, er := c.loadNode(ctx, cl, p, info, false)
+		if er != nil {
+			return walkFunc("", nil, er)
+		}
+		return walkFunc(p, node, nil)
+	})
+}
+
+// walkInfos lists the remote tree in lexical order, skipping temporary files and special files.
+func (c *SFTPClient) walkInfos(ctx context.Context, cl *sftp.Client, dir string, recursive bool, walkFunc func(p string, info os.FileInfo, err error) error) error {
+	if ctx != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	infos, e := cl.ReadDir(c.fullPath(dir))
+	if e != nil {
+		return walkFunc(dir, nil, e)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), filesystem.SyncTmpPrefix) || (!info.IsDir() && !info.Mode().IsRegular()) {
+			continue
+		}
+		p := path.Join(dir, info.Name())
+		if er := walkFunc(p, info, nil); er != nil {
+			return er
+		}
+		if recursive && info.IsDir() {
+			if er := c.walkInfos(ctx, cl, p, recursive, walkFunc); er != nil {
+				return er
+			}
+		}
+	}
+	return nil
+}
+
+// Watch scans the tree every PollInterval and emits events for the files and folders that were created,
+// modified or removed since the previous scan.
+func (c *SFTPClient) Watch(recursivePath string) (*model.WatchObject, error) {
+	return newPollingWatch(c, recursivePath, func() time.Duration { return c.PollInterval }, c.scan)
+}
+
+// scan records the size and modification time of all the files and folders under root.
+func (c *SFTPClient) scan(root string) (map[string]pollEntry, error) {
+	cl, e := c.sftp()
+	if e != nil {
+		return nil, e
+	}
+	entries := make(map[string]pollEntry)
+	e = c.walkInfos(context.Background(), cl, strings.Trim(root, "/"), true, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entries[p] = pollEntry{size: info.Size(), mTime: info.ModTime(), folder: info.IsDir()}
+		return nil
+	})
+	return entries, e
+}
+
+// CreateNode creates a folder and its hidden file storing the folder uuid.
+func (c *SFTPClient) CreateNode(_ context.Context, node tree.N, _ bool) error {
+	if node.IsLeaf() {
+		return errors.New("this is a DataSyncTarget, use PutNode for leafs instead of CreateNode")
+	}
+	cl, e := c.sftp()
+	if e != nil {
+		return e
+	}
+	fPath := c.fullPath(node.GetPath())
+	if _, e := cl.Stat(fPath); e == nil || !errors.Is(e, fs.ErrNotExist) {
+		return e
+	}
+	if e := cl.MkdirAll(fPath); e != nil {
+		return e
+	}
+	if node.GetUuid() != "" && !c.options.BrowseOnly {
+		return c.writeFile(cl, path.Join(fPath, common.PydioSyncHiddenFile), node.GetUuid())
+	}
+	return nil
+}
+
+// DeleteNode removes a file or a folder recursively.
+func (c *SFTPClient) DeleteNode(_ context.Context, p string) error {
+	cl, e := c.sftp()
+	if e != nil {
+		return e
+	}
+	fPath := c.fullPath(p)
+	if _, e := cl.Stat(fPath); e != nil {
+		if errors.Is(e, fs.ErrNotExist) {
+			return nil
+		}
+		return e
+	}
+	return cl.RemoveAll(fPath)
+}
+
+// MoveNode renames a file or a folder.
+func (c *SFTPClient) MoveNode(_ context.Context, oldPath string, newPath string) error {
+	cl, e := c.sftp()
+	if e != nil {
+		return e
+	}
+	oldPath = c.fullPath(oldPath)
+	if _, e := cl.Stat(oldPath); e != nil {
+		if errors.Is(e, fs.ErrNotExist) {
+			return nil
+		}
+		return e
+	}
+	return c.rename(cl, oldPath, c.fullPath(newPath))
+}
+
+// rename moves a file, overwriting the target if it exists.
+func (c *SFTPClient) rename(cl *sftp.Client, from, to string) error {
+	if _, ok := cl.HasExtension("posix-rename@openssh.com"); ok {
+		return cl.PosixRename(from, to)
+	}
+	if stat, e := cl.Stat(to); e == nil && !stat.IsDir() {
+		if e := cl.Remove(to); e != nil {
+			return e
+		}
+	}
+	return cl.Rename(from, to)
+}
+
+// GetReaderOn opens a remote file for reading.
+func (c *SFTPClient) GetReaderOn(_ context.Context, p string) (io.ReadCloser, error) {
+	cl, e := c.sftp()
+	if e != nil {
+		return nil, e
+	}
+	return cl.Open(c.fullPath(p))
+}
+
+// GetWriterOn writes to a temporary file that replaces the target file once closed.
+func (c *SFTPClient) GetWriterOn(cancel context.Context, p string, _ int64) (io.WriteCloser, chan bool, chan error, error) {
+	if path.Base(p) == common.PydioSyncHiddenFile && strings.Trim(p, "/") != common.PydioSyncHiddenFile {
+		return &filesystem.Discarder{}, nil, nil, nil
+	}
+	cl, e := c.sftp()
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	target := c.fullPath(p)
+	tmpPath := path.Join(path.Dir(target), filesystem.SyncTmpPrefix+path.Base(target))
+	file, e := cl.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if e != nil {
+		return nil, nil, nil, e
+	}
+	return &sftpWriter{File: file, client: c, sftp: cl, tmpPath: tmpPath, targetPath: target, cancellable: cancel}, nil, nil, nil
+}
+
+// sftpWriter moves the temporary file to its target when closed, unless the context was cancelled.
+type sftpWriter struct {
+	*sftp.File
+	client      *SFTPClient
+	sftp        *sftp.Client
+	tmpPath     string
+	targetPath  string
+	cancellable context.Context
+}
+
+// Close finishes the upload.
+func (w *sftpWriter) Close() error {
+	if e := w.cancellable.Err(); e != nil {
+		w.File.Close()
+		w.sftp.Remove(w.tmpPath)
+		return e
+	}
+	if e := w.File.Close(); e != nil {
+		w.sftp.Remove(w.tmpPath)
+		return e
+	}
+	return w.client.rename(w.sftp, w.tmpPath, w.targetPath)
+}
+
+func (c *SFTPClient) writeFile(cl *sftp.Client, p string, content string) error {
+	f, e := cl.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if e != nil {
+		return e
+	}
+	if _, e := f.Write([]byte(content)); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// readOrCreateFolderId reads the folder uuid from its hidden file, creating it if necessary.
+func (c *SFTPClient) readOrCreateFolderId(cl *sftp.Client, folder string) (string, error) {
+	if c.options.BrowseOnly {
+		return uuid.New(), nil
+	}
+	hiddenFile := path.Join(folder, common.PydioSyncHiddenFile)
+	f, e := cl.Open(hiddenFile)
+	if e != nil {
+		if !errors.Is(e, fs.ErrNotExist) {
+			return "", e
+		}
+		uid := uuid.New()
+		if e := c.writeFile(cl, hiddenFile, uid); e != nil {
+			return "", e
+		}
+		return uid, nil
+	}
+	defer f.Close()
+	content, e := io.ReadAll(f)
+	if e != nil {
+		return "", e
+	}
+	return string(content), nil
+}
+
+func (c *SFTPClient) getFileHash(cl *sftp.Client, p string) (string, error) {
+	f, e := cl.Open(p)
+	if e != nil {
+		return "", e
+	}
+	defer f.Close()
+	return contentHash(f)
+}
+
+func (c *SFTPClient) loadNode(ctx context.Context, cl *sftp.Client, p string, stat os.FileInfo, computeHash bool) (tree.N, error) {
+	if stat.IsDir() {
+		uid, e := c.readOrCreateFolderId(cl, c.fullPath(p))
+		if e != nil {
+			return nil, e
+		}
+		return tree.LightNode(tree.NodeType_COLLECTION, uid, p, "", stat.Size(), stat.ModTime().Unix(), int32(stat.Mode())), nil
+	}
+	hash := refHash(ctx, c.refHashStore, p, stat.Size(), stat.ModTime())
+	if hash == "" && computeHash {
+		var e error
+		if hash, e = c.getFileHash(cl, c.fullPath(p)); e != nil {
+			return nil, e
+		}
+	}
+	return tree.LightNode(tree.NodeType_LEAF, "", p, hash, stat.Size(), stat.ModTime().Unix(), int32(stat.Mode())), nil
+}
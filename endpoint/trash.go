@@ -0,0 +1,340 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+)
+
+// Reasons for moving a node to the trash.
+const (
+	TrashReasonDelete    = "delete"
+	TrashReasonOverwrite = "overwrite"
+)
+
+const (
+	trashMetaFile = "item.json"
+	trashDataFile = "data"
+)
+
+// TrashItem describes a file or folder kept in the trash.
+type TrashItem struct {
+	ID string
+	// Path is the path of the node relative to the endpoint Root.
+	Path    string
+	Root    string
+	Reason  string
+	Trashed time.Time
+	Size    int64
+	IsDir   bool
+}
+
+// Trash keeps deleted or overwritten local content in a folder of the task data dir. Each item is stored in
+// its own sub-folder, along with a JSON description, so that the trash can be browsed without a running sync.
+type Trash struct {
+	sync.Mutex
+	folder    string
+	retention time.Duration
+}
+
+// NewTrash creates a Trash storing items inside folder. Items older than retention are removed by Prune.
+func NewTrash(folder string, retention time.Duration) *Trash {
+	return &Trash{
+		folder:    folder,
+		retention: retention,
+	}
+}
+
+// Put moves the node found at path inside root to the trash.
+// It returns an os.IsNotExist error if there is nothing to move.
+func (t *Trash) Put(root, nodePath, reason string) (*TrashItem, error) {
+	source := trashLocalPath(root, nodePath)
+	stat, e := os.Stat(source)
+	if e != nil {
+		return nil, e
+	}
+	item := &TrashItem{
+		ID:      fmt.Sprintf("%d-%s", time.Now().UnixNano(), uuid.New()[:8]),
+		Path:    strings.Trim(nodePath, "/"),
+		Root:    root,
+		Reason:  reason,
+		Trashed: time.Now(),
+		IsDir:   stat.IsDir(),
+	}
+	if !item.IsDir {
+		item.Size = stat.Size()
+	}
+	t.Lock()
+	defer t.Unlock()
+	itemFolder := filepath.Join(t.folder, item.ID)
+	if e := os.MkdirAll(itemFolder, 0755); e != nil {
+		return nil, e
+	}
+	if e := moveAll(source, filepath.Join(itemFolder, trashDataFile)); e != nil {
+		os.RemoveAll(itemFolder)
+		return nil, e
+	}
+	data, _ := json.Marshal(item)
+	if e := os.WriteFile(filepath.Join(itemFolder, trashMetaFile), data, 0644); e != nil {
+		return nil, e
+	}
+	return item, nil
+}
+
+// List loads all items, most recently trashed first.
+func (t *Trash) List() (items []*TrashItem, e error) {
+	t.Lock()
+	defer t.Unlock()
+	return t.list()
+}
+
+// Get finds an item by its ID.
+func (t *Trash) Get(id string) (*TrashItem, error) {
+	t.Lock()
+	defer t.Unlock()
+	return t.get(id)
+}
+
+// Restore moves an item back to its original location and returns the restored path. If the location is
+// already taken, the item is restored next to it with a "restored" suffix.
+func (t *Trash) Restore(id string) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	item, e := t.get(id)
+	if e != nil {
+		return "", e
+	}
+	target := item.Path
+	if _, e := os.Stat(trashLocalPath(item.Root, target)); e == nil {
+		ext := path.Ext(target)
+		target = fmt.Sprintf("%s-restored-%s%s", strings.TrimSuffix(target, ext), time.Now().Format("20060102-150405"), ext)
+	}
+	targetPath := trashLocalPath(item.Root, target)
+	if e := os.MkdirAll(filepath.Dir(targetPath), 0755); e != nil {
+		return "", e
+	}
+	if e := moveAll(filepath.Join(t.folder, item.ID, trashDataFile), targetPath); e != nil {
+		return "", e
+	}
+	return target, os.RemoveAll(filepath.Join(t.folder, item.ID))
+}
+
+// Empty removes all items from the trash.
+func (t *Trash) Empty() error {
+	t.Lock()
+	defer t.Unlock()
+	return os.RemoveAll(t.folder)
+}
+
+// Prune removes the items that are older than the retention, and returns the number of removed items.
+func (t *Trash) Prune() (int, error) {
+	if t.retention <= 0 {
+		return 0, nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	items, e := t.list()
+	if e != nil {
+		return 0, e
+	}
+	var count int
+	limit := time.Now().Add(-t.retention)
+	for _, item := range items {
+		if item.Trashed.Before(limit) {
+			if e := os.RemoveAll(filepath.Join(t.folder, item.ID)); e != nil {
+				return count, e
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (t *Trash) list() (items []*TrashItem, e error) {
+	entries, e := os.ReadDir(t.folder)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, nil
+		}
+		return nil, e
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if item, er := t.get(entry.Name()); er == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Trashed.After(items[j].Trashed)
+	})
+	return
+}
+
+func (t *Trash) get(id string) (*TrashItem, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid trash item id")
+	}
+	data, e := os.ReadFile(filepath.Join(t.folder, id, trashMetaFile))
+	if e != nil {
+		if os.IsNotExist(e) {
+			return nil, fmt.Errorf("cannot find trash item %s", id)
+		}
+		return nil, e
+	}
+	item := &TrashItem{}
+	if e := json.Unmarshal(data, item); e != nil {
+		return nil, e
+	}
+	return item, nil
+}
+
+// trashLocalPath converts a sync path to the path of the node inside root, the same way the filesystem client
+// does: sync paths are NFC-normalized while names are stored NFD-normalized on macOS.
+func trashLocalPath(root, nodePath string) string {
+	nodePath = strings.Trim(nodePath, "/")
+	if runtime.GOOS == "darwin" {
+		nodePath = norm.NFD.String(nodePath)
+	}
+	return filepath.Join(root, filepath.FromSlash(nodePath))
+}
+
+// moveAll renames source to target, falling back to a copy when they are not on the same volume.
+func moveAll(source, target string) error {
+	if e := os.Rename(source, target); e == nil {
+		return nil
+	}
+	if e := copyAll(source, target); e != nil {
+		os.RemoveAll(target)
+		return e
+	}
+	return os.RemoveAll(source)
+}
+
+func copyAll(source, target string) error {
+	return filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(source, p)
+		dest := filepath.Join(target, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dest, info.Mode().Perm())
+		}
+		in, e := os.Open(p)
+		if e != nil {
+			return e
+		}
+		defer in.Close()
+		out, e := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if e != nil {
+			return e
+		}
+		if _, e := io.Copy(out, in); e != nil {
+			out.Close()
+			return e
+		}
+		return out.Close()
+	})
+}
+
+// TrashFSClient wraps a filesystem client to move deleted and overwritten nodes to a Trash
+// instead of removing them.
+type TrashFSClient struct {
+	*filesystem.FSClient
+	Trash *Trash
+}
+
+// NewTrashFSClient wraps the client.
+func NewTrashFSClient(client *filesystem.FSClient, trash *Trash) *TrashFSClient {
+	return &TrashFSClient{
+		FSClient: client,
+		Trash:    trash,
+	}
+}
+
+// DeleteNode moves the node to the trash before letting the client update its snapshot.
+func (c *TrashFSClient) DeleteNode(ctx context.Context, nodePath string) error {
+	if c.trashable(nodePath) {
+		if _, e := c.Trash.Put(c.RootPath, nodePath, TrashReasonDelete); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+	}
+	return c.FSClient.DeleteNode(ctx, nodePath)
+}
+
+// GetWriterOn wraps the client writer to move the existing file to the trash before it is replaced.
+func (c *TrashFSClient) GetWriterOn(cancel context.Context, nodePath string, targetSize int64) (out io.WriteCloser, writeDone chan bool, writeErr chan error, err error) {
+	out, writeDone, writeErr, err = c.FSClient.GetWriterOn(cancel, nodePath, targetSize)
+	if err != nil || !c.trashable(nodePath) {
+		return
+	}
+	if _, ok := out.(*filesystem.Discarder); ok {
+		return
+	}
+	return &trashWriter{WriteCloser: out, client: c, nodePath: nodePath, ctx: cancel}, writeDone, writeErr, nil
+}
+
+func (c *TrashFSClient) trashable(nodePath string) bool {
+	base := path.Base(nodePath)
+	return strings.Trim(nodePath, "/") != "" && base != common.PydioSyncHiddenFile && !strings.HasPrefix(base, filesystem.SyncTmpPrefix)
+}
+
+type trashWriter struct {
+	io.WriteCloser
+	client   *TrashFSClient
+	nodePath string
+	ctx      context.Context
+}
+
+// Close moves the previous version to the trash before the temporary file replaces it. The previous
+// version is put back if the write failed.
+func (w *trashWriter) Close() error {
+	item, e := w.client.Trash.Put(w.client.RootPath, w.nodePath, TrashReasonOverwrite)
+	if e != nil && !os.IsNotExist(e) {
+		log.Logger(w.ctx).Warn("Cannot move previous version of " + w.nodePath + " to trash: " + e.Error())
+	}
+	err := w.WriteCloser.Close()
+	if err != nil && item != nil {
+		if _, e := w.client.Trash.Restore(item.ID); e != nil {
+			log.Logger(w.ctx).Error("Cannot restore previous version of " + w.nodePath + ": " + e.Error())
+		}
+	}
+	return err
+}
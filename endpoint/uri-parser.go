@@ -23,6 +23,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os/user"
 	"path/filepath"
@@ -44,6 +45,10 @@ import (
 // EndpointFromURI parse an URI string to instantiate a proper Endpoint
 func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.Endpoint, e error) {
 
+	if strings.HasPrefix(uri, EncryptedScheme) {
+		return encryptedEndpointFromURI(uri, otherUri, browseOnly...)
+	}
+
 	u, e := url.Parse(uri)
 	if e != nil {
 		return nil, e
@@ -67,7 +72,10 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 		return filesystem.NewFSClient(path, opts)
 
 	case "db":
-		return memory.NewMemDB(), nil
+		if u.Path == "" || u.Path == "/" {
+			return memory.NewMemDB(), nil
+		}
+		return NewDBClient(u.Path, opts)
 
 		/*
 			case "router":
@@ -138,9 +146,20 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 		parts = parts[2:]
 		rootPath := strings.Join(parts, "/")
 		if u.User == nil {
-			return nil, errors.New("please provide API keys and secret in URL")
+			return nil, errors.New("please provide the credentials name in URL")
+		}
+		// Inline secrets are only accepted for browsing before a task is saved, they are moved to credentials on save
+		apiKey := u.User.Username()
+		password, ok := u.User.Password()
+		if ok && !opts.BrowseOnly {
+			return nil, errors.New("inline secrets are only supported for browsing, please register credentials instead")
+		} else if !ok {
+			creds := config.Default().FindCredentials(config.CredentialsId(u))
+			if creds == nil {
+				return nil, fmt.Errorf("cannot find credentials %s", config.CredentialsId(u))
+			}
+			apiKey, password = creds.Login, creds.GetSecret()
 		}
-		password, _ := u.User.Password()
 		values := u.Query()
 		normalize := values.Get("normalize") == "true"
 		secure := strings.Contains(u.Hostname(), "amazonaws.com") || values.Get("secure") == "true"
@@ -148,7 +167,7 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 		cfg.Val("type").Set("mc")
 		cfg.Val("endpoint").Set(u.Host)
 		cfg.Val("secure").Set(secure)
-		cfg.Val("key").Set(u.User.Username())
+		cfg.Val("key").Set(apiKey)
 		cfg.Val("secret").Set(password)
 		oc, e := nodes.NewStorageClient(cfg)
 		if e != nil {
@@ -160,12 +179,61 @@ func EndpointFromURI(uri string, otherUri string, browseOnly ...bool) (ep model.
 		}
 		return client, nil
 
+	case "sftp":
+		if u.User == nil {
+			return nil, errors.New("please provide a user name in URL")
+		}
+		identity := config.Default().FindSSHIdentity(config.SSHIdentityId(u.User.Username(), u.Host))
+		return NewSFTPClient(u, identity, opts)
+
+	case "webdav", "webdavs":
+		return NewWebDAVClient(u, config.Default().FindCredentials(config.CredentialsId(u)), opts)
+
 	default:
 		return nil, fmt.Errorf("unsupported scheme " + u.Scheme)
 	}
 
 }
 
+// encryptedEndpointFromURI wraps the endpoint described by the rest of the URI. The encryption key is never stored
+// in the config, it is loaded from the keyring.
+func encryptedEndpointFromURI(uri string, otherUri string, browseOnly ...bool) (model.Endpoint, error) {
+	innerURI := strings.TrimPrefix(uri, EncryptedScheme)
+	u, e := url.Parse(innerURI)
+	if e != nil {
+		return nil, e
+	}
+	keyName := u.Query().Get("key")
+	if keyName == "" {
+		keyName = DefaultEncryptionKey
+	}
+	key, e := config.EncryptionKeyFromKeyring(keyName)
+	if e != nil {
+		return nil, fmt.Errorf("cannot find encryption key %s in keyring: %s", keyName, e.Error())
+	}
+	inner, e := EndpointFromURI(innerURI, otherUri, browseOnly...)
+	if e != nil {
+		return nil, e
+	}
+	opts := model.EndpointOptions{}
+	if len(browseOnly) > 0 && browseOnly[0] {
+		opts.BrowseOnly = true
+	}
+	ep, e := NewEncryptedEndpoint(inner, key, opts)
+	if e != nil {
+		CloseEndpoint(inner)
+		return nil, e
+	}
+	return ep, nil
+}
+
+// CloseEndpoint releases the connections held by an endpoint, if it supports it.
+func CloseEndpoint(ep model.Endpoint) {
+	if closer, ok := ep.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
 // DefaultDirForURI tries to find a default directory to display to user when they choose a specific endpoint.
 // Currently only used for FS, returning ${HOMEDIR}/Cells
 func DefaultDirForURI(uri string) string {
@@ -0,0 +1,506 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package endpoint
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pydio/cells-sync/common"
+	"github.com/pydio/cells-sync/config"
+
+	common2 "github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/log"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	errors2 "github.com/pydio/cells/v4/common/service/errors"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/utils/uuid"
+)
+
+// WebDAVPollInterval is the default delay between two scans of a webdav(s):// endpoint when watching for changes.
+// It can be overridden with the "poll" query parameter of the URI, e.g. webdavs://user@host/path?poll=5m
+const WebDAVPollInterval = time.Minute
+
+// WebDAVResponseTimeout is the maximum delay to wait for the server response once a request is sent. The transfers
+// themselves are not limited, as large files may take a long time to upload or download.
+const WebDAVResponseTimeout = 2 * time.Minute
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/></D:prop></D:propfind>`
+
+// WebDAVClient is a sync endpoint storing files in a folder of a WebDAV share. The webdav:// and webdavs:// schemes
+// respectively use http and https. Credentials are looked up in the config, with their secret stored in the keyring.
+// Changes are detected by regularly scanning the tree and comparing the server ETags and modification times.
+type WebDAVClient struct {
+	RootPath     string
+	PollInterval time.Duration
+
+	uri          string
+	baseURL      url.URL
+	credentials  *config.Credentials
+	options      model.EndpointOptions
+	refHashStore model.PathSyncSource
+	httpClient   *http.Client
+}
+
+// davInfo is a resource listed by a PROPFIND request.
+type davInfo struct {
+	path   string
+	folder bool
+	size   int64
+	mTime  time.Time
+	etag   string
+}
+
+type davMultiStatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		PropStats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// NewWebDAVClient creates a client for the share described by the URI and checks that the root folder exists.
+// Credentials may be nil for anonymous shares.
+func NewWebDAVClient(u *url.URL, credentials *config.Credentials, options model.EndpointOptions) (*WebDAVClient, error) {
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return nil, errors.New("passwords are not supported in webdav URLs, please register credentials instead")
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = WebDAVResponseTimeout
+	c := &WebDAVClient{
+		RootPath:    strings.TrimRight(path.Clean("/"+u.Path), "/"),
+		credentials: credentials,
+		options:     options,
+		httpClient:  &http.Client{Transport: transport},
+	}
+	c.baseURL = url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "webdavs" {
+		c.baseURL.Scheme = "https"
+	} else if credentials != nil {
+		log.Logger(context.Background()).Warn(fmt.Sprintf("Credentials for %s are sent unencrypted, use webdavs:// if the server supports https", u.Host))
+	}
+	c.uri = config.CredentialsId(u) + c.RootPath
+	var e error
+	if c.PollInterval, e = pollInterval(u, WebDAVPollInterval); e != nil {
+		return nil, e
+	}
+	root, e := c.stat(context.Background(), "")
+	if e != nil {
+		return nil, fmt.Errorf("cannot stat root folder %s: %s", c.RootPath, e.Error())
+	}
+	if !root.folder {
+		return nil, fmt.Errorf("root %s is not a folder", c.RootPath)
+	}
+	return c, nil
+}
+
+// resourceURL builds the URL of a resource. A trailing slash is kept, as some servers require it for collections.
+func (c *WebDAVClient) resourceURL(p string) string {
+	u := c.baseURL
+	u.Path = c.RootPath + "/" + strings.Trim(p, "/")
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// do sends an authenticated request and returns an error for non-2xx responses. The response body must be closed.
+func (c *WebDAVClient) do(ctx context.Context, method, p string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, e := http.NewRequestWithContext(ctx, method, c.resourceURL(p), body)
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("User-Agent", "cells-sync/"+common.Version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.credentials != nil {
+		req.SetBasicAuth(c.credentials.Login, c.credentials.GetSecret())
+	}
+	resp, e := c.httpClient.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors2.NotFound("not.found", p)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, p, resp.Status)
+	}
+	return resp, nil
+}
+
+// propfind lists a resource (depth 0) or a folder and its direct children (depth 1).
+func (c *WebDAVClient) propfind(ctx context.Context, p string, depth string) ([]davInfo, error) {
+	resp, e := c.do(ctx, "PROPFIND", p, strings.NewReader(propfindBody), map[string]string{"Depth": depth, "Content-Type": "application/xml; charset=utf-8"})
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	var ms davMultiStatus
+	if e := xml.NewDecoder(resp.Body).Decode(&ms); e != nil {
+		return nil, e
+	}
+	var infos []davInfo
+	for _, r := range ms.Responses {
+		href, e := url.Parse(r.Href)
+		if e != nil {
+			return nil, e
+		}
+		rel := strings.TrimPrefix(strings.TrimRight(href.Path, "/"), c.RootPath)
+		if rel != "" && !strings.HasPrefix(rel, "/") {
+			continue
+		}
+		for _, ps := range r.PropStats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			info := davInfo{
+				path:   strings.Trim(rel, "/"),
+				folder: ps.Prop.ResourceType.Collection != nil,
+				etag:   strings.Trim(strings.TrimPrefix(ps.Prop.ETag, "W/"), "\""),
+			}
+			info.size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			info.mTime, _ = http.ParseTime(ps.Prop.LastModified)
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (c *WebDAVClient) stat(ctx context.Context, p string) (davInfo, error) {
+	infos, e := c.propfind(ctx, p, "0")
+	if e != nil {
+		return davInfo{}, e
+	}
+	if len(infos) == 0 {
+		return davInfo{}, errors2.NotFound("not.found", p)
+	}
+	return infos[0], nil
+}
+
+// GetEndpointInfo returns info about this endpoint.
+func (c *WebDAVClient) GetEndpointInfo() model.EndpointInfo {
+	return model.EndpointInfo{
+		URI:                   c.uri,
+		RequiresFoldersRescan: true,
+	}
+}
+
+// SetRefHashStore passes a reference to a loaded snapshot, used to find the hash of unmodified files.
+func (c *WebDAVClient) SetRefHashStore(source model.PathSyncSource) {
+	c.refHashStore = source
+}
+
+// LoadNode stats a remote resource. The hash of files is computed if it cannot be found in the reference snapshot,
+// except in browse-only mode.
+func (c *WebDAVClient) LoadNode(ctx context.Context, p string, extendedStats ...bool) (tree.N, error) {
+	info, e := c.stat(ctx, strings.Trim(p, "/"))
+	if e != nil {
+		return nil, e
+	}
+	return c.loadNode(ctx, info, !c.options.BrowseOnly)
+}
+
+// ComputeChecksum downloads the remote file to compute its hash.
+func (c *WebDAVClient) ComputeChecksum(ctx context.Context, node tree.N) error {
+	hash, e := c.getFileHash(ctx, node.GetPath())
+	if e != nil {
+		return e
+	}
+	node.UpdateEtag(hash)
+	return nil
+}
+
+// Walk lists the remote tree with PROPFIND requests. The hash of modified files is left empty and is computed
+// with ComputeChecksum.
+func (c *WebDAVClient) Walk(ctx context.Context, walkFunc model.WalkNodesFunc, root string, recursive bool) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.walkInfos(ctx, strings.Trim(root, "/"), recursive, func(info davInfo, err error) error {
+		if err != nil {
+			return walkFunc("", nil, err)
+		}
+		node, er := c.loadNode(ctx, info, false)
+		if er != nil {
+			return walkFunc("", nil, er)
+		}
+		return walkFunc(info.path, node, nil)
+	})
+}
+
+// walkInfos lists folders one level at a time, as many servers refuse "Depth: infinity" requests.
+func (c *WebDAVClient) walkInfos(ctx context.Context, dir string, recursive bool, walkFunc func(info davInfo, err error) error) error {
+	if e := ctx.Err(); e != nil {
+		return e
+	}
+	infos, e := c.propfind(ctx, dir, "1")
+	if e != nil {
+		return walkFunc(davInfo{path: dir}, e)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].path < infos[j].path
+	})
+	for _, info := range infos {
+		if info.path == dir || strings.HasPrefix(path.Base(info.path), filesystem.SyncTmpPrefix) {
+			continue
+		}
+		if er := walkFunc(info, nil); er != nil {
+			return er
+		}
+		if recursive && info.folder {
+			if er := c.walkInfos(ctx, info.path, recursive, walkFunc); er != nil {
+				return er
+			}
+		}
+	}
+	return nil
+}
+
+// Watch scans the tree every PollInterval and emits events for the resources whose ETag, size or modification time
+// changed since the previous scan.
+func (c *WebDAVClient) Watch(recursivePath string) (*model.WatchObject, error) {
+	return newPollingWatch(c, recursivePath, func() time.Duration { return c.PollInterval }, c.scan)
+}
+
+func (c *WebDAVClient) scan(root string) (map[string]pollEntry, error) {
+	entries := make(map[string]pollEntry)
+	e := c.walkInfos(context.Background(), strings.Trim(root, "/"), true, func(info davInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entries[info.path] = pollEntry{size: info.size, mTime: info.mTime, etag: info.etag, folder: info.folder}
+		return nil
+	})
+	return entries, e
+}
+
+// CreateNode creates a folder and its parents with MKCOL requests, and the hidden file storing the folder uuid.
+func (c *WebDAVClient) CreateNode(ctx context.Context, node tree.N, _ bool) error {
+	if node.IsLeaf() {
+		return errors.New("this is a DataSyncTarget, use PutNode for leafs instead of CreateNode")
+	}
+	p := strings.Trim(node.GetPath(), "/")
+	if _, e := c.stat(ctx, p); e == nil || !isNotFound(e) {
+		return e
+	}
+	var current string
+	for _, part := range strings.Split(p, "/") {
+		current = path.Join(current, part)
+		if _, e := c.stat(ctx, current); e == nil {
+			continue
+		}
+		resp, e := c.do(ctx, "MKCOL", current+"/", nil, nil)
+		if e != nil {
+			return e
+		}
+		resp.Body.Close()
+	}
+	if node.GetUuid() != "" && !c.options.BrowseOnly {
+		return c.put(ctx, path.Join(p, common2.PydioSyncHiddenFile), strings.NewReader(node.GetUuid()), int64(len(node.GetUuid())))
+	}
+	return nil
+}
+
+// DeleteNode removes a resource, folders are removed recursively by the server.
+func (c *WebDAVClient) DeleteNode(ctx context.Context, p string) error {
+	resp, e := c.do(ctx, http.MethodDelete, p, nil, nil)
+	if e != nil {
+		if isNotFound(e) {
+			return nil
+		}
+		return e
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// MoveNode moves a resource with a MOVE request, overwriting the target.
+func (c *WebDAVClient) MoveNode(ctx context.Context, oldPath string, newPath string) error {
+	return c.transfer(ctx, "MOVE", oldPath, newPath)
+}
+
+// CopyNode copies a resource on the server side with a COPY request, overwriting the target.
+func (c *WebDAVClient) CopyNode(ctx context.Context, fromPath string, toPath string) error {
+	return c.transfer(ctx, "COPY", fromPath, toPath)
+}
+
+func (c *WebDAVClient) transfer(ctx context.Context, method, from, to string) error {
+	resp, e := c.do(ctx, method, from, nil, map[string]string{"Destination": c.resourceURL(to), "Overwrite": "T"})
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetReaderOn downloads a remote file.
+func (c *WebDAVClient) GetReaderOn(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, e := c.do(ctx, http.MethodGet, p, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	return resp.Body, nil
+}
+
+// GetWriterOn uploads to a temporary file that is moved to the target once the writer is closed.
+func (c *WebDAVClient) GetWriterOn(cancel context.Context, p string, targetSize int64) (io.WriteCloser, chan bool, chan error, error) {
+	if path.Base(p) == common2.PydioSyncHiddenFile && strings.Trim(p, "/") != common2.PydioSyncHiddenFile {
+		return &filesystem.Discarder{}, nil, nil, nil
+	}
+	p = strings.Trim(p, "/")
+	tmpPath := path.Join(path.Dir(p), filesystem.SyncTmpPrefix+path.Base(p))
+	reader, writer := io.Pipe()
+	w := &webdavWriter{PipeWriter: writer, done: make(chan error, 1)}
+	go func() {
+		e := c.put(cancel, tmpPath, reader, targetSize)
+		if e == nil {
+			e = c.MoveNode(cancel, tmpPath, p)
+		}
+		if e != nil {
+			_ = c.DeleteNode(context.Background(), tmpPath)
+		}
+		reader.CloseWithError(e)
+		w.done <- e
+	}()
+	return w, nil, nil, nil
+}
+
+// webdavWriter waits for the end of the upload when closed.
+type webdavWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// Close finishes the upload and returns its error.
+func (w *webdavWriter) Close() error {
+	_ = w.PipeWriter.Close()
+	return <-w.done
+}
+
+func (c *WebDAVClient) put(ctx context.Context, p string, body io.Reader, size int64) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, e := http.NewRequestWithContext(ctx, http.MethodPut, c.resourceURL(p), body)
+	if e != nil {
+		return e
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	req.Header.Set("User-Agent", "cells-sync/"+common.Version)
+	if c.credentials != nil {
+		req.SetBasicAuth(c.credentials.Login, c.credentials.GetSecret())
+	}
+	resp, e := c.httpClient.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s: %s", p, resp.Status)
+	}
+	return nil
+}
+
+// readOrCreateFolderId reads the folder uuid from its hidden file, creating it if necessary.
+func (c *WebDAVClient) readOrCreateFolderId(ctx context.Context, folder string) (string, error) {
+	if c.options.BrowseOnly {
+		return uuid.New(), nil
+	}
+	hiddenFile := path.Join(folder, common2.PydioSyncHiddenFile)
+	resp, e := c.do(ctx, http.MethodGet, hiddenFile, nil, nil)
+	if e != nil {
+		if !isNotFound(e) {
+			return "", e
+		}
+		uid := uuid.New()
+		if e := c.put(ctx, hiddenFile, strings.NewReader(uid), int64(len(uid))); e != nil {
+			return "", e
+		}
+		return uid, nil
+	}
+	defer resp.Body.Close()
+	content, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return "", e
+	}
+	return string(content), nil
+}
+
+func (c *WebDAVClient) getFileHash(ctx context.Context, p string) (string, error) {
+	r, e := c.GetReaderOn(ctx, p)
+	if e != nil {
+		return "", e
+	}
+	defer r.Close()
+	return contentHash(r)
+}
+
+func (c *WebDAVClient) loadNode(ctx context.Context, info davInfo, computeHash bool) (tree.N, error) {
+	if info.folder {
+		uid, e := c.readOrCreateFolderId(ctx, info.path)
+		if e != nil {
+			return nil, e
+		}
+		return tree.LightNode(tree.NodeType_COLLECTION, uid, info.path, "", 0, info.mTime.Unix(), 0777), nil
+	}
+	hash := refHash(ctx, c.refHashStore, info.path, info.size, info.mTime)
+	if hash == "" && computeHash {
+		var e error
+		if hash, e = c.getFileHash(ctx, info.path); e != nil {
+			return nil, e
+		}
+	}
+	return tree.LightNode(tree.NodeType_LEAF, "", info.path, hash, info.size, info.mTime.Unix(), 0666), nil
+}
+
+func isNotFound(e error) bool {
+	return errors2.FromError(e).Code == http.StatusNotFound
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+func TestConfigBundle(t *testing.T) {
+
+	Convey("Test bundle export and import", t, func() {
+		g := &config.Global{
+			Tasks: []*config.Task{
+				{Uuid: "task1", Label: "Docs", LeftURI: "fs:///home/user/Documents", RightURI: "https://admin@cells.example.com/personal-files/docs", Direction: "Bi", RealtimePaused: true},
+				{Uuid: "task2", Label: "Backup", LeftURI: "fs:///home/user/Backup", RightURI: "s3://KEY:SECRET@s3.example.com/bucket/backup", Direction: "Right"},
+			},
+			Authorities: []*config.Authority{
+				{Id: "https://admin@cells.example.com", URI: "https://cells.example.com", Username: "admin", AccessToken: "access", RefreshToken: "refresh", IdToken: "id"},
+			},
+			Logs: &config.Logs{Folder: "/home/user/.config/pydio/cells-sync/logs", MaxFilesNumber: 8},
+		}
+
+		b, e := config.NewBundle(g, map[string]string{"HOME": "/home/user", "DOCS": "/home/user/Documents"})
+		So(e, ShouldBeNil)
+		So(b.Tasks[0].LeftURI, ShouldEqual, "fs://${DOCS}")
+		So(b.Tasks[0].RealtimePaused, ShouldBeFalse)
+		So(b.Tasks[1].LeftURI, ShouldEqual, "fs://${HOME}/Backup")
+		So(b.Tasks[1].RightURI, ShouldEqual, "s3://KEY:${SECRET_1}@s3.example.com/bucket/backup")
+		So(b.Logs.Folder, ShouldEqual, "${HOME}/.config/pydio/cells-sync/logs")
+		So(b.Authorities, ShouldHaveLength, 1)
+		So(b.Authorities[0].AccessToken, ShouldBeEmpty)
+		So(b.Authorities[0].RefreshToken, ShouldBeEmpty)
+		So(b.Authorities[0].IdToken, ShouldBeEmpty)
+		// Original config is untouched
+		So(g.Tasks[0].LeftURI, ShouldEqual, "fs:///home/user/Documents")
+		So(g.Tasks[0].RealtimePaused, ShouldBeTrue)
+		So(b.Variables(), ShouldResemble, []string{"DOCS", "HOME", "SECRET_1"})
+
+		for _, format := range []string{"yaml", "json"} {
+			data, e := b.Marshal(format)
+			So(e, ShouldBeNil)
+			parsed, e := config.ParseBundle(data)
+			So(e, ShouldBeNil)
+			So(parsed.Tasks, ShouldHaveLength, 2)
+			So(parsed.Tasks[1].RightURI, ShouldEqual, b.Tasks[1].RightURI)
+			So(parsed.Authorities[0].Id, ShouldEqual, "https://admin@cells.example.com")
+			So(parsed.Logs.MaxFilesNumber, ShouldEqual, 8)
+		}
+		_, e = b.Marshal("xml")
+		So(e, ShouldNotBeNil)
+		_, e = config.ParseBundle([]byte("Version: 99"))
+		So(e, ShouldNotBeNil)
+
+		b.Expand(map[string]string{"HOME": "/Users/other", "DOCS": "/Users/other/Docs", "SECRET_1": "NEW"})
+		So(b.Tasks[0].LeftURI, ShouldEqual, "fs:///Users/other/Docs")
+		So(b.Tasks[1].LeftURI, ShouldEqual, "fs:///Users/other/Backup")
+		So(b.Tasks[1].RightURI, ShouldEqual, "s3://KEY:NEW@s3.example.com/bucket/backup")
+
+		So(b.MissingAuthorities(g), ShouldBeEmpty)
+		So(b.MissingAuthorities(&config.Global{}), ShouldHaveLength, 1)
+	})
+
+	Convey("Test variables only match whole path segments and literal $ are kept", t, func() {
+		g := &config.Global{
+			Tasks: []*config.Task{
+				{Uuid: "task1", LeftURI: "fs:///home/userby/docs", RightURI: "fs:///home/user/$price", Direction: "Bi",
+					Hooks: &config.Hooks{BeforePatch: &config.Hook{Command: "touch"}}},
+			},
+		}
+		b, e := config.NewBundle(g, map[string]string{"HOME": "/home/user"})
+		So(e, ShouldBeNil)
+		So(b.Tasks[0].LeftURI, ShouldEqual, "fs:///home/userby/docs")
+		So(b.Tasks[0].RightURI, ShouldEqual, "fs://${HOME}/$price")
+		So(b.Tasks[0].Hooks, ShouldBeNil)
+		So(b.Variables(), ShouldResemble, []string{"HOME"})
+		b.Expand(map[string]string{"HOME": "/Users/other"})
+		So(b.Tasks[0].RightURI, ShouldEqual, "fs:///Users/other/$price")
+
+		parsed, e := config.ParseBundle([]byte(`{"Version": 1, "Tasks": [{"Uuid": "t", "Hooks": {"BeforePatch": {"Command": "rm"}}}]}`))
+		So(e, ShouldBeNil)
+		So(parsed.Tasks[0].Hooks, ShouldBeNil)
+	})
+
+}
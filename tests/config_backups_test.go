@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+func TestConfigBackups(t *testing.T) {
+
+	Convey("Test atomic writes", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-config")
+		defer os.RemoveAll(tmp)
+		target := filepath.Join(tmp, "config.json")
+		So(config.WriteFileAtomic(target, []byte("first"), 0600), ShouldBeNil)
+		So(config.WriteFileAtomic(target, []byte("second"), 0600), ShouldBeNil)
+		data, _ := os.ReadFile(target)
+		So(string(data), ShouldEqual, "second")
+		info, _ := os.Stat(target)
+		if runtime.GOOS != "windows" {
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+		}
+		entries, _ := os.ReadDir(tmp)
+		So(entries, ShouldHaveLength, 1)
+	})
+
+	Convey("Test rolling backups", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-config")
+		defer os.RemoveAll(tmp)
+		backups := &config.Backups{Folder: filepath.Join(tmp, "backups"), Prefix: "config-", Keep: 3}
+		list, e := backups.List()
+		So(e, ShouldBeNil)
+		So(list, ShouldBeEmpty)
+
+		for i := 0; i < 5; i++ {
+			_, e := backups.Save([]byte(fmt.Sprintf("version %d", i)))
+			So(e, ShouldBeNil)
+		}
+		list, e = backups.List()
+		So(e, ShouldBeNil)
+		So(list, ShouldHaveLength, 3)
+		data, e := backups.Read(list[0].Name)
+		So(e, ShouldBeNil)
+		So(string(data), ShouldEqual, "version 4")
+		data, _ = backups.Read(list[2].Name)
+		So(string(data), ShouldEqual, "version 2")
+
+		_, e = backups.Read("../config.json")
+		So(e, ShouldNotBeNil)
+	})
+
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+func TestConfigReload(t *testing.T) {
+
+	Convey("Test reloading config emits changes", t, func() {
+		auth := &config.Authority{Id: "https://admin@cells.example.com", URI: "https://cells.example.com", Username: "admin", AccessToken: "a1", RefreshToken: "r1"}
+		g := &config.Global{
+			Tasks: []*config.Task{
+				{Uuid: "kept", LeftURI: "fs:///a", RightURI: "fs:///b", Direction: "Bi"},
+				{Uuid: "updated", LeftURI: "fs:///c", RightURI: "fs:///d", Direction: "Bi"},
+				{Uuid: "removed", LeftURI: "fs:///e", RightURI: "fs:///f", Direction: "Bi"},
+			},
+			Authorities: []*config.Authority{
+				auth,
+				{Id: "https://other@cells.example.com", URI: "https://cells.example.com", Username: "other"},
+			},
+		}
+		newConf := &config.Global{
+			Tasks: []*config.Task{
+				{Uuid: "kept", LeftURI: "fs:///a", RightURI: "fs:///b", Direction: "Bi"},
+				{Uuid: "updated", LeftURI: "fs:///c", RightURI: "fs:///d", Direction: "Right"},
+				{Uuid: "created", LeftURI: "fs:///g", RightURI: "fs:///h", Direction: "Left"},
+			},
+			Authorities: []*config.Authority{
+				{Id: "https://admin@cells.example.com", URI: "https://cells.example.com", Username: "admin", AccessToken: "a2", RefreshToken: "r2"},
+			},
+			Logs: &config.Logs{MaxFilesNumber: 3},
+		}
+
+		events := g.Reload(newConf)
+		types := map[string]string{}
+		var authChanges []*config.AuthChange
+		for _, ev := range events {
+			switch change := ev.(type) {
+			case *config.TaskChange:
+				types[change.Task.Uuid] = change.Type
+			case *config.AuthChange:
+				authChanges = append(authChanges, change)
+			}
+		}
+		So(types, ShouldResemble, map[string]string{"updated": "update", "created": "create", "removed": "remove"})
+		So(authChanges, ShouldHaveLength, 2)
+		So(authChanges[0].Type, ShouldEqual, "update")
+		So(authChanges[0].Authority, ShouldEqual, auth)
+		So(authChanges[1].Type, ShouldEqual, "remove")
+		So(authChanges[1].Authority.Username, ShouldEqual, "other")
+
+		So(g.Tasks, ShouldHaveLength, 3)
+		So(g.Authorities, ShouldHaveLength, 1)
+		So(g.Authorities[0], ShouldEqual, auth)
+		So(auth.AccessToken, ShouldEqual, "a2")
+		So(g.Logs.MaxFilesNumber, ShouldEqual, 3)
+
+		So(g.Reload(newConf), ShouldBeEmpty)
+	})
+
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+	"github.com/pydio/cells/v4/common/sync/merger"
+)
+
+func conflictingPatch(leftMTime, rightMTime int64) (*memory.MemDB, *memory.MemDB, merger.Patch) {
+	ctx := context.Background()
+	left := memory.NewMemDB()
+	right := memory.NewMemDB()
+	left.CreateNode(ctx, &tree.Node{Path: "a.txt", Type: tree.NodeType_LEAF, Etag: "left", MTime: leftMTime}, false)
+	right.CreateNode(ctx, &tree.Node{Path: "a.txt", Type: tree.NodeType_LEAF, Etag: "right", MTime: rightMTime}, false)
+	patch := merger.NewPatch(left, right, merger.PatchOptions{})
+	patch.Enqueue(merger.NewConflictOperation(&tree.Node{Path: "a.txt"}, merger.ConflictPathOperation, nil, nil))
+	return left, right, patch
+}
+
+func TestConflictResolver(t *testing.T) {
+
+	ctx := context.Background()
+
+	Convey("Test unknown policies leave conflicts unresolved", t, func() {
+		So(control.NewConflictResolver("", nil, nil), ShouldBeNil)
+		So(control.NewConflictResolver("unknown", nil, nil), ShouldBeNil)
+	})
+
+	Convey("Test prefer-newest policy", t, func() {
+		left, right, patch := conflictingPatch(10, 20)
+		resolver := control.NewConflictResolver(config.ConflictPolicyPreferNewest, left, right)
+		So(resolver.Pending(patch), ShouldBeTrue)
+		resolutions := resolver.Resolve(ctx, patch)
+		So(resolver.Pending(patch), ShouldBeFalse)
+		So(resolutions, ShouldHaveLength, 1)
+		So(resolutions[0].Source(), ShouldEqual, right)
+		So(resolutions[0].OperationsByType([]merger.OperationType{merger.OpDelete}), ShouldBeEmpty)
+		So(resolutions[0].OperationsByType([]merger.OperationType{merger.OpCreateFile}), ShouldHaveLength, 1)
+		So(resolver.Settled(patch), ShouldBeTrue)
+		// Patches can be received twice: conflicts are only resolved once
+		So(resolver.Resolve(ctx, patch), ShouldBeEmpty)
+	})
+
+	Convey("Test keep-both policy", t, func() {
+		left, right, patch := conflictingPatch(10, 20)
+		resolver := control.NewConflictResolver(config.ConflictPolicyKeepBoth, left, right)
+		resolutions := resolver.Resolve(ctx, patch)
+		So(resolutions, ShouldHaveLength, 3)
+		// Right version is renamed by the first patch, not directly
+		moves := resolutions[0].OperationsByType([]merger.OperationType{merger.OpMoveFile})
+		So(moves, ShouldHaveLength, 1)
+		So(moves[0].GetMoveOriginPath(), ShouldEqual, "a.txt")
+		So(moves[0].GetRefPath(), ShouldStartWith, "a-conflict-")
+		So(resolutions[0].Target(), ShouldEqual, right)
+		_, e := right.LoadNode(ctx, "a.txt")
+		So(e, ShouldBeNil)
+		So(resolutions[1].Source(), ShouldEqual, left)
+		So(resolutions[2].Source(), ShouldEqual, right)
+		copies := resolutions[2].OperationsByType([]merger.OperationType{merger.OpCreateFile})
+		So(copies, ShouldHaveLength, 1)
+		So(copies[0].GetRefPath(), ShouldEqual, moves[0].GetRefPath())
+		So(copies[0].GetNode().GetEtag(), ShouldEqual, "right")
+	})
+
+	Convey("Test folder conflicts remove the children missing from the winning side", t, func() {
+		left := memory.NewMemDB()
+		right := memory.NewMemDB()
+		for _, n := range []*tree.Node{
+			{Path: "folder", Type: tree.NodeType_COLLECTION, Uuid: "folder"},
+			{Path: "folder/common.txt", Type: tree.NodeType_LEAF, Etag: "common"},
+		} {
+			left.CreateNode(ctx, n, false)
+			right.CreateNode(ctx, n, false)
+		}
+		left.CreateNode(ctx, &tree.Node{Path: "folder/left.txt", Type: tree.NodeType_LEAF, Etag: "left"}, false)
+		right.CreateNode(ctx, &tree.Node{Path: "folder/right", Type: tree.NodeType_COLLECTION, Uuid: "right"}, false)
+		right.CreateNode(ctx, &tree.Node{Path: "folder/right/child.txt", Type: tree.NodeType_LEAF, Etag: "child"}, false)
+		patch := merger.NewPatch(left, right, merger.PatchOptions{})
+		patch.Enqueue(merger.NewConflictOperation(&tree.Node{Path: "folder", Type: tree.NodeType_COLLECTION}, merger.ConflictFolderUUID, nil, nil))
+
+		resolutions := control.NewConflictResolver(config.ConflictPolicyPreferLeft, left, right).Resolve(ctx, patch)
+		So(resolutions, ShouldHaveLength, 1)
+		deletes := resolutions[0].OperationsByType([]merger.OperationType{merger.OpDelete})
+		So(deletes, ShouldHaveLength, 1)
+		So(deletes[0].GetRefPath(), ShouldEqual, "folder/right")
+		creates := resolutions[0].OperationsByType([]merger.OperationType{merger.OpCreateFile})
+		So(creates, ShouldHaveLength, 2)
+	})
+
+	Convey("Test conflicts resolved by policy are not reported as errors", t, func() {
+		task := &config.Task{Uuid: "task"}
+		left, right, patch := conflictingPatch(10, 20)
+		errs, hasErrors := control.PatchErrors(patch)
+		So(hasErrors, ShouldBeTrue)
+		So(control.AfterPatchEvent(patch, hasErrors), ShouldEqual, control.HookAfterPatchError)
+		So(control.NewHookInput(control.HookAfterPatchError, task, patch).Error, ShouldNotBeEmpty)
+		event := control.NewPatchErrorEvent(task, patch, errs)
+		So(event, ShouldNotBeNil)
+		So(event.Conflicts, ShouldEqual, 1)
+
+		control.NewConflictResolver(config.ConflictPolicyPreferLeft, left, right).Resolve(ctx, patch)
+		_, patchHasErrors := patch.HasErrors()
+		So(patchHasErrors, ShouldBeTrue)
+		errs, hasErrors = control.PatchErrors(patch)
+		So(hasErrors, ShouldBeFalse)
+		So(control.AfterPatchEvent(patch, hasErrors), ShouldEqual, control.HookAfterPatchSuccess)
+		So(control.NewHookInput(control.HookAfterPatchSuccess, task, patch).Error, ShouldBeEmpty)
+		So(control.NewPatchErrorEvent(task, patch, errs), ShouldBeNil)
+	})
+
+	Convey("Test conflict store keeps open conflicts", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-conflicts")
+		defer os.RemoveAll(tmp)
+		store, e := endpoint.NewConflictStore(tmp)
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		_, _, patch := conflictingPatch(10, 20)
+		So(store.Record(patch), ShouldBeNil)
+		// Recording the same patch twice does not duplicate conflicts
+		So(store.Record(patch), ShouldBeNil)
+		conflicts, e := store.List()
+		So(e, ShouldBeNil)
+		So(conflicts, ShouldHaveLength, 1)
+		So(conflicts[0].Path, ShouldEqual, "a.txt")
+
+		conflict, e := store.Get(conflicts[0].ID)
+		So(e, ShouldBeNil)
+		So(store.Delete(conflict), ShouldBeNil)
+		conflicts, _ = store.List()
+		So(conflicts, ShouldBeEmpty)
+	})
+
+	Convey("Test resolved conflicts are not recorded", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-conflicts")
+		defer os.RemoveAll(tmp)
+		store, _ := endpoint.NewConflictStore(tmp)
+		defer store.Stop()
+
+		left, right, patch := conflictingPatch(10, 20)
+		control.NewConflictResolver(config.ConflictPolicyPreferLeft, left, right).Resolve(ctx, patch)
+		So(store.Record(patch), ShouldBeNil)
+		conflicts, _ := store.List()
+		So(conflicts, ShouldBeEmpty)
+	})
+
+	Convey("Test conflicts are removed once resolved or cleared", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-conflicts")
+		defer os.RemoveAll(tmp)
+		store, _ := endpoint.NewConflictStore(tmp)
+		defer store.Stop()
+
+		left, right, patch := conflictingPatch(10, 20)
+		So(store.Record(patch), ShouldBeNil)
+		conflicts, _ := store.List()
+		So(conflicts, ShouldHaveLength, 1)
+
+		// The same conflict resolved by a policy in a later patch
+		_, _, later := conflictingPatch(10, 20)
+		control.NewConflictResolver(config.ConflictPolicyPreferLeft, left, right).Resolve(ctx, later)
+		So(store.Record(later), ShouldBeNil)
+		conflicts, _ = store.List()
+		So(conflicts, ShouldBeEmpty)
+
+		// A conflict missing from a later patch is only removed if it is cleared
+		So(store.Record(patch), ShouldBeNil)
+		empty := merger.NewPatch(left, right, merger.PatchOptions{})
+		n, e := store.Prune(empty, func(*endpoint.Conflict) bool { return false })
+		So(e, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		n, e = store.Prune(patch, func(*endpoint.Conflict) bool { return true })
+		So(e, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		n, e = store.Prune(empty, func(*endpoint.Conflict) bool { return true })
+		So(e, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		conflicts, _ = store.List()
+		So(conflicts, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/sync/task"
+)
+
+func countBlobs(storePath string) (count int) {
+	filepath.Walk(filepath.Join(storePath, "blobs"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return
+}
+
+func writeDBFile(client *endpoint.DBClient, p, content string) {
+	w, _, _, _ := client.GetWriterOn(context.Background(), p, int64(len(content)))
+	w.Write([]byte(content))
+	So(w.Close(), ShouldBeNil)
+}
+
+func TestDBEndpoint(t *testing.T) {
+
+	Convey("Test persistent db endpoint", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-db")
+		defer os.RemoveAll(tmp)
+		storePath := filepath.Join(tmp, "store")
+		ctx := context.Background()
+
+		ep, e := endpoint.EndpointFromURI("db://", "")
+		So(e, ShouldBeNil)
+		_, ok := ep.(*memory.MemDB)
+		So(ok, ShouldBeTrue)
+
+		ep, e = endpoint.EndpointFromURI("db://"+filepath.ToSlash(storePath), "")
+		So(e, ShouldBeNil)
+		client := ep.(*endpoint.DBClient)
+
+		Convey("Nodes and contents are persisted", func() {
+			So(client.CreateNode(ctx, &tree.Node{Path: "folder", Uuid: "folder-uuid", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+			writeDBFile(client, "folder/sub/file.txt", "content")
+			So(client.Close(), ShouldBeNil)
+
+			reopened, e := endpoint.NewDBClient(storePath, model.EndpointOptions{})
+			So(e, ShouldBeNil)
+			defer reopened.Close()
+			folder, e := reopened.LoadNode(ctx, "folder")
+			So(e, ShouldBeNil)
+			So(folder.GetUuid(), ShouldEqual, "folder-uuid")
+			sub, e := reopened.LoadNode(ctx, "folder/sub")
+			So(e, ShouldBeNil)
+			So(sub.IsLeaf(), ShouldBeFalse)
+			So(sub.GetUuid(), ShouldNotBeEmpty)
+
+			node, e := reopened.LoadNode(ctx, "folder/sub/file.txt")
+			So(e, ShouldBeNil)
+			So(node.GetSize(), ShouldEqual, 7)
+			plainDir, _ := os.MkdirTemp("", "cells-plain")
+			defer os.RemoveAll(plainDir)
+			os.WriteFile(filepath.Join(plainDir, "file.txt"), []byte("content"), 0644)
+			fsClient, _ := filesystem.NewFSClient(plainDir, model.EndpointOptions{})
+			fsNode, _ := fsClient.LoadNode(ctx, "file.txt")
+			So(node.GetEtag(), ShouldEqual, fsNode.GetEtag())
+			_, e = os.Stat(filepath.Join(storePath, "blobs", node.GetEtag()[:2], node.GetEtag()))
+			So(e, ShouldBeNil)
+
+			r, e := reopened.GetReaderOn(ctx, "folder/sub/file.txt")
+			So(e, ShouldBeNil)
+			data, _ := io.ReadAll(r)
+			r.Close()
+			So(string(data), ShouldEqual, "content")
+
+			var walked []string
+			reopened.Walk(ctx, func(p string, node tree.N, err error) error {
+				walked = append(walked, p)
+				return err
+			}, "/", true)
+			So(walked, ShouldResemble, []string{"folder", "folder/sub", "folder/sub/file.txt"})
+			walked = nil
+			reopened.Walk(ctx, func(p string, node tree.N, err error) error {
+				walked = append(walked, p)
+				return err
+			}, "folder", false)
+			So(walked, ShouldResemble, []string{"folder/sub"})
+		})
+
+		Convey("Blobs are shared and removed when not referenced anymore", func() {
+			defer client.Close()
+			writeDBFile(client, "a.txt", "same")
+			writeDBFile(client, "b.txt", "same")
+			So(countBlobs(storePath), ShouldEqual, 1)
+			writeDBFile(client, "b.txt", "other")
+			So(countBlobs(storePath), ShouldEqual, 2)
+			So(client.MoveNode(ctx, "b.txt", "folder/c.txt"), ShouldBeNil)
+			_, e := client.LoadNode(ctx, "folder")
+			So(e, ShouldBeNil)
+			So(client.DeleteNode(ctx, "folder"), ShouldBeNil)
+			So(countBlobs(storePath), ShouldEqual, 1)
+			So(client.DeleteNode(ctx, "a.txt"), ShouldBeNil)
+			So(countBlobs(storePath), ShouldEqual, 0)
+		})
+
+		Convey("Moving over an existing node replaces it and releases its blobs", func() {
+			defer client.Close()
+			writeDBFile(client, "src.txt", "source")
+			writeDBFile(client, "dst/a.txt", "a")
+			writeDBFile(client, "dst/sub/b.txt", "b")
+			So(countBlobs(storePath), ShouldEqual, 3)
+			So(client.MoveNode(ctx, "src.txt", "dst"), ShouldBeNil)
+			So(countBlobs(storePath), ShouldEqual, 1)
+			node, e := client.LoadNode(ctx, "dst")
+			So(e, ShouldBeNil)
+			So(node.IsLeaf(), ShouldBeTrue)
+			_, e = client.LoadNode(ctx, "dst/sub/b.txt")
+			So(e, ShouldNotBeNil)
+			So(client.MoveNode(ctx, "dst", "dst/inside"), ShouldNotBeNil)
+		})
+
+		Convey("Cancelled transfers are not indexed", func() {
+			defer client.Close()
+			cancelCtx, cancel := context.WithCancel(ctx)
+			w, _, _, e := client.GetWriterOn(cancelCtx, "cancelled.txt", 7)
+			So(e, ShouldBeNil)
+			w.Write([]byte("partial"))
+			cancel()
+			So(w.Close(), ShouldNotBeNil)
+			_, e = client.LoadNode(ctx, "cancelled.txt")
+			So(e, ShouldNotBeNil)
+			So(countBlobs(storePath), ShouldEqual, 0)
+		})
+
+		Convey("A local folder is synced to the store and back", func() {
+			defer client.Close()
+			left, _ := os.MkdirTemp("", "cells-db-left")
+			defer os.RemoveAll(left)
+			os.MkdirAll(filepath.Join(left, "folder"), 0755)
+			os.WriteFile(filepath.Join(left, "folder", "file.txt"), []byte("content"), 0644)
+			leftClient, _ := filesystem.NewFSClient(left, model.EndpointOptions{})
+			So(runOnce(task.NewSync(leftClient, client, model.DirectionRight)), ShouldBeNil)
+
+			right, _ := os.MkdirTemp("", "cells-db-right")
+			defer os.RemoveAll(right)
+			rightClient, _ := filesystem.NewFSClient(right, model.EndpointOptions{})
+			So(runOnce(task.NewSync(client, rightClient, model.DirectionRight)), ShouldBeNil)
+			data, e := os.ReadFile(filepath.Join(right, "folder", "file.txt"))
+			So(e, ShouldBeNil)
+			So(string(data), ShouldEqual, "content")
+		})
+
+	})
+
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// readOnlyEndpoint only exposes the browsing methods of an endpoint.
+type readOnlyEndpoint struct {
+	model.PathSyncSource
+}
+
+func TestDryRun(t *testing.T) {
+
+	ctx := context.Background()
+
+	Convey("Test unidirectional dry-run", t, func() {
+		left := memory.NewMemDB()
+		right := memory.NewMemDB()
+		left.CreateNode(ctx, &tree.Node{Path: "folder", Type: tree.NodeType_COLLECTION, Uuid: "folder-uuid", Etag: "-1"}, false)
+		left.CreateNode(ctx, &tree.Node{Path: "folder/a.txt", Type: tree.NodeType_LEAF, Uuid: "a-uuid", Etag: "a", Size: 10, MTime: 10}, false)
+
+		patch, fullScan, e := control.ComputeDryRun(ctx, left, right, model.DirectionRight, nil, nil, nil)
+		So(e, ShouldBeNil)
+		So(fullScan, ShouldBeTrue)
+		report := control.NewDryRunReport("task", "Right", patch, left, right)
+		So(report.Counts[control.DryRunCreateFolder], ShouldEqual, 1)
+		So(report.Counts[control.DryRunCreateFile], ShouldEqual, 1)
+		So(report.TotalBytes, ShouldEqual, 10)
+		So(report.Operations[control.DryRunCreateFile][0].Path, ShouldEqual, "folder/a.txt")
+		So(report.Operations[control.DryRunCreateFile][0].Target, ShouldEqual, "right")
+
+		// Nothing is applied
+		_, e = right.LoadNode(ctx, "folder/a.txt")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test bidirectional dry-run with conflicts", t, func() {
+		left := memory.NewMemDB()
+		right := memory.NewMemDB()
+		left.CreateNode(ctx, &tree.Node{Path: "a.txt", Type: tree.NodeType_LEAF, Uuid: "a-uuid", Etag: "a", Size: 10, MTime: 10}, false)
+		left.CreateNode(ctx, &tree.Node{Path: "c.txt", Type: tree.NodeType_LEAF, Uuid: "c-left", Etag: "c-left", Size: 5, MTime: 10}, false)
+		right.CreateNode(ctx, &tree.Node{Path: "b.txt", Type: tree.NodeType_LEAF, Uuid: "b-uuid", Etag: "b", Size: 20, MTime: 10}, false)
+		right.CreateNode(ctx, &tree.Node{Path: "c.txt", Type: tree.NodeType_LEAF, Uuid: "c-right", Etag: "c-right", Size: 6, MTime: 20}, false)
+
+		patch, _, e := control.ComputeDryRun(ctx, left, right, model.DirectionBi, nil, nil, nil)
+		So(e, ShouldBeNil)
+		report := control.NewDryRunReport("task", "Bi", patch, left, right)
+		So(report.Counts[control.DryRunCreateFile], ShouldEqual, 2)
+		So(report.Counts[control.DryRunConflict], ShouldEqual, 1)
+		So(report.Operations[control.DryRunConflict][0].Path, ShouldEqual, "c.txt")
+		So(report.Operations[control.DryRunConflict][0].Target, ShouldEqual, "both")
+		targets := map[string]string{}
+		for _, op := range report.Operations[control.DryRunCreateFile] {
+			targets[op.Path] = op.Target
+		}
+		So(targets["a.txt"], ShouldEqual, "right")
+		So(targets["b.txt"], ShouldEqual, "left")
+		So(report.TotalBytes, ShouldEqual, 30)
+	})
+
+	Convey("Test dry-run to a read-only endpoint returns an error", t, func() {
+		left := memory.NewMemDB()
+		right := &readOnlyEndpoint{PathSyncSource: memory.NewMemDB()}
+		_, _, e := control.ComputeDryRun(ctx, left, right, model.DirectionRight, nil, nil, nil)
+		So(e, ShouldNotBeNil)
+		_, _, e = control.ComputeDryRun(ctx, left, right, model.DirectionBi, nil, nil, nil)
+		So(e, ShouldNotBeNil)
+		_, _, e = control.ComputeDryRun(ctx, right, left, model.DirectionRight, nil, nil, nil)
+		So(e, ShouldBeNil)
+	})
+
+}
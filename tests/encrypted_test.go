@@ -0,0 +1,203 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zalando/go-keyring"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+	"github.com/pydio/cells/v4/common/sync/task"
+)
+
+func TestEncryptedEndpoint(t *testing.T) {
+
+	Convey("Test encrypted endpoint wrapping a local folder", t, func() {
+		keyring.MockInit()
+		tmp, _ := os.MkdirTemp("", "cells-encrypted")
+		defer os.RemoveAll(tmp)
+		ctx := context.Background()
+		uri := "enc+fs://" + filepath.ToSlash(tmp) + "?key=test"
+
+		_, e := endpoint.EndpointFromURI(uri, "")
+		So(e, ShouldNotBeNil)
+		key, _ := endpoint.NewEncryptionKey()
+		So(config.EncryptionKeyToKeyring("test", key), ShouldBeNil)
+
+		ep, e := endpoint.EndpointFromURI(uri, "")
+		So(e, ShouldBeNil)
+		client := ep.(*endpoint.EncryptedEndpoint)
+		So(client.GetEndpointInfo().URI, ShouldStartWith, "enc+fs://")
+
+		Convey("Names and contents are encrypted, and decrypted when read", func() {
+			content := bytes.Repeat([]byte("secret content "), 10000)
+			So(client.CreateNode(ctx, &tree.Node{Path: "folder", Uuid: "folder-uuid", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+			w, _, _, e := client.GetWriterOn(ctx, "folder/file.txt", int64(len(content)))
+			So(e, ShouldBeNil)
+			w.Write(content)
+			So(w.Close(), ShouldBeNil)
+
+			entries, _ := os.ReadDir(tmp)
+			So(entries, ShouldHaveLength, 1)
+			for _, entry := range entries {
+				So(entry.Name(), ShouldNotContainSubstring, "folder")
+			}
+			var stored []byte
+			filepath.Walk(tmp, func(p string, info os.FileInfo, err error) error {
+				So(p, ShouldNotContainSubstring, "file.txt")
+				if !info.IsDir() && info.Size() > 100 {
+					stored, _ = os.ReadFile(p)
+				}
+				return nil
+			})
+			So(stored, ShouldNotBeEmpty)
+			So(bytes.Contains(stored, []byte("secret")), ShouldBeFalse)
+
+			node, e := client.LoadNode(ctx, "folder/file.txt")
+			So(e, ShouldBeNil)
+			So(node.GetSize(), ShouldEqual, len(content))
+			plainDir, _ := os.MkdirTemp("", "cells-plain")
+			defer os.RemoveAll(plainDir)
+			os.WriteFile(filepath.Join(plainDir, "file.txt"), content, 0644)
+			fsClient, _ := filesystem.NewFSClient(plainDir, model.EndpointOptions{})
+			fsNode, _ := fsClient.LoadNode(ctx, "file.txt")
+			So(node.GetEtag(), ShouldEqual, fsNode.GetEtag())
+			folder, e := client.LoadNode(ctx, "folder")
+			So(e, ShouldBeNil)
+			So(folder.GetUuid(), ShouldEqual, "folder-uuid")
+
+			r, e := client.GetReaderOn(ctx, "folder/file.txt")
+			So(e, ShouldBeNil)
+			read, e := io.ReadAll(r)
+			r.Close()
+			So(e, ShouldBeNil)
+			So(read, ShouldResemble, content)
+
+			So(client.MoveNode(ctx, "folder/file.txt", "folder/moved.txt"), ShouldBeNil)
+			moved, e := client.LoadNode(ctx, "folder/moved.txt")
+			So(e, ShouldBeNil)
+			So(moved.GetEtag(), ShouldEqual, fsNode.GetEtag())
+			So(client.DeleteNode(ctx, "folder"), ShouldBeNil)
+			entries, _ = os.ReadDir(tmp)
+			So(entries, ShouldBeEmpty)
+		})
+
+		Convey("Browsing shows decrypted names and ignores foreign files", func() {
+			w, _, _, _ := client.GetWriterOn(ctx, "file with space.txt", 7)
+			w.Write([]byte("content"))
+			So(w.Close(), ShouldBeNil)
+			os.WriteFile(filepath.Join(tmp, "not-encrypted.txt"), []byte("plain"), 0644)
+
+			browse, e := endpoint.EndpointFromURI(uri, "", true)
+			So(e, ShouldBeNil)
+			var paths []string
+			e = browse.(model.PathSyncSource).Walk(ctx, func(p string, node tree.N, err error) error {
+				paths = append(paths, p)
+				if node.IsLeaf() {
+					So(node.GetSize(), ShouldEqual, 7)
+				}
+				return err
+			}, "", false)
+			So(e, ShouldBeNil)
+			So(paths, ShouldResemble, []string{"file with space.txt"})
+		})
+
+		Convey("A local folder is synced to the encrypted endpoint and back", func() {
+			left, _ := os.MkdirTemp("", "cells-encrypted-left")
+			defer os.RemoveAll(left)
+			os.MkdirAll(filepath.Join(left, "folder"), 0755)
+			os.WriteFile(filepath.Join(left, "folder", "file.txt"), []byte("content"), 0644)
+			leftClient, _ := filesystem.NewFSClient(left, model.EndpointOptions{})
+			So(runOnce(task.NewSync(leftClient, client, model.DirectionRight)), ShouldBeNil)
+
+			right, _ := os.MkdirTemp("", "cells-encrypted-right")
+			defer os.RemoveAll(right)
+			rightClient, _ := filesystem.NewFSClient(right, model.EndpointOptions{})
+			So(runOnce(task.NewSync(client, rightClient, model.DirectionRight)), ShouldBeNil)
+			data, e := os.ReadFile(filepath.Join(right, "folder", "file.txt"))
+			So(e, ShouldBeNil)
+			So(string(data), ShouldEqual, "content")
+		})
+
+		Convey("Tampered contents are detected", func() {
+			w, _, _, _ := client.GetWriterOn(ctx, "file.txt", 7)
+			w.Write([]byte("content"))
+			So(w.Close(), ShouldBeNil)
+			entries, _ := os.ReadDir(tmp)
+			for _, entry := range entries {
+				data, _ := os.ReadFile(filepath.Join(tmp, entry.Name()))
+				data[len(data)-1] ^= 1
+				os.WriteFile(filepath.Join(tmp, entry.Name()), data, 0644)
+			}
+			r, e := client.GetReaderOn(ctx, "file.txt")
+			So(e, ShouldBeNil)
+			_, e = io.ReadAll(r)
+			r.Close()
+			So(e, ShouldEqual, endpoint.ErrEncryptedContent)
+		})
+
+	})
+
+}
+
+// runOnce runs a single sync without watching the endpoints, as filesystem watchers may still send events
+// once the sync is shut down.
+func runOnce(s *task.Sync) error {
+	statusChan := make(chan model.Status)
+	doneChan := make(chan interface{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-statusChan:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	s.SetupEventsChan(statusChan, doneChan, nil)
+	s.Start(context.Background(), false)
+	defer s.Shutdown()
+	s.Run(context.Background(), false, true)
+	select {
+	case p := <-doneChan:
+		if _, ok := p.(merger.Patch); !ok {
+			return fmt.Errorf("doneChan did not send a patch")
+		}
+		return nil
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("breaking test after 10s, this is not normal")
+	}
+}
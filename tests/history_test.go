@@ -0,0 +1,90 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+func TestHistoryStateStore(t *testing.T) {
+
+	task := &config.Task{Uuid: "history-task", LeftURI: "fs:///tmp/left", RightURI: "fs:///tmp/right"}
+
+	Convey("Test history records transitions and survives restarts", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-history")
+		defer os.RemoveAll(tmp)
+
+		h, e := control.NewHistoryStateStore(control.NewMemoryStateStore(task), tmp, time.Hour)
+		So(e, ShouldBeNil)
+		h.UpdateProcessStatus(model.NewProcessingStatus("Starting sync loop"), model.TaskStatusProcessing)
+		h.UpdateProcessStatus(model.NewProcessingStatus("Still running"), model.TaskStatusProcessing)
+		h.UpdateProcessStatus(model.NewProcessingStatus("Processing ended on error!").SetError(fmt.Errorf("boom")), model.TaskStatusError)
+		h.UpdateConnection(true, model.EndpointInfo{URI: "fs:///tmp/left"})
+		h.UpdateConnection(true, model.EndpointInfo{URI: "fs:///tmp/left"})
+		h.Close()
+
+		h, e = control.NewHistoryStateStore(control.NewMemoryStateStore(task), tmp, time.Hour)
+		So(e, ShouldBeNil)
+		defer h.Close()
+		entries, e := h.Load(control.HistoryQuery{})
+		So(e, ShouldBeNil)
+		So(entries, ShouldHaveLength, 4)
+		So(entries[0].Type, ShouldEqual, control.HistoryTypeConnection)
+		So(entries[0].Connected, ShouldBeTrue)
+		So(entries[1].Type, ShouldEqual, control.HistoryTypeSummary)
+		So(entries[1].Error, ShouldEqual, "boom")
+		So(entries[2].Status, ShouldEqual, "error")
+		So(entries[3].Status, ShouldEqual, "processing")
+		So(entries[3].PreviousStatus, ShouldEqual, "idle")
+
+		entries, _ = h.Load(control.HistoryQuery{Type: control.HistoryTypeStatus, Limit: 1})
+		So(entries, ShouldHaveLength, 1)
+		So(entries[0].Status, ShouldEqual, "error")
+
+		entries, _ = h.Load(control.HistoryQuery{To: time.Now().Add(-time.Hour)})
+		So(entries, ShouldBeEmpty)
+		entries, _ = h.Load(control.HistoryQuery{From: time.Now().Add(-time.Hour), To: time.Now()})
+		So(entries, ShouldHaveLength, 4)
+	})
+
+	Convey("Test history retention", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-history")
+		defer os.RemoveAll(tmp)
+
+		h, _ := control.NewHistoryStateStore(control.NewMemoryStateStore(task), tmp, time.Hour)
+		h.UpdateSyncStatus(model.TaskStatusPaused)
+		h.Close()
+		<-time.After(10 * time.Millisecond)
+
+		h, _ = control.NewHistoryStateStore(control.NewMemoryStateStore(task), tmp, time.Millisecond)
+		defer h.Close()
+		entries, _ := h.Load(control.HistoryQuery{})
+		So(entries, ShouldBeEmpty)
+	})
+}
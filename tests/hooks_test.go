@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+func TestHooks(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks tests rely on a POSIX shell")
+	}
+	ctx := context.Background()
+	task := &config.Task{Uuid: "task-uuid", Label: "Test"}
+	patch := merger.NewPatch(memory.NewMemDB(), memory.NewMemDB(), merger.PatchOptions{})
+	node := &tree.Node{Path: "folder/file.txt", Type: tree.NodeType_LEAF, Etag: "hash"}
+	patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.NodeToEventInfo(ctx, node.Path, node, model.EventCreate), node))
+
+	Convey("Test hook receives patch description on stdin", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-hooks")
+		defer os.RemoveAll(tmp)
+		out := filepath.Join(tmp, "input.json")
+		hook := &config.Hook{Command: "sh", Args: []string{"-c", "cat > " + out}}
+
+		So(control.RunHook(ctx, hook, control.NewHookInput(control.HookAfterPatchSuccess, task, patch)), ShouldBeNil)
+		data, e := os.ReadFile(out)
+		So(e, ShouldBeNil)
+		var input control.HookInput
+		So(json.Unmarshal(data, &input), ShouldBeNil)
+		So(input.Event, ShouldEqual, control.HookAfterPatchSuccess)
+		So(input.TaskUuid, ShouldEqual, "task-uuid")
+		So(input.Paths, ShouldResemble, []string{"folder/file.txt"})
+		So(input.Stats, ShouldContainKey, "Pending")
+	})
+
+	Convey("Test hook timeout and exit code", t, func() {
+		So(control.RunHook(ctx, &config.Hook{Command: "sleep", Args: []string{"5"}, Timeout: "100ms"}, control.NewHookInput(control.HookBeforePatch, task, patch)), ShouldNotBeNil)
+		So(control.RunHook(ctx, &config.Hook{Command: "false"}, control.NewHookInput(control.HookBeforePatch, task, patch)), ShouldNotBeNil)
+		So(control.RunHook(ctx, nil, nil), ShouldBeNil)
+	})
+
+	Convey("Test hook does not wait for children keeping its output open", t, func() {
+		delay := control.HookWaitDelay
+		control.HookWaitDelay = 200 * time.Millisecond
+		defer func() { control.HookWaitDelay = delay }()
+		start := time.Now()
+		_ = control.RunHook(ctx, &config.Hook{Command: "sh", Args: []string{"-c", "sleep 5 & echo started"}}, control.NewHookInput(control.HookBeforePatch, task, patch))
+		So(time.Since(start), ShouldBeLessThan, 3*time.Second)
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+
+	Convey("Test gitignore-style rules", t, func() {
+
+		m, e := endpoint.NewIgnoreMatcher([]string{"# comment", "*.tmp", "node_modules/", "/build", "docs/**/draft", ".git*", "!.gitignore"})
+		So(e, ShouldBeNil)
+
+		So(m.Match("/file.tmp"), ShouldBeTrue)
+		So(m.Match("/a/b/file.tmp"), ShouldBeTrue)
+		So(m.Match("/a/b/file.txt"), ShouldBeFalse)
+		So(m.Match("/a/node_modules/lib/index.js"), ShouldBeTrue)
+		So(m.Match("/build/out.bin"), ShouldBeTrue)
+		So(m.Match("/src/build/out.bin"), ShouldBeFalse)
+		So(m.Match("/docs/draft"), ShouldBeTrue)
+		So(m.Match("/docs/a/b/draft"), ShouldBeTrue)
+		So(m.Match("/.git/config"), ShouldBeTrue)
+		So(m.Match("/a/.gitignore"), ShouldBeFalse)
+		So(m.Match("/a/.pydio"), ShouldBeTrue)
+
+	})
+
+	Convey("Test negation cannot re-include a file inside an excluded folder", t, func() {
+
+		m, e := endpoint.NewIgnoreMatcher([]string{"logs/", "!logs/keep.log"})
+		So(e, ShouldBeNil)
+		So(m.Match("/logs/keep.log"), ShouldBeTrue)
+
+	})
+
+	Convey("Test .cellsignore files in local folders", t, func() {
+
+		tmp, _ := os.MkdirTemp("", "cells-ignore")
+		defer os.RemoveAll(tmp)
+		So(os.MkdirAll(filepath.Join(tmp, "sub"), 0755), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(tmp, "sub", endpoint.IgnoreFileName), []byte("*.log\n/local\n"), 0644), ShouldBeNil)
+
+		m, e := endpoint.NewIgnoreMatcher(nil, tmp)
+		So(e, ShouldBeNil)
+		So(m.Match("/sub/a.log"), ShouldBeTrue)
+		So(m.Match("/sub/deep/a.log"), ShouldBeTrue)
+		So(m.Match("/sub/local"), ShouldBeTrue)
+		So(m.Match("/a.log"), ShouldBeFalse)
+		So(m.Match("/local"), ShouldBeFalse)
+
+	})
+
+	Convey("Test folder-only rules use the node type", t, func() {
+
+		m, e := endpoint.NewIgnoreMatcher([]string{"build/"})
+		So(e, ShouldBeNil)
+		So(m.Match("/build/out.bin"), ShouldBeTrue)
+		So(m.Match("/build"), ShouldBeFalse)
+		So(m.MatchNode("/build", tree.LightNode(tree.NodeType_COLLECTION, "", "/build", "", 0, 0, 0)), ShouldBeTrue)
+		So(m.MatchNode("/build", tree.LightNode(tree.NodeType_LEAF, "", "/build", "", 0, 0, 0)), ShouldBeFalse)
+
+		remote := memory.NewMemDB()
+		ctx := context.Background()
+		So(remote.CreateNode(ctx, tree.LightNode(tree.NodeType_COLLECTION, "f", "/build", "", 0, 0, 0), false), ShouldBeNil)
+		So(remote.CreateNode(ctx, tree.LightNode(tree.NodeType_LEAF, "l", "/src/build", "etag", 0, 0, 0), false), ShouldBeNil)
+		m.SetNodeSources(remote)
+		So(m.Match("/build"), ShouldBeTrue)
+		So(m.Match("/src/build"), ShouldBeFalse)
+
+	})
+
+	Convey("Test default rules are not shared", t, func() {
+
+		task := &config.Task{}
+		rules := task.GetIgnoreRules()
+		rules[0] = "modified"
+		So(config.DefaultIgnoreRules[0], ShouldNotEqual, "modified")
+
+	})
+
+	Convey("Test invalid rules are reported", t, func() {
+
+		_, e := endpoint.NewIgnoreMatcher([]string{"[a-"})
+		So(e, ShouldNotBeNil)
+
+	})
+}
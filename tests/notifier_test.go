@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+)
+
+func TestNotifier(t *testing.T) {
+
+	Convey("Test notifications are signed and retried", t, func() {
+		var attempts int32
+		received := make(chan *control.Notification, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get(control.NotificationSignatureHeader) != "sha256="+control.SignNotification("secret", body) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			n := &control.Notification{}
+			json.Unmarshal(body, n)
+			received <- n
+		}))
+		defer server.Close()
+
+		sinks := []*config.NotificationSink{
+			{Url: server.URL, Secret: "secret", MaxRetries: 2},
+			{Url: server.URL, Events: []string{control.NotificationPatchError}},
+		}
+
+		notifier := control.NewNotifier(func() []*config.NotificationSink {
+			return sinks
+		})
+		notifier.Backoff = 10 * time.Millisecond
+		notifier.Notify(&control.Notification{Event: control.NotificationStatusChanged, TaskUuid: "task", Status: "error"})
+
+		select {
+		case n := <-received:
+			So(n.TaskUuid, ShouldEqual, "task")
+			So(n.Status, ShouldEqual, "error")
+		case <-time.After(5 * time.Second):
+			So("notification not received", ShouldBeEmpty)
+		}
+		So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+	})
+	Convey("Test patch error notifications carry the task label", t, func() {
+		received := make(chan *control.Notification, 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			n := &control.Notification{}
+			json.Unmarshal(body, n)
+			received <- n
+		}))
+		defer server.Close()
+
+		notifier := control.NewNotifier(func() []*config.NotificationSink {
+			return []*config.NotificationSink{{Url: server.URL, Events: []string{control.NotificationPatchError}}}
+		})
+		go notifier.Serve()
+		defer notifier.Stop()
+
+		event := &control.PatchErrorEvent{TaskUuid: "notified-task", TaskLabel: "My Task", PatchUUID: "patch", Errors: []string{"error"}}
+		var n *control.Notification
+		for i := 0; i < 50 && n == nil; i++ {
+			// Serve subscribes to the bus asynchronously, publish until the event is received
+			control.GetBus().Pub(event, control.TopicPatch)
+			select {
+			case n = <-received:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		So(n, ShouldNotBeNil)
+		So(n.TaskUuid, ShouldEqual, "notified-task")
+		So(n.TaskLabel, ShouldEqual, "My Task")
+	})
+}
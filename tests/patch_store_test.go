@@ -0,0 +1,332 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.etcd.io/bbolt"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/memory"
+	"github.com/pydio/cells/v4/common/sync/merger"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+func storePatches(store *endpoint.PatchStore, left, right *memory.MemDB, stamps ...time.Time) {
+	ctx := context.Background()
+	for i, stamp := range stamps {
+		patch := merger.NewPatch(left, right, merger.PatchOptions{})
+		node := &tree.Node{Path: fmt.Sprintf("file-%d.txt", i), Type: tree.NodeType_LEAF, Etag: "etag", Size: 10}
+		patch.Enqueue(merger.NewOperation(merger.OpCreateFile, model.NodeToEventInfo(ctx, node.Path, node, model.EventCreate), node))
+		patch.Stamp(stamp)
+		store.Store(patch)
+	}
+	// Wait for the last patch to be persisted
+	for i := 0; i < 50; i++ {
+		if pp, _ := store.Load(0, len(stamps)); len(pp) == len(stamps) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPatchStoreRetention(t *testing.T) {
+
+	Convey("Test pruning by count and age", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{MaxCount: 3, MaxAge: 48 * time.Hour})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		now := time.Now()
+		storePatches(store, left, right, now.Add(-72*time.Hour), now.Add(-3*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Hour), now)
+		patches, _ := store.Load(0, 10)
+		So(patches, ShouldHaveLength, 5)
+
+		pruned, e := store.Prune()
+		So(e, ShouldBeNil)
+		So(pruned, ShouldEqual, 2)
+		patches, _ = store.Load(0, 10)
+		So(patches, ShouldHaveLength, 3)
+		So(patches[0].GetStamp().Unix(), ShouldEqual, now.Unix())
+		So(patches[2].GetStamp().Unix(), ShouldEqual, now.Add(-2*time.Hour).Unix())
+	})
+
+	Convey("Test pruning by size and compaction", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{MaxSize: 1})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		var stamps []time.Time
+		for i := 0; i < 20; i++ {
+			stamps = append(stamps, time.Now().Add(time.Duration(i-20)*time.Minute))
+		}
+		storePatches(store, left, right, stamps...)
+		pruned, e := store.Prune()
+		So(e, ShouldBeNil)
+		So(pruned, ShouldEqual, 19)
+
+		So(store.Compact(true), ShouldBeNil)
+		patches, e := store.Load(0, 10)
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+		So(patches[0].Size(), ShouldEqual, 1)
+		_, e = os.Stat(filepath.Join(tmp, "patches.compact"))
+		So(os.IsNotExist(e), ShouldBeTrue)
+	})
+
+	Convey("Test paginating patches and loading them lazily", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		now := time.Now()
+		// Stored in random order
+		storePatches(store, left, right, now.Add(-2*time.Hour), now, now.Add(-3*time.Hour), now.Add(-time.Hour))
+		summaries, e := store.LoadSummaries(1, 2)
+		So(e, ShouldBeNil)
+		So(summaries, ShouldHaveLength, 2)
+		So(summaries[0].Stamp.Unix(), ShouldEqual, now.Add(-time.Hour).Unix())
+		So(summaries[1].Stamp.Unix(), ShouldEqual, now.Add(-2*time.Hour).Unix())
+		So(summaries[0].Source, ShouldEqual, left.GetEndpointInfo().URI)
+		So(summaries[0].Size, ShouldBeGreaterThan, 0)
+
+		patch, e := store.LoadPatch(summaries[0].UUID)
+		So(e, ShouldBeNil)
+		So(patch.Size(), ShouldEqual, 1)
+		So(patch.GetStamp().Unix(), ShouldEqual, summaries[0].Stamp.Unix())
+
+		patches, e := store.Load(3, 10)
+		So(e, ShouldBeNil)
+		So(patches, ShouldHaveLength, 1)
+		So(patches[0].GetStamp().Unix(), ShouldEqual, now.Add(-3*time.Hour).Unix())
+
+		_, e = store.LoadPatch("unknown")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test migrating patches from legacy layout", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		ctx := context.Background()
+
+		db, e := bbolt.Open(filepath.Join(tmp, "patches"), 0644, nil)
+		So(e, ShouldBeNil)
+		stamp := time.Now().Add(-time.Hour)
+		e = db.Update(func(tx *bbolt.Tx) error {
+			bucket, _ := tx.CreateBucket([]byte("patches"))
+			pb, _ := bucket.CreateBucket([]byte("legacy-patch"))
+			mTime, _ := stamp.MarshalJSON()
+			pb.Put([]byte("stamp"), mTime)
+			pb.Put([]byte("patchError"), []byte("legacy error"))
+			pb.Put([]byte("source"), []byte(right.GetEndpointInfo().URI))
+			ops, _ := pb.CreateBucket([]byte("operations"))
+			node := &tree.Node{Path: "legacy.txt", Type: tree.NodeType_LEAF, Etag: "etag", Size: 10}
+			data, _ := json.Marshal(merger.NewOperation(merger.OpCreateFile, model.NodeToEventInfo(ctx, node.Path, node, model.EventCreate), node))
+			return ops.Put([]byte{0, 0, 0, 0, 0, 0, 0, 1}, data)
+		})
+		So(e, ShouldBeNil)
+		db.Close()
+
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+		summaries, e := store.LoadSummaries(0, 10)
+		So(e, ShouldBeNil)
+		So(summaries, ShouldHaveLength, 1)
+		So(summaries[0].UUID, ShouldEqual, "legacy-patch")
+		So(summaries[0].Error, ShouldEqual, "legacy error")
+		So(summaries[0].Source, ShouldEqual, right.GetEndpointInfo().URI)
+
+		patch, e := store.LoadPatch("legacy-patch")
+		So(e, ShouldBeNil)
+		So(patch.Size(), ShouldEqual, 1)
+		_, hasErrors := patch.HasErrors()
+		So(hasErrors, ShouldBeTrue)
+		So(patch.Source().GetEndpointInfo().URI, ShouldEqual, right.GetEndpointInfo().URI)
+	})
+
+	Convey("Test searching operations in patches", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		ctx := context.Background()
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		now := time.Now()
+		add := func(stamp time.Time, opType merger.OperationType, paths ...string) {
+			patch := merger.NewPatch(left, right, merger.PatchOptions{})
+			for _, p := range paths {
+				node := &tree.Node{Path: p, Type: tree.NodeType_LEAF, Etag: "etag", Size: 10}
+				patch.Enqueue(merger.NewOperation(opType, model.NodeToEventInfo(ctx, node.Path, node, model.EventCreate), node))
+			}
+			patch.Stamp(stamp)
+			store.Store(patch)
+		}
+		add(now.Add(-2*time.Hour), merger.OpCreateFile, "docs/report.pdf", "docs/notes.txt", "photos/a.jpg")
+		add(now.Add(-time.Hour), merger.OpDelete, "docs/report.pdf")
+		storePatches(store, left, right, now)
+
+		results, e := store.Search(endpoint.PatchSearchQuery{Path: "/docs/report.pdf"})
+		So(e, ShouldBeNil)
+		So(results, ShouldHaveLength, 2)
+		So(results[0].Type, ShouldEqual, "Delete")
+		So(results[0].Target, ShouldEqual, "right")
+		So(results[0].PatchStamp.Unix(), ShouldEqual, now.Add(-time.Hour).Unix())
+		So(results[1].Type, ShouldEqual, "CreateFile")
+
+		deleteType, e := endpoint.ParseOperationType("delete")
+		So(e, ShouldBeNil)
+		results, _ = store.Search(endpoint.PatchSearchQuery{Path: "docs", Types: []merger.OperationType{deleteType}})
+		So(results, ShouldHaveLength, 1)
+
+		results, _ = store.Search(endpoint.PatchSearchQuery{Path: "*/*.jpg"})
+		So(results, ShouldHaveLength, 1)
+		So(results[0].Path, ShouldEqual, "photos/a.jpg")
+
+		results, _ = store.Search(endpoint.PatchSearchQuery{From: now.Add(-90 * time.Minute), To: now.Add(-30 * time.Minute)})
+		So(results, ShouldHaveLength, 1)
+		results, _ = store.Search(endpoint.PatchSearchQuery{Limit: 2})
+		So(results, ShouldHaveLength, 2)
+		results, _ = store.Search(endpoint.PatchSearchQuery{ErrorsOnly: true})
+		So(results, ShouldBeEmpty)
+
+		_, e = endpoint.ParseOperationType("Explode")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test opening a patch store read-only", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{})
+		So(e, ShouldBeNil)
+		now := time.Now()
+		storePatches(store, left, right, now.Add(-time.Hour), now)
+		store.Stop()
+
+		info, _ := os.Stat(filepath.Join(tmp, "patches"))
+		readOnly, e := endpoint.OpenPatchStoreReadOnly(tmp, left, right)
+		So(e, ShouldBeNil)
+		results, e := readOnly.Search(endpoint.PatchSearchQuery{})
+		So(e, ShouldBeNil)
+		So(results, ShouldHaveLength, 2)
+		_, e = readOnly.Prune()
+		So(e, ShouldBeNil)
+		So(readOnly.Compact(true), ShouldNotBeNil)
+		readOnly.Stop()
+		after, _ := os.Stat(filepath.Join(tmp, "patches"))
+		So(after.ModTime(), ShouldEqual, info.ModTime())
+
+		legacy, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(legacy)
+		db, e := bbolt.Open(filepath.Join(legacy, "patches"), 0644, nil)
+		So(e, ShouldBeNil)
+		_ = db.Update(func(tx *bbolt.Tx) error {
+			_, er := tx.CreateBucket([]byte("patches"))
+			return er
+		})
+		db.Close()
+		_, e = endpoint.OpenPatchStoreReadOnly(legacy, left, right)
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test loading the history of a file", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-patches")
+		defer os.RemoveAll(tmp)
+		ctx := context.Background()
+		left, right := memory.NewMemDB(), memory.NewMemDB()
+		left.SetTestPathURI("left")
+		right.SetTestPathURI("right")
+		store, e := endpoint.NewPatchStore(tmp, left, right, endpoint.PatchRetention{})
+		So(e, ShouldBeNil)
+		defer store.Stop()
+
+		now := time.Now()
+		add := func(stamp time.Time, source *memory.MemDB, opType merger.OperationType, path, etag, target string) {
+			patchTarget := right
+			if source == right {
+				patchTarget = left
+			}
+			patch := merger.NewPatch(source, patchTarget, merger.PatchOptions{})
+			node := &tree.Node{Path: path, Type: tree.NodeType_LEAF, Etag: etag, Size: 10}
+			if opType == merger.OpMoveFolder {
+				node.Type = tree.NodeType_COLLECTION
+			}
+			op := merger.NewOperation(opType, model.NodeToEventInfo(ctx, path, node, model.EventCreate), node)
+			if target != "" {
+				op.UpdateRefPath(target)
+			}
+			patch.Enqueue(op)
+			patch.Stamp(stamp)
+			store.Store(patch)
+		}
+		add(now.Add(-5*time.Hour), left, merger.OpCreateFile, "docs/a.txt", "e1", "")
+		add(now.Add(-4*time.Hour), right, merger.OpUpdateFile, "docs/a.txt", "e2", "")
+		add(now.Add(-3*time.Hour), left, merger.OpCreateFile, "docs/b.txt", "e3", "")
+		add(now.Add(-2*time.Hour), left, merger.OpMoveFile, "docs/a.txt", "e2", "docs/c.txt")
+		add(now.Add(-time.Hour), right, merger.OpMoveFolder, "docs", "", "archive")
+		storePatches(store, left, right, now)
+
+		history, e := store.History("/docs/a.txt", 0)
+		So(e, ShouldBeNil)
+		So(history, ShouldHaveLength, 4)
+		So(history[0].Type, ShouldEqual, "CreateFile")
+		So(history[0].Source, ShouldEqual, "left")
+		So(history[0].Target, ShouldEqual, "right")
+		So(history[0].Etag, ShouldEqual, "e1")
+		So(history[1].Type, ShouldEqual, "UpdateFile")
+		So(history[1].Source, ShouldEqual, "right")
+		So(history[1].Target, ShouldEqual, "left")
+		So(history[1].Etag, ShouldEqual, "e2")
+		So(history[2].Type, ShouldEqual, "MoveFile")
+		So(history[2].Path, ShouldEqual, "docs/c.txt")
+		So(history[3].Type, ShouldEqual, "MoveFolder")
+
+		history, _ = store.History("docs/c.txt", 0)
+		So(history, ShouldHaveLength, 2)
+		history, _ = store.History("docs/a.txt", 2)
+		So(history, ShouldHaveLength, 2)
+		So(history[1].Type, ShouldEqual, "MoveFolder")
+		_, e = store.History("/", 0)
+		So(e, ShouldNotBeNil)
+	})
+
+}
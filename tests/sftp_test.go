@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+// startSFTPServer serves SFTP on a random local port, accepting only the given client key.
+func startSFTPServer(clientKey ssh.PublicKey) (string, ssh.PublicKey, func()) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostPriv)
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	conf.AddHostKey(hostSigner)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		for {
+			nConn, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, e := ssh.NewServerConn(nConn, conf)
+				if e != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					if newChannel.ChannelType() != "session" {
+						newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					channel, reqs, _ := newChannel.Accept()
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if ok {
+								if server, e := sftp.NewServer(channel); e == nil {
+									server.Serve()
+								}
+								channel.Close()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), hostSigner.PublicKey(), func() { l.Close() }
+}
+
+func TestSFTPEndpoint(t *testing.T) {
+
+	Convey("Test sftp endpoint against an in-process server", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-sftp")
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		os.MkdirAll(root, 0755)
+
+		clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+		sshPub, _ := ssh.NewPublicKey(clientPub)
+		block, _ := ssh.MarshalPrivateKey(clientPriv, "")
+		keyFile := filepath.Join(tmp, "id_ed25519")
+		os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+
+		addr, hostKey, stop := startSFTPServer(sshPub)
+		defer stop()
+		knownHosts := filepath.Join(tmp, "known_hosts")
+		os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey)+"\n"), 0600)
+
+		u, _ := url.Parse("sftp://user@" + addr + filepath.ToSlash(root))
+		identity := &config.SSHIdentity{Id: config.SSHIdentityId("user", addr), KeyFile: keyFile, KnownHosts: knownHosts}
+
+		Convey("Connection is refused for unknown hosts or inline passwords", func() {
+			os.WriteFile(knownHosts, []byte{}, 0600)
+			_, e := endpoint.NewSFTPClient(u, identity, model.EndpointOptions{})
+			So(e, ShouldNotBeNil)
+
+			withPassword, _ := url.Parse("sftp://user:secret@" + addr + filepath.ToSlash(root))
+			_, e = endpoint.NewSFTPClient(withPassword, &config.SSHIdentity{KeyFile: keyFile, InsecureSkipHostKey: true}, model.EndpointOptions{})
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Nodes are created, loaded, walked, moved and deleted", func() {
+			client, e := endpoint.NewSFTPClient(u, identity, model.EndpointOptions{})
+			So(e, ShouldBeNil)
+			defer client.Close()
+			So(client.GetEndpointInfo().URI, ShouldEqual, "sftp://user@"+addr+filepath.ToSlash(root))
+
+			ctx := context.Background()
+			So(client.CreateNode(ctx, &tree.Node{Path: "folder", Uuid: "folder-uuid", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+			data, _ := os.ReadFile(filepath.Join(root, "folder", common.PydioSyncHiddenFile))
+			So(string(data), ShouldEqual, "folder-uuid")
+
+			w, _, _, e := client.GetWriterOn(ctx, "folder/file.txt", 7)
+			So(e, ShouldBeNil)
+			w.Write([]byte("content"))
+			So(w.Close(), ShouldBeNil)
+			data, _ = os.ReadFile(filepath.Join(root, "folder", "file.txt"))
+			So(string(data), ShouldEqual, "content")
+
+			node, e := client.LoadNode(ctx, "folder/file.txt")
+			So(e, ShouldBeNil)
+			So(node.GetSize(), ShouldEqual, 7)
+			fsClient, _ := filesystem.NewFSClient(root, model.EndpointOptions{})
+			fsNode, _ := fsClient.LoadNode(ctx, "folder/file.txt")
+			So(node.GetEtag(), ShouldEqual, fsNode.GetEtag())
+			folder, e := client.LoadNode(ctx, "folder")
+			So(e, ShouldBeNil)
+			So(folder.GetUuid(), ShouldEqual, "folder-uuid")
+			_, e = client.LoadNode(ctx, "missing")
+			So(e, ShouldNotBeNil)
+
+			var walked []string
+			e = client.Walk(ctx, func(p string, node tree.N, err error) error {
+				walked = append(walked, p)
+				return err
+			}, "/", true)
+			So(e, ShouldBeNil)
+			So(walked, ShouldResemble, []string{"folder", "folder/" + common.PydioSyncHiddenFile, "folder/file.txt"})
+
+			So(client.MoveNode(ctx, "folder", "moved"), ShouldBeNil)
+			_, e = os.Stat(filepath.Join(root, "moved", "file.txt"))
+			So(e, ShouldBeNil)
+			So(client.DeleteNode(ctx, "moved"), ShouldBeNil)
+			_, e = os.Stat(filepath.Join(root, "moved"))
+			So(os.IsNotExist(e), ShouldBeTrue)
+		})
+
+		Convey("Changes are detected by polling", func() {
+			client, e := endpoint.NewSFTPClient(u, identity, model.EndpointOptions{})
+			So(e, ShouldBeNil)
+			defer client.Close()
+			client.PollInterval = 50 * time.Millisecond
+			os.WriteFile(filepath.Join(root, "existing.txt"), []byte("content"), 0644)
+
+			watch, e := client.Watch("")
+			So(e, ShouldBeNil)
+			defer close(watch.DoneChan)
+
+			os.WriteFile(filepath.Join(root, "new.txt"), []byte("new"), 0644)
+			os.Remove(filepath.Join(root, "existing.txt"))
+			events := make(map[string]model.EventInfo)
+			timeout := time.After(5 * time.Second)
+			for len(events) < 2 {
+				select {
+				case ev := <-watch.EventInfoChan:
+					events[ev.Path] = ev
+				case <-timeout:
+					t.Fatal("no events received")
+				}
+			}
+			So(events["existing.txt"].Type, ShouldEqual, model.EventRemove)
+			So(events["new.txt"].Type, ShouldEqual, model.EventCreate)
+			So(events["new.txt"].Size, ShouldEqual, 3)
+		})
+
+	})
+
+}
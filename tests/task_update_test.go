@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/config"
+)
+
+func TestDiffTasks(t *testing.T) {
+
+	Convey("Test classifying task updates", t, func() {
+		previous := &config.Task{
+			Uuid:           "task",
+			Label:          "Documents",
+			LeftURI:        "fs:///home/user/Documents",
+			RightURI:       "https://cells.example.com/personal-files",
+			Direction:      "Bi",
+			SelectiveRoots: []string{"a", "b"},
+			Realtime:       true,
+			LoopInterval:   "PT10M",
+		}
+		update := func(modify func(t *config.Task)) config.TaskUpdate {
+			task := *previous
+			task.SelectiveRoots = append([]string{}, previous.SelectiveRoots...)
+			modify(&task)
+			return config.DiffTasks(previous, &task)
+		}
+
+		So(update(func(t *config.Task) {}), ShouldEqual, 0)
+		So(update(func(t *config.Task) { t.Label = "Docs" }), ShouldEqual, config.TaskUpdateCosmetic)
+		So(update(func(t *config.Task) { t.Hooks = &config.Hooks{} }), ShouldEqual, config.TaskUpdateCosmetic)
+		So(update(func(t *config.Task) { t.LoopInterval = "PT5M" }), ShouldEqual, config.TaskUpdateSchedule)
+		So(update(func(t *config.Task) { t.SelectiveRoots = []string{"a"} }), ShouldEqual, config.TaskUpdateFilters)
+		So(update(func(t *config.Task) { t.IgnoreRules = []string{"*.tmp"} }), ShouldEqual, config.TaskUpdateFilters)
+		// Explicit default rules are the same as nil rules
+		So(update(func(t *config.Task) { t.IgnoreRules = config.DefaultIgnoreRules }), ShouldEqual, 0)
+		So(update(func(t *config.Task) { t.Direction = "Left" }), ShouldEqual, config.TaskUpdateRestart)
+		So(update(func(t *config.Task) { t.Realtime = false }), ShouldEqual, config.TaskUpdateRestart)
+		So(update(func(t *config.Task) { t.RightURI = "https://cells.example.com/common-files" }), ShouldEqual, config.TaskUpdateEndpoints)
+
+		changes := update(func(t *config.Task) {
+			t.Label = "Docs"
+			t.HardInterval = "P1D"
+		})
+		So(changes.Has(config.TaskUpdateCosmetic), ShouldBeTrue)
+		So(changes.Has(config.TaskUpdateSchedule), ShouldBeTrue)
+		So(changes.Has(config.TaskUpdateRestart|config.TaskUpdateEndpoints), ShouldBeFalse)
+	})
+
+}
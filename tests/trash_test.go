@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+func TestTrash(t *testing.T) {
+
+	Convey("Test trash put, restore and empty", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-trash")
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		os.MkdirAll(filepath.Join(root, "folder"), 0755)
+		os.WriteFile(filepath.Join(root, "folder", "file.txt"), []byte("content"), 0644)
+
+		trash := endpoint.NewTrash(filepath.Join(tmp, "trash"), time.Hour)
+		item, e := trash.Put(root, "folder/file.txt", endpoint.TrashReasonDelete)
+		So(e, ShouldBeNil)
+		So(item.Size, ShouldEqual, 7)
+		_, e = os.Stat(filepath.Join(root, "folder", "file.txt"))
+		So(os.IsNotExist(e), ShouldBeTrue)
+		_, e = trash.Put(root, "folder/missing.txt", endpoint.TrashReasonDelete)
+		So(os.IsNotExist(e), ShouldBeTrue)
+
+		items, e := trash.List()
+		So(e, ShouldBeNil)
+		So(items, ShouldHaveLength, 1)
+		So(items[0].Path, ShouldEqual, "folder/file.txt")
+
+		restored, e := trash.Restore(item.ID)
+		So(e, ShouldBeNil)
+		So(restored, ShouldEqual, "folder/file.txt")
+		data, _ := os.ReadFile(filepath.Join(root, "folder", "file.txt"))
+		So(string(data), ShouldEqual, "content")
+		items, _ = trash.List()
+		So(items, ShouldBeEmpty)
+
+		// Restoring over an existing file uses another name
+		item, _ = trash.Put(root, "folder", endpoint.TrashReasonDelete)
+		So(item.IsDir, ShouldBeTrue)
+		os.MkdirAll(filepath.Join(root, "folder"), 0755)
+		restored, e = trash.Restore(item.ID)
+		So(e, ShouldBeNil)
+		So(restored, ShouldStartWith, "folder-restored-")
+		_, e = os.Stat(filepath.Join(root, restored, "file.txt"))
+		So(e, ShouldBeNil)
+
+		trash.Put(root, restored, endpoint.TrashReasonDelete)
+		So(trash.Empty(), ShouldBeNil)
+		items, _ = trash.List()
+		So(items, ShouldBeEmpty)
+
+		_, e = trash.Restore("../root")
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test trash retention", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-trash")
+		defer os.RemoveAll(tmp)
+		os.WriteFile(filepath.Join(tmp, "file.txt"), []byte("content"), 0644)
+
+		trash := endpoint.NewTrash(filepath.Join(tmp, "trash"), time.Millisecond)
+		trash.Put(tmp, "file.txt", endpoint.TrashReasonDelete)
+		<-time.After(10 * time.Millisecond)
+		n, e := trash.Prune()
+		So(e, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		items, _ := trash.List()
+		So(items, ShouldBeEmpty)
+	})
+
+	Convey("Test filesystem client with trash", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-trash")
+		defer os.RemoveAll(tmp)
+		root := filepath.Join(tmp, "root")
+		os.MkdirAll(root, 0755)
+		os.WriteFile(filepath.Join(root, "deleted.txt"), []byte("deleted"), 0644)
+		os.WriteFile(filepath.Join(root, "updated.txt"), []byte("old"), 0644)
+
+		fs, e := filesystem.NewFSClient(root, model.EndpointOptions{})
+		So(e, ShouldBeNil)
+		trash := endpoint.NewTrash(filepath.Join(tmp, "trash"), time.Hour)
+		client := endpoint.NewTrashFSClient(fs, trash)
+		ctx := context.Background()
+
+		So(client.DeleteNode(ctx, "deleted.txt"), ShouldBeNil)
+		_, e = os.Stat(filepath.Join(root, "deleted.txt"))
+		So(os.IsNotExist(e), ShouldBeTrue)
+
+		w, _, _, e := client.GetWriterOn(ctx, "updated.txt", 3)
+		So(e, ShouldBeNil)
+		w.Write([]byte("new"))
+		So(w.Close(), ShouldBeNil)
+		data, _ := os.ReadFile(filepath.Join(root, "updated.txt"))
+		So(string(data), ShouldEqual, "new")
+
+		w, _, _, _ = client.GetWriterOn(ctx, "created.txt", 3)
+		w.Write([]byte("new"))
+		So(w.Close(), ShouldBeNil)
+
+		items, _ := trash.List()
+		So(items, ShouldHaveLength, 2)
+		So(items[0].Path, ShouldEqual, "updated.txt")
+		So(items[0].Reason, ShouldEqual, endpoint.TrashReasonOverwrite)
+		So(items[1].Path, ShouldEqual, "deleted.txt")
+		So(items[1].Reason, ShouldEqual, endpoint.TrashReasonDelete)
+	})
+
+}
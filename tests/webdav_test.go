@@ -0,0 +1,233 @@
+/*
+ * Copyright 2019 Abstrium SAS
+ *
+ *  This file is part of Cells Sync.
+ *
+ *  Cells Sync is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  Cells Sync is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU General Public License for more details.
+ *
+ *  You should have received a copy of the GNU General Public License
+ *  along with Cells Sync.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/net/webdav"
+
+	"github.com/pydio/cells-sync/config"
+	"github.com/pydio/cells-sync/control"
+	"github.com/pydio/cells-sync/endpoint"
+	"github.com/pydio/cells/v4/common"
+	"github.com/pydio/cells/v4/common/proto/tree"
+	"github.com/pydio/cells/v4/common/sync/endpoints/filesystem"
+	"github.com/pydio/cells/v4/common/sync/model"
+)
+
+func TestWebDAVEndpoint(t *testing.T) {
+
+	Convey("Test webdav endpoint against an in-process server", t, func() {
+		tmp, _ := os.MkdirTemp("", "cells-webdav")
+		defer os.RemoveAll(tmp)
+		handler := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.Dir(tmp), LockSystem: webdav.NewMemLS()}
+		var collections []string
+		var collectionsLock sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if login, secret, ok := r.BasicAuth(); !ok || login != "login" || secret != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.Method == "MKCOL" {
+				collectionsLock.Lock()
+				collections = append(collections, r.URL.Path)
+				collectionsLock.Unlock()
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		uri := strings.Replace(server.URL, "http://", "webdav://", 1) + "/dav"
+		u, _ := url.Parse(uri)
+		creds, _ := config.NewCredentials(uri, "login", "secret")
+		ctx := context.Background()
+
+		Convey("Credentials are required", func() {
+			_, e := endpoint.NewWebDAVClient(u, nil, model.EndpointOptions{})
+			So(e, ShouldNotBeNil)
+			withPassword, _ := url.Parse(strings.Replace(uri, "webdav://", "webdav://login:secret@", 1))
+			_, e = endpoint.NewWebDAVClient(withPassword, creds, model.EndpointOptions{})
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Nodes are created, loaded, walked, copied, moved and deleted", func() {
+			client, e := endpoint.NewWebDAVClient(u, creds, model.EndpointOptions{})
+			So(e, ShouldBeNil)
+			So(client.GetEndpointInfo().URI, ShouldEqual, uri)
+
+			So(client.CreateNode(ctx, &tree.Node{Path: "folder/sub", Uuid: "sub-uuid", Type: tree.NodeType_COLLECTION}, false), ShouldBeNil)
+			collectionsLock.Lock()
+			So(collections, ShouldResemble, []string{"/dav/folder/", "/dav/folder/sub/"})
+			collectionsLock.Unlock()
+			data, _ := os.ReadFile(filepath.Join(tmp, "folder", "sub", common.PydioSyncHiddenFile))
+			So(string(data), ShouldEqual, "sub-uuid")
+
+			w, _, _, e := client.GetWriterOn(ctx, "folder/file with space.txt", 7)
+			So(e, ShouldBeNil)
+			w.Write([]byte("content"))
+			So(w.Close(), ShouldBeNil)
+			data, _ = os.ReadFile(filepath.Join(tmp, "folder", "file with space.txt"))
+			So(string(data), ShouldEqual, "content")
+
+			node, e := client.LoadNode(ctx, "folder/file with space.txt")
+			So(e, ShouldBeNil)
+			So(node.GetSize(), ShouldEqual, 7)
+			fsClient, _ := filesystem.NewFSClient(tmp, model.EndpointOptions{})
+			fsNode, _ := fsClient.LoadNode(ctx, "folder/file with space.txt")
+			So(node.GetEtag(), ShouldEqual, fsNode.GetEtag())
+			sub, e := client.LoadNode(ctx, "folder/sub")
+			So(e, ShouldBeNil)
+			So(sub.GetUuid(), ShouldEqual, "sub-uuid")
+			_, e = client.LoadNode(ctx, "missing")
+			So(e, ShouldNotBeNil)
+
+			var walked []string
+			e = client.Walk(ctx, func(p string, node tree.N, err error) error {
+				walked = append(walked, p)
+				return err
+			}, "/", true)
+			So(e, ShouldBeNil)
+			So(walked, ShouldContain, "folder/file with space.txt")
+			So(walked, ShouldContain, "folder/sub/"+common.PydioSyncHiddenFile)
+
+			So(client.CopyNode(ctx, "folder/file with space.txt", "copy.txt"), ShouldBeNil)
+			data, _ = os.ReadFile(filepath.Join(tmp, "copy.txt"))
+			So(string(data), ShouldEqual, "content")
+			So(client.MoveNode(ctx, "folder", "moved"), ShouldBeNil)
+			_, e = os.Stat(filepath.Join(tmp, "moved", "file with space.txt"))
+			So(e, ShouldBeNil)
+			So(client.DeleteNode(ctx, "moved"), ShouldBeNil)
+			_, e = os.Stat(filepath.Join(tmp, "moved"))
+			So(os.IsNotExist(e), ShouldBeTrue)
+		})
+
+		Convey("Browse-only mode does not write or hash anything", func() {
+			os.MkdirAll(filepath.Join(tmp, "folder"), 0755)
+			os.WriteFile(filepath.Join(tmp, "file.txt"), []byte("content"), 0644)
+			client, e := endpoint.NewWebDAVClient(u, creds, model.EndpointOptions{BrowseOnly: true})
+			So(e, ShouldBeNil)
+			var children []tree.N
+			e = client.Walk(ctx, func(p string, node tree.N, err error) error {
+				children = append(children, node)
+				return err
+			}, "", false)
+			So(e, ShouldBeNil)
+			So(children, ShouldHaveLength, 2)
+			So(children[1].IsLeaf(), ShouldBeFalse)
+			_, e = os.Stat(filepath.Join(tmp, "folder", common.PydioSyncHiddenFile))
+			So(os.IsNotExist(e), ShouldBeTrue)
+			node, _ := client.LoadNode(ctx, "file.txt")
+			So(node.GetEtag(), ShouldBeEmpty)
+		})
+
+		Convey("Changes are detected by polling", func() {
+			client, e := endpoint.NewWebDAVClient(u, creds, model.EndpointOptions{})
+			So(e, ShouldBeNil)
+			client.PollInterval = 50 * time.Millisecond
+			os.WriteFile(filepath.Join(tmp, "existing.txt"), []byte("content"), 0644)
+
+			watch, e := client.Watch("")
+			So(e, ShouldBeNil)
+			defer close(watch.DoneChan)
+
+			os.WriteFile(filepath.Join(tmp, "new.txt"), []byte("new"), 0644)
+			os.Remove(filepath.Join(tmp, "existing.txt"))
+			events := make(map[string]model.EventInfo)
+			timeout := time.After(5 * time.Second)
+			for len(events) < 2 {
+				select {
+				case ev := <-watch.EventInfoChan:
+					events[ev.Path] = ev
+				case <-timeout:
+					t.Fatal("no events received")
+				}
+			}
+			So(events["existing.txt"].Type, ShouldEqual, model.EventRemove)
+			So(events["new.txt"].Type, ShouldEqual, model.EventCreate)
+		})
+
+	})
+
+}
+
+func TestCredentialsKeyring(t *testing.T) {
+
+	Convey("Test credentials secrets are kept out of the config", t, func() {
+		keyring.MockInit()
+		creds, e := config.NewCredentials("webdavs://user@host:8443/some/path?poll=1m", "login", "secret")
+		So(e, ShouldBeNil)
+		So(creds.Id, ShouldEqual, "webdavs://user@host:8443")
+
+		saved, e := creds.BeforeSave()
+		So(e, ShouldBeNil)
+		So(saved.Secret, ShouldBeEmpty)
+		data, _ := json.Marshal(saved)
+		So(string(data), ShouldNotContainSubstring, "secret")
+
+		loaded := &config.Credentials{}
+		json.Unmarshal(data, loaded)
+		loaded.AfterLoad()
+		So(loaded.GetSecret(), ShouldEqual, "secret")
+		data, _ = json.Marshal(loaded)
+		So(string(data), ShouldNotContainSubstring, "secret")
+
+		keyring.MockInitWithError(errors.New("no keyring"))
+		defer keyring.MockInit()
+		_, e = creds.BeforeSave()
+		So(e, ShouldNotBeNil)
+	})
+
+	Convey("Test credentials routes reject cross-origin requests", t, func() {
+		gin.SetMode(gin.ReleaseMode)
+		router := gin.New()
+		router.PUT("/credentials", control.SameOriginOnly("http://localhost:3636"), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		for origin, status := range map[string]int{
+			"":                      http.StatusOK,
+			"http://localhost:3636": http.StatusOK,
+			"http://evil.example":   http.StatusForbidden,
+		} {
+			req := httptest.NewRequest(http.MethodPut, "/credentials", nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, status)
+		}
+	})
+
+}